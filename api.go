@@ -0,0 +1,534 @@
+package rwtxt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/schollz/rwtxt/pkg/db"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// apiPrefix is where version 1 of the JSON API is served.
+const apiPrefix = "/api/v1/"
+
+const (
+	defaultAPILimit = 50
+	maxAPILimit     = 500
+)
+
+// APIPage is a page as returned by the API. Lists leave out the data, a
+// single page has it as markdown, rendered HTML or its history, depending on
+// the format asked for.
+type APIPage struct {
+	ID        string        `json:"id"`
+	Domain    string        `json:"domain"`
+	Slug      string        `json:"slug,omitempty"`
+	Created   time.Time     `json:"created"`
+	Modified  time.Time     `json:"modified"`
+	Views     int           `json:"views"`
+	Data      string        `json:"data,omitempty"`
+	HTML      string        `json:"html,omitempty"`
+	Revisions []APIRevision `json:"revisions,omitempty"`
+}
+
+// APIRevision is one version in the history of a page.
+type APIRevision struct {
+	Timestamp int64     `json:"timestamp"`
+	Modified  time.Time `json:"modified"`
+	Data      string    `json:"data"`
+	Delta     int       `json:"delta"`
+}
+
+// APIList is a page of results from listing or searching a domain.
+type APIList struct {
+	Pages  []APIPage `json:"pages"`
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+}
+
+// apiPageRequest is the body to create or update a page. Fields that are
+// left out are not changed.
+type apiPageRequest struct {
+	Slug *string `json:"slug"`
+	Data *string `json:"data"`
+}
+
+func newAPIPage(f db.File) APIPage {
+	return APIPage{
+		ID:       f.ID,
+		Domain:   f.Domain,
+		Slug:     f.Slug,
+		Created:  f.Created,
+		Modified: f.Modified,
+		Views:    f.Views,
+	}
+}
+
+// handleAPI serves the JSON API:
+//
+//	POST   /api/v1/{domain}/keys          sign in, returns a key
+//	GET    /api/v1/{domain}/pages         list pages
+//	POST   /api/v1/{domain}/pages         create a page
+//	GET    /api/v1/{domain}/pages/{page}  get a page by id or slug
+//	PUT    /api/v1/{domain}/pages/{page}  update a page
+//	DELETE /api/v1/{domain}/pages/{page}  move a page to the trash
+//	GET    /api/v1/{domain}/search?q=     search pages
+//	GET    /api/v1/{domain}/tokens        list API tokens
+//	POST   /api/v1/{domain}/tokens        create an API token
+//	DELETE /api/v1/{domain}/tokens/{id}   revoke an API token
+//
+// Requests to a domain other than public are authenticated with a key or API
+// token of the domain in an "Authorization: Bearer" header, see apiScope.
+func (rwt *RWTxt) handleAPI(w http.ResponseWriter, r *http.Request) (err error) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		return apiError(w, http.StatusNotFound, "unknown API version")
+	}
+	fields := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	if len(fields) < 2 {
+		return apiError(w, http.StatusNotFound, "not found")
+	}
+	domain := strings.TrimSpace(strings.ToLower(fields[0]))
+	_, ispublic, _, errDomain := rwt.fs.GetDomainFromName(domain)
+	if errDomain != nil {
+		return apiError(w, http.StatusNotFound, "domain does not exist")
+	}
+
+	if fields[1] == "keys" && len(fields) == 2 {
+		if r.Method != "POST" {
+			return apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return rwt.handleAPIKey(w, r, domain)
+	}
+
+	scope, by := rwt.apiScope(r, domain, ispublic)
+	need := db.ScopeRead
+	if r.Method != "GET" {
+		need = db.ScopeWrite
+	}
+	if fields[1] == "tokens" {
+		need = db.ScopeAdmin
+	}
+	if !scope.Allows(need) {
+		if scope == "" {
+			return apiError(w, http.StatusUnauthorized, "need a key or token for the domain")
+		}
+		return apiError(w, http.StatusForbidden, "need a key or token with "+string(need)+" scope")
+	}
+
+	switch {
+	case fields[1] == "pages" && len(fields) == 2:
+		switch r.Method {
+		case "GET":
+			return rwt.handleAPIList(w, r, domain)
+		case "POST":
+			return rwt.handleAPICreate(w, r, domain, by)
+		}
+	case fields[1] == "pages" && len(fields) == 3:
+		switch r.Method {
+		case "GET":
+			return rwt.handleAPIGet(w, r, domain, fields[2])
+		case "PUT":
+			return rwt.handleAPIUpdate(w, r, domain, fields[2], by)
+		case "DELETE":
+			return rwt.handleAPIDelete(w, r, domain, fields[2], by)
+		}
+	case fields[1] == "search" && len(fields) == 2:
+		if r.Method == "GET" {
+			return rwt.handleAPISearch(w, r, domain)
+		}
+	case fields[1] == "tokens" && len(fields) == 2:
+		switch r.Method {
+		case "GET":
+			return rwt.handleAPITokens(w, r, domain)
+		case "POST":
+			return rwt.handleAPICreateToken(w, r, domain, by)
+		}
+	case fields[1] == "tokens" && len(fields) == 3:
+		if r.Method == "DELETE" {
+			return rwt.handleAPIDeleteToken(w, r, domain, fields[2], by)
+		}
+	default:
+		return apiError(w, http.StatusNotFound, "not found")
+	}
+	return apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// apiScope returns what the request may do in the domain, and who it is
+// audited as. Anyone may read and write public and read domains that were
+// made public. Everything else needs a session key, which may do what the
+// role of its user allows, or an API token of the domain.
+func (rwt *RWTxt) apiScope(r *http.Request, domain string, ispublic bool) (scope db.Scope, by db.Event) {
+	by.Domain = domain
+	if domain == "public" {
+		return db.ScopeWrite, by
+	}
+	if ispublic {
+		scope = db.ScopeRead
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if key == "" {
+		return
+	}
+	if strings.HasPrefix(key, db.TokenPrefix) {
+		t, err := rwt.fs.CheckToken(key)
+		if err != nil {
+			log.Debug(err)
+		} else if t.Domain == domain {
+			scope = t.Scope
+			by.Session = "token " + strconv.Itoa(t.ID)
+		}
+		return
+	}
+	k, err := rwt.fs.GetKey(key)
+	if err == nil && k.Domain == domain {
+		if err = rwt.fs.UpdateKeys([]string{key}); err != nil {
+			log.Debug(err)
+		}
+		scope = k.Role.Scope()
+		by.User, by.Session = k.User, db.KeyID(key)
+	}
+	return
+}
+
+func (rwt *RWTxt) handleAPIKey(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	if domain == "public" {
+		return apiError(w, http.StatusBadRequest, "public does not need a key")
+	}
+	var login struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if errDecode := json.NewDecoder(r.Body).Decode(&login); errDecode != nil {
+		return apiError(w, http.StatusBadRequest, "could not parse request: "+errDecode.Error())
+	}
+	if wait := rwt.checkLogin(r, domain, login.User); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return apiError(w, http.StatusTooManyRequests, "too many failed logins")
+	}
+	key, errKey := rwt.signIn(domain, login.User, login.Password, login.Code)
+	rwt.loginDone(r, domain, login.User, key, errKey)
+	if errKey != nil {
+		return apiError(w, http.StatusUnauthorized, errSignIn.Error())
+	}
+	return writeJSON(w, http.StatusOK, Payload{Domain: domain, DomainKey: key, Success: true})
+}
+
+// APIToken is an API token as returned by the API. The token itself is only
+// included when it is created.
+type APIToken struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	Scope    db.Scope   `json:"scope"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Token    string     `json:"token,omitempty"`
+}
+
+func newAPIToken(t db.Token) APIToken {
+	return APIToken{ID: t.ID, Name: t.Name, Scope: t.Scope, Created: t.Created, Expires: t.Expires, LastUsed: t.LastUsed}
+}
+
+func (rwt *RWTxt) handleAPITokens(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	tokens, err := rwt.fs.GetTokens(domain)
+	if err != nil {
+		return apiError(w, http.StatusInternalServerError, err.Error())
+	}
+	apiTokens := make([]APIToken, len(tokens))
+	for i, t := range tokens {
+		apiTokens[i] = newAPIToken(t)
+	}
+	return writeJSON(w, http.StatusOK, apiTokens)
+}
+
+// handleAPICreateToken creates a token from {"name", "scope", "expires"},
+// where expires is an RFC 3339 time or left out for a token that does not
+// expire.
+func (rwt *RWTxt) handleAPICreateToken(w http.ResponseWriter, r *http.Request, domain string, by db.Event) (err error) {
+	var req struct {
+		Name    string     `json:"name"`
+		Scope   string     `json:"scope"`
+		Expires *time.Time `json:"expires"`
+	}
+	if errDecode := json.NewDecoder(r.Body).Decode(&req); errDecode != nil {
+		return apiError(w, http.StatusBadRequest, "could not parse request: "+errDecode.Error())
+	}
+	scope, err := db.ParseScope(req.Scope)
+	if err != nil {
+		return apiError(w, http.StatusBadRequest, err.Error())
+	}
+	token, t, err := rwt.fs.CreateToken(domain, req.Name, scope, req.Expires)
+	if err != nil {
+		return apiError(w, http.StatusBadRequest, err.Error())
+	}
+	by.Action, by.Detail = db.AuditSettings, fmt.Sprintf("created API token %d (%s, %s)", t.ID, t.Name, t.Scope)
+	rwt.audit(r, by)
+	apiToken := newAPIToken(t)
+	apiToken.Token = token
+	return writeJSON(w, http.StatusCreated, apiToken)
+}
+
+func (rwt *RWTxt) handleAPIDeleteToken(w http.ResponseWriter, r *http.Request, domain, id string, by db.Event) (err error) {
+	tokenID, err := strconv.Atoi(id)
+	if err == nil {
+		err = rwt.fs.DeleteToken(domain, tokenID)
+	}
+	if err != nil {
+		return apiError(w, http.StatusNotFound, "no such token")
+	}
+	by.Action, by.Detail = db.AuditSettings, fmt.Sprintf("revoked API token %d", tokenID)
+	rwt.audit(r, by)
+	return writeJSON(w, http.StatusOK, Payload{ID: id, Domain: domain, Success: true})
+}
+
+// handleAPIList lists the pages of the domain, by default the most recently
+// modified first. ?sort= takes modified, created or views and ?order=asc
+// reverses it. Pages are returned ?limit= at a time, starting at ?offset=.
+func (rwt *RWTxt) handleAPIList(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	if domain == "public" && !rwt.Config.Private {
+		return apiError(w, http.StatusForbidden, "cannot list public")
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "modified"
+	}
+	if sortBy != "modified" && sortBy != "created" && sortBy != "views" {
+		return apiError(w, http.StatusBadRequest, "sort must be modified, created or views")
+	}
+	order := r.URL.Query().Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		return apiError(w, http.StatusBadRequest, "order must be asc or desc")
+	}
+
+	files, err := rwt.fs.GetAll(domain, sortBy == "created")
+	if err != nil {
+		return apiError(w, http.StatusInternalServerError, err.Error())
+	}
+	if sortBy == "views" {
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Views > files[j].Views
+		})
+	}
+	if order == "asc" {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+	return rwt.writeAPIList(w, r, files, false)
+}
+
+func (rwt *RWTxt) handleAPISearch(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	if domain == "public" && !rwt.Config.Private {
+		return apiError(w, http.StatusForbidden, "cannot search public")
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		return apiError(w, http.StatusBadRequest, "need a query")
+	}
+	files, err := rwt.fs.Find(query, domain)
+	if qerr, ok := err.(*db.QueryError); ok {
+		return apiError(w, http.StatusBadRequest, qerr.Reason)
+	} else if err != nil {
+		return apiError(w, http.StatusInternalServerError, err.Error())
+	}
+	return rwt.writeAPIList(w, r, files, true)
+}
+
+// writeAPIList writes the files selected by ?offset= and ?limit=, with their
+// data if withData is true.
+func (rwt *RWTxt) writeAPIList(w http.ResponseWriter, r *http.Request, files []db.File, withData bool) (err error) {
+	list := APIList{Total: len(files), Limit: defaultAPILimit, Pages: []APIPage{}}
+	if s := r.URL.Query().Get("offset"); s != "" {
+		list.Offset, err = strconv.Atoi(s)
+		if err != nil || list.Offset < 0 {
+			return apiError(w, http.StatusBadRequest, "offset must be a positive number")
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		list.Limit, err = strconv.Atoi(s)
+		if err != nil || list.Limit < 1 || list.Limit > maxAPILimit {
+			return apiError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAPILimit))
+		}
+	}
+	for i := list.Offset; i < len(files) && i < list.Offset+list.Limit; i++ {
+		page := newAPIPage(files[i])
+		if withData {
+			page.Data = files[i].Data
+		}
+		list.Pages = append(list.Pages, page)
+	}
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// handleAPIGet returns the page as markdown, or with ?format=html or
+// ?format=history as rendered HTML or all of its versions.
+func (rwt *RWTxt) handleAPIGet(w http.ResponseWriter, r *http.Request, domain, page string) (err error) {
+	f, status, err := rwt.apiFile(domain, page)
+	if err != nil {
+		return apiError(w, status, err.Error())
+	}
+	p := newAPIPage(f)
+	switch r.URL.Query().Get("format") {
+	case "", "markdown":
+		p.Data = f.Data
+	case "html":
+		p.HTML = string(utils.RenderMarkdownToHTML(f.Data))
+	case "history":
+		revisions, errRevisions := f.Revisions()
+		if errRevisions != nil {
+			return apiError(w, http.StatusInternalServerError, errRevisions.Error())
+		}
+		p.Revisions = make([]APIRevision, len(revisions))
+		for i, revision := range revisions {
+			p.Revisions[i] = APIRevision{
+				Timestamp: revision.Timestamp,
+				Modified:  revision.Modified(),
+				Data:      revision.Data,
+				Delta:     revision.Delta,
+			}
+		}
+	default:
+		return apiError(w, http.StatusBadRequest, "format must be markdown, html or history")
+	}
+	return writeJSON(w, http.StatusOK, p)
+}
+
+func (rwt *RWTxt) handleAPICreate(w http.ResponseWriter, r *http.Request, domain string, by db.Event) (err error) {
+	var req apiPageRequest
+	if errDecode := json.NewDecoder(r.Body).Decode(&req); errDecode != nil {
+		return apiError(w, http.StatusBadRequest, "could not parse request: "+errDecode.Error())
+	}
+	f := db.File{
+		ID:       utils.UUID(),
+		Domain:   domain,
+		Created:  time.Now().UTC(),
+		Modified: time.Now().UTC(),
+	}
+	if req.Slug != nil {
+		f.Slug = strings.TrimSpace(*req.Slug)
+		if db.IsReservedSlug(f.Slug) {
+			return apiError(w, http.StatusBadRequest, "slug "+f.Slug+" is reserved")
+		}
+	}
+	if req.Data != nil {
+		f.Data = strings.TrimSpace(*req.Data)
+	}
+	by.Action = db.AuditCreate
+	return rwt.saveAPIPage(w, r, f, http.StatusCreated, by)
+}
+
+func (rwt *RWTxt) handleAPIUpdate(w http.ResponseWriter, r *http.Request, domain, page string, by db.Event) (err error) {
+	f, status, err := rwt.apiFile(domain, page)
+	if err != nil {
+		return apiError(w, status, err.Error())
+	}
+	var req apiPageRequest
+	if errDecode := json.NewDecoder(r.Body).Decode(&req); errDecode != nil {
+		return apiError(w, http.StatusBadRequest, "could not parse request: "+errDecode.Error())
+	}
+	if req.Slug != nil {
+		f.Slug = strings.TrimSpace(*req.Slug)
+		if db.IsReservedSlug(f.Slug) {
+			return apiError(w, http.StatusBadRequest, "slug "+f.Slug+" is reserved")
+		}
+	}
+	before := f.Data
+	if req.Data != nil {
+		f.Data = strings.TrimSpace(*req.Data)
+	}
+	by.Action = pageAction(before, f.Data)
+	if by.Action == "" {
+		// renaming an empty page
+		by.Action = db.AuditSave
+	}
+	return rwt.saveAPIPage(w, r, f, http.StatusOK, by)
+}
+
+// handleAPIDelete empties the page, which moves it to the trash of the
+// domain like erasing it in the editor does.
+func (rwt *RWTxt) handleAPIDelete(w http.ResponseWriter, r *http.Request, domain, page string, by db.Event) (err error) {
+	f, status, err := rwt.apiFile(domain, page)
+	if err != nil {
+		return apiError(w, status, err.Error())
+	}
+	f.Data = ""
+	err = rwt.fs.Save(f)
+	if err != nil {
+		return apiError(w, http.StatusInternalServerError, err.Error())
+	}
+	by.Action, by.Page = db.AuditDelete, f.ID
+	rwt.audit(r, by)
+	return writeJSON(w, http.StatusOK, Payload{ID: f.ID, Domain: domain, Success: true})
+}
+
+// saveAPIPage saves the page, audits it as the event, and writes it back as
+// it was stored.
+func (rwt *RWTxt) saveAPIPage(w http.ResponseWriter, r *http.Request, f db.File, status int, by db.Event) (err error) {
+	err = rwt.fs.Save(f)
+	if err != nil {
+		return apiError(w, http.StatusInternalServerError, err.Error())
+	}
+	by.Page = f.ID
+	rwt.audit(r, by)
+	if f.Domain != "public" {
+		if errSimilar := rwt.addSimilar(f.Domain, f.ID); errSimilar != nil {
+			log.Debug(errSimilar)
+		}
+	}
+	saved, errStatus, err := rwt.apiFile(f.Domain, f.ID)
+	if err != nil {
+		return apiError(w, errStatus, err.Error())
+	}
+	p := newAPIPage(saved)
+	p.Data = saved.Data
+	return writeJSON(w, status, p)
+}
+
+// apiFile returns the page in the domain with the id or slug, with the status
+// to respond with if it can not.
+func (rwt *RWTxt) apiFile(domain, page string) (f db.File, status int, err error) {
+	id, many, err := rwt.fs.Exists(page, domain)
+	if err != nil {
+		return f, http.StatusInternalServerError, err
+	}
+	if id == "" {
+		return f, http.StatusNotFound, errNoPage
+	}
+	if many {
+		return f, http.StatusConflict, errManyPages
+	}
+	files, err := rwt.fs.Get(id, domain)
+	if err != nil || len(files) == 0 {
+		return f, http.StatusNotFound, errNoPage
+	}
+	return files[0], http.StatusOK, nil
+}
+
+var (
+	errNoPage    = errors.New("page does not exist")
+	errManyPages = errors.New("more than one page has that slug, use the id")
+)
+
+// apiError writes the message as a failed Payload. Errors are answered rather
+// than returned, so only the ones of the server are logged.
+func apiError(w http.ResponseWriter, status int, message string) error {
+	if status >= http.StatusInternalServerError {
+		log.Error(message)
+	}
+	return writeJSON(w, status, Payload{Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,138 @@
+package rwtxt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/schollz/rwtxt/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// api sends a request to the API with the key and decodes the response into
+// v.
+func api(t *testing.T, rwt *RWTxt, method, path, key, body string, v interface{}) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w, response := do(rwt, r)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	if v != nil {
+		assert.Nil(t, json.Unmarshal([]byte(response), v), response)
+	}
+	return w.Code
+}
+
+func TestAPI(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+
+	var p Payload
+	assert.Equal(t, http.StatusUnauthorized, api(t, rwt, "POST", "/api/v1/notes/keys", "", `{"password":"wrong"}`, &p))
+	// the failure makes the next login wait, see TestHandleLoginThrottled
+	rwt.logins.succeed(rwt.loginKeys(httptest.NewRequest("POST", "/", nil), "notes", "")...)
+	assert.Equal(t, http.StatusOK, api(t, rwt, "POST", "/api/v1/notes/keys", "", `{"password":"secret"}`, &p))
+	key := p.DomainKey
+	assert.NotEmpty(t, key)
+
+	assert.Equal(t, http.StatusUnauthorized, api(t, rwt, "GET", "/api/v1/notes/pages", "", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, api(t, rwt, "GET", "/api/v1/notes/pages", "nokey", "", nil))
+	assert.Equal(t, http.StatusNotFound, api(t, rwt, "GET", "/api/v1/nodomain/pages", key, "", nil))
+
+	var page APIPage
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/pages", key, `{"slug":"todo","data":"# buy milk"}`, &page))
+	assert.Equal(t, "todo", page.Slug)
+	assert.Equal(t, "# buy milk", page.Data)
+	id := page.ID
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/pages", key, `{"slug":"done","data":"nothing"}`, &page))
+	assert.Equal(t, http.StatusBadRequest, api(t, rwt, "POST", "/api/v1/notes/pages", key, `{"slug":"trash","data":"hidden"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, api(t, rwt, "PUT", "/api/v1/notes/pages/"+id, key, `{"slug":"members"}`, nil))
+
+	var list APIList
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/pages?limit=1", key, "", &list))
+	assert.Equal(t, 2, list.Total)
+	assert.Len(t, list.Pages, 1)
+	assert.Equal(t, "done", list.Pages[0].Slug)
+	assert.Empty(t, list.Pages[0].Data)
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/pages?order=asc&offset=1", key, "", &list))
+	assert.Len(t, list.Pages, 1)
+	assert.Equal(t, "done", list.Pages[0].Slug)
+	assert.Equal(t, http.StatusBadRequest, api(t, rwt, "GET", "/api/v1/notes/pages?sort=size", key, "", nil))
+
+	page = APIPage{}
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/pages/todo?format=html", key, "", &page))
+	assert.Equal(t, id, page.ID)
+	assert.Contains(t, page.HTML, "<h1")
+	assert.Empty(t, page.Data)
+
+	assert.Equal(t, http.StatusOK, api(t, rwt, "PUT", "/api/v1/notes/pages/"+id, key, `{"data":"# buy eggs"}`, &page))
+	assert.Equal(t, "todo", page.Slug, "leaving out the slug keeps it")
+	page = APIPage{}
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/pages/todo?format=history", key, "", &page))
+	assert.Len(t, page.Revisions, 2)
+	assert.Equal(t, "# buy eggs", page.Revisions[1].Data)
+
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/search?q=eggs", key, "", &list))
+	assert.Equal(t, 1, list.Total)
+	assert.Equal(t, http.StatusBadRequest, api(t, rwt, "GET", "/api/v1/notes/search?q=has:milk", key, "", nil))
+
+	assert.Equal(t, http.StatusOK, api(t, rwt, "DELETE", "/api/v1/notes/pages/todo", key, "", &p))
+	assert.True(t, p.Success)
+	files, err := fs.GetTrash("notes")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, http.StatusNotFound, api(t, rwt, "GET", "/api/v1/notes/pages/nopage", key, "", nil))
+}
+
+func TestAPIPublic(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	assert.Nil(t, fs.UpdateDomain("notes", "", true, db.DomainOptions{}))
+	assert.Nil(t, fs.Save(db.File{ID: "abc", Slug: "todo", Data: "buy milk", Domain: "notes"}))
+
+	// domains made public can be read, but not changed, without a key
+	var page APIPage
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/pages/todo", "", "", &page))
+	assert.Equal(t, "buy milk", page.Data)
+	assert.Equal(t, http.StatusForbidden, api(t, rwt, "PUT", "/api/v1/notes/pages/todo", "", `{"data":""}`, nil))
+
+	// public can be written by anyone, but not listed
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/public/pages", "", `{"data":"hello"}`, &page))
+	assert.Equal(t, http.StatusForbidden, api(t, rwt, "GET", "/api/v1/public/pages", "", "", nil))
+}
+
+func TestAPITokens(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	key, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+
+	var token APIToken
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/tokens", key, `{"name":"bot","scope":"read"}`, &token))
+	assert.Equal(t, db.ScopeRead, token.Scope)
+	read := token.Token
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/tokens", key, `{"name":"writer","scope":"write"}`, &token))
+	write := token.Token
+
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/pages", read, "", nil))
+	assert.Equal(t, http.StatusForbidden, api(t, rwt, "POST", "/api/v1/notes/pages", read, `{"data":"hi"}`, nil))
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/pages", write, `{"data":"hi"}`, nil))
+	assert.Equal(t, http.StatusForbidden, api(t, rwt, "GET", "/api/v1/notes/tokens", write, "", nil))
+
+	var tokens []APIToken
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/notes/tokens", key, "", &tokens))
+	assert.Len(t, tokens, 2)
+	assert.Empty(t, tokens[0].Token, "tokens are only shown when created")
+	assert.NotNil(t, tokens[0].LastUsed)
+
+	// tokens only work in their own domain
+	assert.Nil(t, fs.SetDomain("other", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, api(t, rwt, "GET", "/api/v1/other/pages", write, "", nil))
+
+	assert.Equal(t, http.StatusOK, api(t, rwt, "DELETE", "/api/v1/notes/tokens/"+strconv.Itoa(token.ID), key, "", nil))
+	assert.Equal(t, http.StatusUnauthorized, api(t, rwt, "GET", "/api/v1/notes/pages", write, "", nil))
+}
@@ -0,0 +1,111 @@
+package rwtxt
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/schollz/logger"
+	"github.com/schollz/rwtxt/pkg/db"
+)
+
+// auditLimit is how many events the audit page shows.
+const auditLimit = 500
+
+// remoteAddr returns the address the request came from, without its port.
+// With Config.TrustProxy it is the last one in X-Forwarded-For, which the
+// proxy in front of rwtxt adds, as every request comes from the proxy itself.
+func (rwt *RWTxt) remoteAddr(r *http.Request) string {
+	if rwt.Config.TrustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// audit records the event, from the address of the request, in the audit log
+// of its domain. The public domain has no one to show the log to, so nothing
+// is recorded for it. A failure to record is logged, but does not fail the
+// request.
+func (rwt *RWTxt) audit(r *http.Request, e db.Event) {
+	if e.Domain == "" || e.Domain == "public" {
+		return
+	}
+	e.Time = rwt.now()
+	e.Remote = rwt.remoteAddr(r)
+	if err := rwt.fs.Audit(e); err != nil {
+		log.Errorf("could not audit %s in %s: %s", e.Action, e.Domain, err)
+	}
+}
+
+// audit records the event as done by whoever is signed in to the domain.
+func (tr *TemplateRender) audit(r *http.Request, action db.AuditAction, page, detail string) {
+	tr.rwt.audit(r, db.Event{
+		Domain:  tr.Domain,
+		Action:  action,
+		Page:    page,
+		User:    tr.User,
+		Session: db.KeyID(tr.DomainKey),
+		Detail:  detail,
+	})
+}
+
+// pageAction returns how saving a page with data over what it had before is
+// audited, which is nothing if it was and stays empty.
+func pageAction(before, after string) db.AuditAction {
+	switch {
+	case before == "" && after == "":
+		return ""
+	case before == "":
+		return db.AuditCreate
+	case after == "":
+		return db.AuditDelete
+	}
+	return db.AuditSave
+}
+
+// handleAudit shows the most recent events of the domain to anyone signed in
+// to it, optionally only those of ?action= or ?user=.
+func (tr *TemplateRender) handleAudit(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.SignedIn || tr.Domain == "public" {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must sign in")), 302)
+		return
+	}
+
+	filter := db.AuditFilter{Domain: tr.Domain, User: r.URL.Query().Get("user"), Limit: auditLimit}
+	if action := r.URL.Query().Get("action"); action != "" {
+		filter.Action, err = db.ParseAuditAction(action)
+		if err != nil {
+			tr.Message = err.Error()
+		}
+	}
+	tr.Events, err = tr.rwt.fs.GetAudit(filter)
+	if err != nil {
+		return
+	}
+	tr.Search = string(filter.Action)
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "audit | " + tr.Domain
+	tr.NumResults = len(tr.Events)
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.auditTemplate.Execute(gz, tr)
+}
+
+// AuditActions are the actions the audit log can be filtered by.
+func (tr *TemplateRender) AuditActions() []db.AuditAction {
+	return db.AuditActions
+}
@@ -0,0 +1,146 @@
+package rwtxt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/schollz/rwtxt/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleAudit(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	now := time.Unix(1500000000, 0)
+	rwt.now = func() time.Time { return now }
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	actions := func(filter db.AuditFilter) (actions []string) {
+		filter.Domain = "notes"
+		events, err := fs.GetAudit(filter)
+		assert.Nil(t, err)
+		for _, e := range events {
+			actions = append(actions, string(e.Action))
+		}
+		return
+	}
+
+	// logins, and failed ones, with where they came from
+	w, _ := do(rwt, postForm("/login", url.Values{"domain": {"notes"}, "password": {"wrong"}}))
+	assert.Equal(t, http.StatusFound, w.Code)
+	now = now.Add(time.Hour)
+	w, _ = do(rwt, postForm("/login", url.Values{"domain": {"notes"}, "password": {"secret"}}))
+	cookie := w.Result().Cookies()[0]
+	events, err := fs.GetAudit(db.AuditFilter{Domain: "notes"})
+	assert.Nil(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, db.AuditLogin, events[0].Action)
+		assert.Equal(t, db.KeyID(cookie.Value), events[0].Session)
+		assert.Len(t, events[0].Session, 12)
+		assert.Equal(t, "192.0.2.1", events[0].Remote)
+		assert.True(t, events[0].Time.Equal(now))
+		assert.Equal(t, db.AuditLoginFailed, events[1].Action)
+		assert.Empty(t, events[1].Session)
+	}
+
+	// changes to the settings say what changed
+	form := url.Values{"domain": {"notes"}, "domain_key": {cookie.Value}, "ispublic": {"on"}, "sharedpassword": {"on"}, "password": {"secret2"}}
+	r := postForm("/update", form)
+	r.AddCookie(cookie)
+	do(rwt, r)
+	events, _ = fs.GetAudit(db.AuditFilter{Domain: "notes", Action: db.AuditSettings})
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "changed the password, made the domain public", events[0].Detail)
+	}
+	w, _ = do(rwt, postForm("/login", url.Values{"domain": {"notes"}, "password": {"secret2"}}))
+	cookie = w.Result().Cookies()[0]
+
+	// pages written through the API
+	var page APIPage
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/pages", cookie.Value, `{"slug":"todo","data":"# buy milk"}`, &page))
+	assert.Equal(t, http.StatusOK, api(t, rwt, "PUT", "/api/v1/notes/pages/todo", cookie.Value, `{"data":"# buy bread"}`, nil))
+	assert.Equal(t, http.StatusOK, api(t, rwt, "DELETE", "/api/v1/notes/pages/todo", cookie.Value, "", nil))
+	events, _ = fs.GetAudit(db.AuditFilter{Domain: "notes", Page: page.ID})
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, []db.AuditAction{db.AuditDelete, db.AuditSave, db.AuditCreate}, []db.AuditAction{events[0].Action, events[1].Action, events[2].Action})
+		assert.Equal(t, db.KeyID(cookie.Value), events[0].Session)
+	}
+	var token struct {
+		ID    int    `json:"id"`
+		Token string `json:"token"`
+	}
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/tokens", cookie.Value, `{"name":"bot","scope":"write"}`, &token))
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/notes/pages", token.Token, `{"slug":"bot","data":"beep"}`, &page))
+	events, _ = fs.GetAudit(db.AuditFilter{Domain: "notes", Page: page.ID})
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "token 1", events[0].Session)
+	}
+
+	// and in the browser, as soon as it is saved
+	assert.Nil(t, fs.SetDomain("other", "secret"))
+	assert.Nil(t, fs.Save(db.File{ID: "theirs", Data: "their page", Domain: "other"}))
+	server := httptest.NewServer(http.HandlerFunc(rwt.Handler))
+	defer server.Close()
+	dial := func() *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+		assert.Nil(t, err)
+		return c
+	}
+	send := func(c *websocket.Conn, p Payload) (reply Payload) {
+		assert.Nil(t, c.WriteJSON(p))
+		assert.Nil(t, c.ReadJSON(&reply))
+		return
+	}
+	if c := dial(); c != nil {
+		for _, data := range []string{"#", "# notes", "# notes for today"} {
+			send(c, Payload{ID: "typed", Slug: "today", Data: data, Domain: "notes", DomainKey: cookie.Value})
+			assert.Equal(t, []string{"create"}, actions(db.AuditFilter{Page: "typed"}))
+		}
+		c.Close()
+	}
+	// but not when the save fails
+	if c := dial(); c != nil {
+		reply := send(c, Payload{ID: "theirs", Data: "overwritten", Domain: "notes", DomainKey: cookie.Value})
+		assert.Equal(t, "not saving", reply.Message)
+		c.Close()
+	}
+	assert.Empty(t, actions(db.AuditFilter{Page: "theirs"}))
+
+	// the log is shown to those signed in
+	w, _ = do(rwt, httptest.NewRequest("GET", "/notes/audit", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	r = httptest.NewRequest("GET", "/notes/audit", nil)
+	r.AddCookie(cookie)
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "login-failed <small>")
+	assert.Contains(t, body, "made the domain public")
+	assert.Contains(t, body, "192.0.2.1")
+	assert.Contains(t, body, `href="/notes/typed"`)
+	r = httptest.NewRequest("GET", "/notes/audit?action=settings", nil)
+	r.AddCookie(cookie)
+	_, body = do(rwt, r)
+	assert.Contains(t, body, "made the domain public")
+	assert.NotContains(t, body, `href="/notes/typed"`)
+
+	// nothing is kept for the public domain
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/public/pages", "", `{"data":"hello"}`, nil))
+	events, _ = fs.GetAudit(db.AuditFilter{Domain: "public"})
+	assert.Empty(t, events)
+}
+
+func TestAuditUnknownDomain(t *testing.T) {
+	rwt, fs := newTestServer(t)
+
+	// failed logins to domains that do not exist leave nothing behind for
+	// whoever creates them later
+	w, _ := do(rwt, postForm("/login", url.Values{"domain": {"ghost"}, "user": {"alice"}, "password": {"wrong"}}))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Nil(t, fs.SetDomain("ghost", "secret"))
+	events, err := fs.GetAudit(db.AuditFilter{Domain: "ghost"})
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/rwtxt/pkg/db"
+)
+
+// commands are run as "rwtxt [flags] <command> [command flags]", after the
+// global flags such as -db have been parsed.
+var commands = map[string]func(args []string) error{
+	"migrate": migrateCommand,
+	"fsck":    fsckCommand,
+	"restore": restoreCommand,
+	"backups": backupsCommand,
+	"compact": compactCommand,
+	"domain":  domainCommand,
+	"token":   tokenCommand,
+	"user":    userCommand,
+	"audit":   auditCommand,
+}
+
+func commandNames() (names []string) {
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func runCommand(name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command '%s', expected one of %v", name, commandNames())
+	}
+	return command(args)
+}
+
+// migrateCommand reports the schema version and applies pending migrations.
+func migrateCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only report pending migrations, do not apply them")
+	flags.Parse(args)
+
+	fs, err := db.OpenStore(dbName)
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	migrator, ok := fs.(db.Migrator)
+	if !ok {
+		return fmt.Errorf("%s does not support migrations", dbName)
+	}
+
+	version, err := migrator.SchemaVersion()
+	if err != nil {
+		return
+	}
+	fmt.Printf("%s is at schema version %d\n", dbName, version)
+
+	pending, err := migrator.PendingMigrations()
+	if err != nil {
+		return
+	}
+	if len(pending) == 0 {
+		fmt.Println("no pending migrations")
+		return reportReserved(fs)
+	}
+	for _, m := range pending {
+		fmt.Printf("pending %4d  %s\n", m.Version, m.Description)
+	}
+	if *dryRun {
+		return
+	}
+
+	applied, err := migrator.Migrate()
+	for _, m := range applied {
+		fmt.Printf("applied %4d  %s\n", m.Version, m.Description)
+	}
+	if err != nil {
+		return
+	}
+	return reportReserved(fs)
+}
+
+// reportReserved warns of the domains and pages that were made before their
+// names were reserved, which rwtxt now hides behind its own paths.
+func reportReserved(fs db.Store) (err error) {
+	hidden, err := db.FindReserved(fs)
+	for _, h := range hidden {
+		fmt.Printf("warning: %s\n", h)
+	}
+	return
+}
+
+// fsckCommand finds and repairs pages whose search index is out of sync.
+func fsckCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only report problems, do not repair them")
+	flags.Parse(args)
+
+	fs, err := openMigratedStore()
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	checker, ok := fs.(db.Checker)
+	if !ok {
+		fmt.Printf("%s keeps its search index with its pages, nothing to check\n", dbName)
+		return reportReserved(fs)
+	}
+	if err = reportReserved(fs); err != nil {
+		return
+	}
+
+	problems, err := checker.Fsck(!*dryRun)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if err != nil {
+		return
+	}
+	switch {
+	case len(problems) == 0:
+		fmt.Printf("%s is consistent\n", dbName)
+	case *dryRun:
+		err = fmt.Errorf("found %d problems, run without -n to repair them", len(problems))
+	default:
+		fmt.Printf("repaired %d problems\n", len(problems))
+	}
+	return
+}
+
+// compactCommand thins out the history of every page.
+func compactCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	flags.Parse(args)
+
+	fs, err := openMigratedStore()
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	compactor, ok := fs.(db.Compactor)
+	if !ok {
+		return fmt.Errorf("%s does not support compacting history", dbName)
+	}
+
+	pages, revisions, err := compactor.Compact(time.Now().UTC())
+	if err != nil {
+		return
+	}
+	fmt.Printf("compacted the history of %d pages, removing %d revisions\n", pages, revisions)
+	return
+}
+
+// restoreCommand rebuilds the database from a dump written by DumpSQL.
+func restoreCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "dump to restore from, defaults to the most recent backup")
+	force := flags.Bool("force", false, "overwrite a database that is not empty")
+	flags.Parse(args)
+
+	if db.IsPostgres(dbName) {
+		return fmt.Errorf("only SQLite databases can be restored from a dump")
+	}
+	if *from == "" {
+		var backups []db.Backup
+		backups, err = db.ListBackups(backupDir, dbName)
+		if err != nil {
+			return
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backups of %s in %s, name a dump with -from", dbName, backupDir)
+		}
+		*from = backups[0].Path
+	}
+	rows, err := db.Restore(dbName, *from, *force)
+	if err != nil {
+		return
+	}
+	tables := make([]string, 0, len(rows))
+	for table := range rows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("restored %6d rows into %s\n", rows[table], table)
+	}
+	fmt.Printf("%s restored from %s\n", dbName, *from)
+	return
+}
+
+// backupsCommand lists the backups written to the backup directory.
+func backupsCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("backups", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rwtxt [flags] backups list\n")
+	}
+	flags.Parse(args)
+	if flags.Arg(0) != "list" {
+		flags.Usage()
+		return fmt.Errorf("expected 'list'")
+	}
+
+	backups, err := db.ListBackups(backupDir, dbName)
+	if err != nil {
+		return
+	}
+	if len(backups) == 0 {
+		fmt.Printf("no backups of %s in %s\n", dbName, backupDir)
+		return
+	}
+	for _, b := range backups {
+		fmt.Printf("%s  %10d  %s\n", b.Time.Format("2006-01-02 15:04"), b.Size, b.Path)
+	}
+	return
+}
+
+// tokenCommand creates, lists and revokes the API tokens of a domain.
+func tokenCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	domain := flags.String("domain", "", "domain of the tokens")
+	name := flags.String("name", "", "name of the new token")
+	scope := flags.String("scope", string(db.ScopeRead), "what the new token may do: read, write or admin")
+	expires := flags.Duration("expires", 0, "how long until the new token expires, it does not if 0")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rwtxt [flags] token [token flags] create|list|revoke <id>\n\nToken flags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *domain == "" || (flags.Arg(0) != "create" && flags.Arg(0) != "list" && flags.Arg(0) != "revoke") {
+		flags.Usage()
+		return fmt.Errorf("expected -domain and 'create', 'list' or 'revoke'")
+	}
+
+	fs, err := openMigratedStore()
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	if _, _, _, err = fs.GetDomainFromName(*domain); err != nil {
+		return
+	}
+
+	switch flags.Arg(0) {
+	case "create":
+		s, errScope := db.ParseScope(*scope)
+		if errScope != nil {
+			return errScope
+		}
+		var expiry *time.Time
+		if *expires > 0 {
+			t := time.Now().UTC().Add(*expires)
+			expiry = &t
+		}
+		token, t, errCreate := fs.CreateToken(*domain, *name, s, expiry)
+		if errCreate != nil {
+			return errCreate
+		}
+		fmt.Printf("created %s token %d '%s' for %s, it will not be shown again:\n%s\n", t.Scope, t.ID, t.Name, t.Domain, token)
+	case "list":
+		tokens, errList := fs.GetTokens(*domain)
+		if errList != nil {
+			return errList
+		}
+		if len(tokens) == 0 {
+			fmt.Printf("%s has no tokens\n", *domain)
+			return
+		}
+		for _, t := range tokens {
+			expiry, used := "never", "never"
+			if t.Expires != nil {
+				expiry = t.Expires.Format("2006-01-02 15:04")
+			}
+			if t.LastUsed != nil {
+				used = t.LastUsed.Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%4d  %-5s  expires %-16s  last used %-16s  %s\n", t.ID, t.Scope, expiry, used, t.Name)
+		}
+	case "revoke":
+		id, errID := strconv.Atoi(flags.Arg(1))
+		if errID != nil {
+			return fmt.Errorf("expected the id of the token to revoke")
+		}
+		err = fs.DeleteToken(*domain, id)
+		if err == nil {
+			fmt.Printf("revoked token %d\n", id)
+		}
+	}
+	return
+}
+
+// openMigratedStore opens the database, refusing to if it has pending
+// migrations.
+func openMigratedStore() (fs db.Store, err error) {
+	fs, err = db.OpenStore(dbName)
+	if err != nil {
+		return
+	}
+	if migrator, ok := fs.(db.Migrator); ok {
+		pending, errPending := migrator.PendingMigrations()
+		if errPending == nil && len(pending) > 0 {
+			errPending = fmt.Errorf("%s has pending migrations, run 'rwtxt migrate' first", dbName)
+		}
+		if errPending != nil {
+			fs.Close()
+			return nil, errPending
+		}
+	}
+	return
+}
+
+// userCommand creates users, changes their passwords, and sets or lists the
+// members of a domain.
+func userCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("user", flag.ExitOnError)
+	name := flags.String("name", "", "name of the user")
+	password := flags.String("password", "", "password of the user")
+	domain := flags.String("domain", "", "domain to set or list the members of")
+	role := flags.String("role", "", "role of the user in the domain: reader, editor or admin, or empty to remove them")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rwtxt [flags] user [user flags] add|passwd|member|members|notwofactor\n\nUser flags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	switch {
+	case (flags.Arg(0) == "add" || flags.Arg(0) == "passwd") && *name != "" && *password != "":
+	case flags.Arg(0) == "member" && *name != "" && *domain != "":
+	case flags.Arg(0) == "members" && *domain != "":
+	case flags.Arg(0) == "notwofactor" && *name != "":
+	default:
+		flags.Usage()
+		return fmt.Errorf("expected -name and -password with 'add' or 'passwd', -name and -domain with 'member', -domain with 'members', or -name with 'notwofactor'")
+	}
+
+	fs, err := openMigratedStore()
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+
+	switch flags.Arg(0) {
+	case "add":
+		err = fs.CreateUser(*name, *password)
+		if err == nil {
+			fmt.Printf("added user %s\n", *name)
+		}
+	case "passwd":
+		err = fs.SetUserPassword(*name, *password)
+		if err == nil {
+			fmt.Printf("changed the password of %s\n", *name)
+		}
+	case "notwofactor":
+		err = fs.SetTwoFactor("", *name, "", nil)
+		if err == nil {
+			fmt.Printf("turned off two-factor authentication of %s\n", *name)
+		}
+	case "member":
+		r := db.Role("")
+		if *role != "" {
+			if r, err = db.ParseRole(*role); err != nil {
+				return
+			}
+		}
+		err = fs.SetMembership(*domain, *name, r)
+		if err == nil && r == "" {
+			fmt.Printf("removed %s from %s\n", *name, *domain)
+		} else if err == nil {
+			fmt.Printf("%s is now %s of %s\n", *name, r, *domain)
+		}
+	case "members":
+		memberships, errList := fs.GetMemberships(*domain)
+		if errList != nil {
+			return errList
+		}
+		if len(memberships) == 0 {
+			fmt.Printf("%s has no members\n", *domain)
+			return
+		}
+		for _, m := range memberships {
+			fmt.Printf("%-6s  %s\n", m.Role, m.User)
+		}
+	}
+	return
+}
+
+// domainCommand creates domains, which is the only way to when rwtxt runs
+// with -nosignup.
+func domainCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("domain", flag.ExitOnError)
+	name := flags.String("name", "", "name of the domain")
+	password := flags.String("password", "", "password of the domain")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rwtxt [flags] domain [domain flags] create|notwofactor\n\nDomain flags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	switch {
+	case flags.Arg(0) == "create" && *name != "" && *password != "":
+	case flags.Arg(0) == "notwofactor" && *name != "":
+	default:
+		flags.Usage()
+		return fmt.Errorf("expected -name and -password with 'create', or -name with 'notwofactor'")
+	}
+
+	fs, err := openMigratedStore()
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	if flags.Arg(0) == "notwofactor" {
+		err = fs.SetTwoFactor(*name, "", "", nil)
+		if err == nil {
+			fmt.Printf("turned off two-factor authentication of %s\n", strings.ToLower(*name))
+		}
+		return
+	}
+	err = fs.SetDomain(*name, *password)
+	if err == nil {
+		fmt.Printf("created domain %s\n", strings.ToLower(*name))
+	}
+	return
+}
+
+// auditCommand prints the audit log, the most recent events first.
+func auditCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	domain := flags.String("domain", "", "only events of the domain")
+	action := flags.String("action", "", "only events of the action: login, login-failed, settings, create, save, delete or upload")
+	user := flags.String("user", "", "only events of the user")
+	page := flags.String("page", "", "only events of the page or upload id")
+	since := flags.String("since", "", "only events since the date, time (RFC 3339) or duration ago, such as 24h")
+	until := flags.String("until", "", "only events before the date, time (RFC 3339) or duration ago")
+	limit := flags.Int("limit", 100, "at most this many events, all if 0")
+	asJSON := flags.Bool("json", false, "print the events as JSON, one per line")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rwtxt [flags] audit [audit flags]\n\nAudit flags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	filter := db.AuditFilter{Domain: *domain, User: *user, Page: *page, Limit: *limit}
+	if *action != "" {
+		filter.Action, err = db.ParseAuditAction(*action)
+		if err != nil {
+			return
+		}
+	}
+	if filter.Since, err = parseSince(*since); err != nil {
+		return
+	}
+	if filter.Until, err = parseSince(*until); err != nil {
+		return
+	}
+
+	fs, err := openMigratedStore()
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	events, err := fs.GetAudit(filter)
+	if err != nil {
+		return
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range events {
+			if err = enc.Encode(e); err != nil {
+				return
+			}
+		}
+		return
+	}
+	for _, e := range events {
+		fmt.Printf("%s  %-12s  %-12s  %-12s  %-15s  %-12s  %s  %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Domain, e.Action, orDash(e.User), orDash(e.Remote), orDash(e.Session), orDash(e.Page), e.Detail)
+	}
+	return
+}
+
+// parseSince parses a date, an RFC 3339 time, or a duration before now. The
+// empty string is the zero time.
+func parseSince(s string) (t time.Time, err error) {
+	if s == "" {
+		return
+	}
+	if d, errDuration := time.ParseDuration(s); errDuration == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err = time.Parse(time.RFC3339, s); err == nil {
+		return
+	}
+	if t, err = time.Parse("2006-01-02", s); err == nil {
+		return
+	}
+	return t, fmt.Errorf("expected a date, time or duration, not '%s'", s)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
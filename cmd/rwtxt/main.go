@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -14,8 +15,9 @@ import (
 )
 
 var (
-	dbName  string
-	Version string
+	dbName    string
+	backupDir string
+	Version   string
 )
 
 func main() {
@@ -28,11 +30,25 @@ func main() {
 		debug           = flag.Bool("debug", false, "debug mode")
 		showVersion     = flag.Bool("v", false, "show version")
 		profileMemory   = flag.Bool("memprofile", false, "profile memory")
-		database        = flag.String("db", "rwtxt.db", "name of the database")
+		database        = flag.String("db", "rwtxt.db", "name of the SQLite database, or a postgres:// DSN")
 		listen          = flag.String("listen", ":8152", "interface:port to listen on")
 		private         = flag.Bool("private", false, "private setup (allows listing of public notes)")
 		created         = flag.Bool("created", false, "order by date created rather than date modified")
+		trash           = flag.Duration("trash", rwtxt.DefaultTrashRetention, "how long emptied pages are kept in the trash")
+		backups         = flag.String("backupdir", rwtxt.DefaultBackupDir, "directory to write backups of the SQLite database to")
+		keepLast        = flag.Int("keeplast", db.DefaultBackupPolicy.Last, "number of most recent backups to keep")
+		keepDaily       = flag.Int("keepdaily", db.DefaultBackupPolicy.Daily, "number of days to keep the last backup of")
+		keepWeekly      = flag.Int("keepweekly", db.DefaultBackupPolicy.Weekly, "number of weeks to keep the last backup of")
+		noSignup        = flag.Bool("nosignup", false, "only create domains with the domain command, not by logging in to them")
+		lockout         = flag.Int("lockout", rwtxt.DefaultLoginLockout, "number of failed logins in a row that lock out an address or account")
+		lockoutDuration = flag.Duration("lockoutduration", rwtxt.DefaultLoginLockoutDuration, "how long a lockout lasts")
+		proxy           = flag.Bool("proxy", false, "take the address of requests from the X-Forwarded-For header, only set this behind a proxy that sets it")
+		origins         = flag.String("origins", "", "comma-separated origins, like https://notes.example.com, that may open websockets besides rwtxt itself")
 	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: rwtxt [flags] [command]\n\nCommands: %v\n\nFlags:\n", commandNames())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if *profileMemory {
@@ -65,19 +81,30 @@ func main() {
 		panic(err)
 	}
 	dbName = *database
+	backupDir = *backups
 	defer log.Flush()
 
-	fs, err := db.New(dbName)
+	if flag.NArg() > 0 {
+		err = runCommand(flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rwtxt %s: %s\n", flag.Arg(0), err)
+			log.Flush()
+			os.Exit(1)
+		}
+		return
+	}
+
+	fs, err := db.NewStore(dbName)
 	if err != nil {
 		panic(err)
 	}
 
 	if *export {
-		err = fs.ExportPosts()
+		err = db.ExportPosts(fs)
 		if err != nil {
 			panic(err)
 		}
-		err = fs.ExportUploads()
+		err = db.ExportUploads(fs)
 		if err != nil {
 			panic(err)
 		}
@@ -91,6 +118,20 @@ func main() {
 		ResizeOnRequest: *resizeOnRequest,
 		ResizeOnUpload:  *resizeOnUpload,
 		OrderByCreated:  *created,
+		TrashRetention:  *trash,
+		BackupDir:       backupDir,
+		Backups: db.BackupPolicy{
+			Last:   *keepLast,
+			Daily:  *keepDaily,
+			Weekly: *keepWeekly,
+		},
+		NoSignup:             *noSignup,
+		LoginLockout:         *lockout,
+		LoginLockoutDuration: *lockoutDuration,
+		TrustProxy:           *proxy,
+	}
+	if *origins != "" {
+		config.Origins = strings.Split(*origins, ",")
 	}
 
 	rwt, err := rwtxt.New(fs, config)
@@ -0,0 +1,53 @@
+package rwtxt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// csrfCookie is the cookie that keeps the CSRF token of a browser.
+const csrfCookie = "rwtxt-csrf"
+
+// csrfToken returns the CSRF token of the browser, giving it a new one if it
+// has none yet. Every form that changes something posts the token back as
+// csrf, which checkCSRF compares to the cookie. Another site can make the
+// browser post a form, and send the cookie along, but it can not read the
+// cookie to put the token in the form.
+func csrfToken(w http.ResponseWriter, r *http.Request) (token string) {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	token = hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return
+}
+
+// checkCSRF returns whether the request carries the CSRF token of the
+// browser.
+func checkCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.FormValue("csrf"))) == 1
+}
+
+// isHTTPS returns whether the browser made the request over HTTPS, either
+// directly or through a proxy in front of rwtxt. Cookies are only marked
+// Secure then, so that rwtxt keeps working over plain HTTP.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,87 @@
+package rwtxt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRF(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+
+	// pages give the browser a token, and put it in their forms
+	w, body := do(rwt, httptest.NewRequest("GET", "/public", nil))
+	cookies := w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	assert.Equal(t, csrfCookie, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+	assert.False(t, cookies[0].Secure)
+	assert.Contains(t, body, `name="csrf" value="`+cookies[0].Value+`"`)
+
+	// the same token is kept
+	r := httptest.NewRequest("GET", "/public", nil)
+	r.AddCookie(cookies[0])
+	w, _ = do(rwt, r)
+	assert.Empty(t, w.Result().Cookies())
+
+	// forms without it, or with another one, are refused
+	form := url.Values{"domain": {"notes"}, "password": {"secret"}}
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	form.Set("csrf", "fedcba9876543210fedcba9876543210")
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFToken})
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	r = postForm("/login", url.Values{"domain": {"newdomain"}, "password": {"secret"}})
+	r.Header.Del("Cookie")
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, _, _, err := fs.GetDomainFromName("newdomain")
+	assert.NotNil(t, err)
+
+	// the session cookie is only sent along by the same site, and over HTTPS
+	// if that is how rwtxt is reached
+	r = postForm("/login", form)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	cookies = w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	session := cookies[0]
+	assert.Equal(t, "rwtxt-domains", session.Name)
+	assert.Equal(t, "/", session.Path)
+	assert.True(t, session.HttpOnly)
+	assert.True(t, session.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, session.SameSite)
+
+	// logging out has to be posted too
+	r = httptest.NewRequest("GET", "/logout?d=notes", nil)
+	r.AddCookie(session)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	for _, c := range w.Result().Cookies() {
+		assert.NotEqual(t, "rwtxt-domains", c.Name)
+	}
+	r = postForm("/logout", url.Values{"d": {"notes"}})
+	r.AddCookie(session)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	if cookies = w.Result().Cookies(); assert.Len(t, cookies, 1) {
+		assert.Equal(t, "rwtxt-domains", cookies[0].Name)
+		assert.Empty(t, cookies[0].Value)
+	}
+}
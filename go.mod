@@ -6,6 +6,7 @@ require (
 	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575
 	github.com/disintegration/imaging v1.6.2
 	github.com/gorilla/websocket v1.4.2
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/microcosm-cc/bluemonday v1.0.15
 	github.com/pkg/errors v0.9.1
@@ -14,7 +15,8 @@ require (
 	github.com/schollz/logger v1.2.0
 	github.com/schollz/sqlite3dump v1.3.0
 	github.com/schollz/versionedtext v1.0.0
-	github.com/sergi/go-diff v1.2.0 // indirect
+	github.com/sergi/go-diff v1.2.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.4.0
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d // indirect
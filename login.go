@@ -0,0 +1,176 @@
+package rwtxt
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/schollz/rwtxt/pkg/db"
+)
+
+// DefaultLoginLockout is how many failed logins in a row lock out an address
+// or an account of a domain.
+const DefaultLoginLockout = 10
+
+// DefaultLoginLockoutDuration is how long a lockout lasts.
+const DefaultLoginLockoutDuration = 15 * time.Minute
+
+// loginBackoff is how long to wait after the first failed login. It doubles
+// with each failure after that, until the lockout.
+const loginBackoff = time.Second
+
+// loginLimiter throttles password checks by counting failed logins per
+// address and per domain. Each failure doubles the time until the next
+// attempt is allowed, and after lockout failures no attempt is allowed for
+// the lockout duration. A successful login resets the count.
+type loginLimiter struct {
+	lockout  int
+	duration time.Duration
+	failures map[string]*loginFailures
+	sync.Mutex
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+func newLoginLimiter(lockout int, duration time.Duration) *loginLimiter {
+	return &loginLimiter{
+		lockout:  lockout,
+		duration: duration,
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+// wait returns how long until the next login is allowed, which is the
+// longest wait of any of the keys.
+func (l *loginLimiter) wait(now time.Time, keys ...string) (wait time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok {
+			continue
+		}
+		if w := f.last.Add(l.delay(f.count)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	return
+}
+
+// delay returns how long to wait after count failures in a row.
+func (l *loginLimiter) delay(count int) time.Duration {
+	if count >= l.lockout {
+		return l.duration
+	}
+	d := loginBackoff << uint(count-1)
+	if d > l.duration {
+		d = l.duration
+	}
+	return d
+}
+
+// fail counts a failed login for the keys, and returns the highest count.
+func (l *loginLimiter) fail(now time.Time, keys ...string) (count int) {
+	l.Lock()
+	defer l.Unlock()
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok {
+			f = &loginFailures{}
+			l.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count > count {
+			count = f.count
+		}
+	}
+	// forget about failures that no longer delay anything
+	for key, f := range l.failures {
+		if now.Sub(f.last) > l.duration {
+			delete(l.failures, key)
+		}
+	}
+	return
+}
+
+// succeed resets the failed logins of the keys.
+func (l *loginLimiter) succeed(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// loginKeys returns the keys that logins of the user to the domain from the
+// request are counted under, the address and the account, which is the shared
+// password of the domain if user is empty. Failures with one account do not
+// lock out the others of the domain.
+func (rwt *RWTxt) loginKeys(r *http.Request, domain, user string) []string {
+	return []string{"ip " + rwt.remoteAddr(r), "account " + domain + "/" + strings.ToLower(strings.TrimSpace(user))}
+}
+
+// checkLogin returns how long the login of the user to the domain has to
+// wait, if it is throttled.
+func (rwt *RWTxt) checkLogin(r *http.Request, domain, user string) (wait time.Duration) {
+	wait = rwt.logins.wait(rwt.now(), rwt.loginKeys(r, domain, user)...)
+	if wait > 0 {
+		log.Infof("throttled login to %s from %s for %s", domain, rwt.remoteAddr(r), wait.Round(time.Second))
+	}
+	return
+}
+
+// loginDone records the outcome of a login of the user to the domain, which
+// gave out the key if it succeeded. Failed logins to domains that do not
+// exist are not audited, as the audit log is kept for good and anyone could
+// fill it under made up names, which whoever creates the domain would get.
+func (rwt *RWTxt) loginDone(r *http.Request, domain, user, key string, err error) {
+	keys := rwt.loginKeys(r, domain, user)
+	if err == nil {
+		rwt.logins.succeed(keys...)
+		rwt.audit(r, db.Event{Domain: domain, Action: db.AuditLogin, User: user, Session: db.KeyID(key)})
+		return
+	}
+	count := rwt.logins.fail(rwt.now(), keys...)
+	log.Infof("failed login to %s from %s (%d in a row): %s", domain, rwt.remoteAddr(r), count, err)
+	if _, _, _, errDomain := rwt.fs.GetDomainFromName(domain); errDomain == nil {
+		rwt.audit(r, db.Event{Domain: domain, Action: db.AuditLoginFailed, User: user, Detail: err.Error()})
+	}
+}
+
+// errSignIn is the error of any failed sign in, so that it does not tell
+// which of the user, password or two-factor code was wrong.
+var errSignIn = errors.New("incorrect user, password or two-factor code")
+
+// signIn returns a new key for the domain, or for the user in the domain, if
+// the password is correct. If the domain or user is enrolled in two-factor
+// authentication, the code is checked after the password, so that a wrong
+// password does not use it up, and before the key is made, so that no
+// session exists without it.
+func (rwt *RWTxt) signIn(domain, user, password, code string) (key string, err error) {
+	defer func() {
+		if err != nil {
+			log.Debugf("sign in to %s: %s", domain, err)
+			err = errSignIn
+		}
+	}()
+	err = rwt.fs.CheckPassword(domain, user, password)
+	if err != nil {
+		return
+	}
+	err = rwt.fs.CheckTwoFactor(domain, user, code, rwt.now())
+	if err != nil {
+		return
+	}
+	if user != "" {
+		return rwt.fs.SetUserKey(domain, user, password)
+	}
+	return rwt.fs.SetKey(domain, password)
+}
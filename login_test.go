@@ -0,0 +1,183 @@
+package rwtxt
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/schollz/rwtxt/pkg/db"
+	"github.com/schollz/rwtxt/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	l := newLoginLimiter(3, time.Minute)
+	now := time.Now()
+	assert.Zero(t, l.wait(now, "ip a"))
+
+	// each failure doubles the wait
+	assert.Equal(t, 1, l.fail(now, "ip a", "domain d"))
+	assert.Equal(t, time.Second, l.wait(now, "ip a"))
+	assert.Equal(t, time.Second, l.wait(now, "ip b", "domain d"))
+	assert.Zero(t, l.wait(now.Add(time.Second), "ip a"))
+	assert.Equal(t, 2, l.fail(now, "ip a"))
+	assert.Equal(t, 2*time.Second, l.wait(now, "ip a"))
+
+	// until the lockout
+	assert.Equal(t, 3, l.fail(now, "ip a"))
+	assert.Equal(t, time.Minute, l.wait(now, "ip a"))
+	assert.Zero(t, l.wait(now.Add(time.Minute), "ip a"))
+
+	l.succeed("ip a")
+	assert.Zero(t, l.wait(now, "ip a"))
+
+	// old failures are forgotten
+	l.fail(now.Add(2*time.Minute), "ip c")
+	assert.NotContains(t, l.failures, "domain d")
+}
+
+func login(rwt *RWTxt, domain, password string) *httptest.ResponseRecorder {
+	form := url.Values{"domain": {domain}, "password": {password}}
+	r := postForm("/login", form)
+	w, _ := do(rwt, r)
+	return w
+}
+
+func TestHandleLoginThrottled(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	// the clock stands still, so the backoff does not run out while
+	// passwords are hashed
+	now := time.Now()
+	rwt.now = func() time.Time { return now }
+
+	w := login(rwt, "notes", "wrong")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+
+	// even the right password has to wait after a failure
+	w = login(rwt, "notes", "secret")
+	assert.Empty(t, w.Result().Cookies())
+	assert.Contains(t, w.Header().Get("Location"), "/public?m=")
+
+	var p Payload
+	assert.Equal(t, http.StatusTooManyRequests, api(t, rwt, "POST", "/api/v1/notes/keys", "", `{"password":"secret"}`, &p))
+
+	rwt.logins.succeed(rwt.loginKeys(httptest.NewRequest("POST", "/login", nil), "notes", "")...)
+	w = login(rwt, "notes", "secret")
+	assert.Len(t, w.Result().Cookies(), 1)
+
+	// failures with one account do not hold up the other accounts of the
+	// domain from elsewhere
+	assert.Nil(t, fs.CreateUser("alice", "pass"))
+	assert.Nil(t, fs.SetMembership("notes", "alice", db.RoleEditor))
+	loginFrom := func(addr string, form url.Values) *httptest.ResponseRecorder {
+		r := postForm("/login", form)
+		r.RemoteAddr = addr + ":1234"
+		w, _ := do(rwt, r)
+		return w
+	}
+	w = loginFrom("198.51.100.1", url.Values{"domain": {"notes"}, "user": {"alice"}, "password": {"wrong"}})
+	assert.Empty(t, w.Result().Cookies())
+	w = loginFrom("198.51.100.2", url.Values{"domain": {"notes"}, "password": {"secret"}})
+	assert.Len(t, w.Result().Cookies(), 1)
+	w = loginFrom("198.51.100.2", url.Values{"domain": {"notes"}, "user": {"alice"}, "password": {"pass"}})
+	assert.Empty(t, w.Result().Cookies())
+}
+
+func TestHandleLoginBehindProxy(t *testing.T) {
+	fs := db.NewMemory()
+	rwt, err := New(fs, Config{TrustProxy: true})
+	assert.Nil(t, err)
+	now := time.Now()
+	rwt.now = func() time.Time { return now }
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	assert.Nil(t, fs.CreateUser("alice", "pass"))
+	assert.Nil(t, fs.SetMembership("notes", "alice", db.RoleEditor))
+	loginVia := func(forwarded string, form url.Values) *httptest.ResponseRecorder {
+		r := postForm("/login", form)
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w, _ := do(rwt, r)
+		return w
+	}
+
+	// clients behind the same proxy are told apart by the address it adds
+	w := loginVia("203.0.113.7, 198.51.100.1", url.Values{"domain": {"notes"}, "user": {"alice"}, "password": {"wrong"}})
+	assert.Empty(t, w.Result().Cookies())
+	w = loginVia("198.51.100.2", url.Values{"domain": {"notes"}, "password": {"secret"}})
+	assert.Len(t, w.Result().Cookies(), 1)
+	events, err := fs.GetAudit(db.AuditFilter{Domain: "notes"})
+	assert.Nil(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "198.51.100.2", events[0].Remote)
+		assert.Equal(t, "198.51.100.1", events[1].Remote)
+	}
+
+	// without a proxy anyone could send the header, so it is ignored
+	rwt, _ = newTestServer(t)
+	r := postForm("/login", url.Values{})
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "192.0.2.1", rwt.remoteAddr(r))
+}
+
+func TestHandleLoginNoSignup(t *testing.T) {
+	fs := db.NewMemory()
+	rwt, err := New(fs, Config{NoSignup: true})
+	assert.Nil(t, err)
+
+	w := login(rwt, "newdomain", "secret")
+	assert.Empty(t, w.Result().Cookies())
+	_, _, _, err = fs.GetDomainFromName("newdomain")
+	assert.NotNil(t, err, "domains are not created by logging in")
+}
+
+func TestHandleLoginTwoFactor(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	now := time.Unix(1500000000, 0)
+	rwt.now = func() time.Time { return now }
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	secret, _ := utils.NewTOTPSecret()
+	recoveryCodes, _ := db.NewRecoveryCodes()
+	assert.Nil(t, fs.SetTwoFactor("notes", "", secret, recoveryCodes))
+	loginCode := func(code string) *httptest.ResponseRecorder {
+		// wait out the throttling of the failure before
+		now = now.Add(time.Minute)
+		form := url.Values{"domain": {"notes"}, "password": {"secret"}, "code": {code}}
+		r := postForm("/login", form)
+		w, _ := do(rwt, r)
+		return w
+	}
+
+	// the password is not enough
+	w := login(rwt, "notes", "secret")
+	assert.Empty(t, w.Result().Cookies())
+	assert.Contains(t, w.Header().Get("Location"), "/public?m=")
+	assert.Empty(t, loginCode("000000").Result().Cookies())
+
+	// a wrong password does not use up the code, and fails like any other
+	now = now.Add(time.Minute)
+	wrong := url.Values{"domain": {"notes"}, "password": {"wrong"}, "code": {recoveryCodes[0]}}
+	w, _ = do(rwt, postForm("/login", wrong))
+	assert.Empty(t, w.Result().Cookies())
+	assert.Equal(t, "/public?m="+base64.URLEncoding.EncodeToString([]byte(errSignIn.Error())), w.Header().Get("Location"))
+	now = now.Add(time.Minute)
+	code, _ := utils.TOTPCode(secret, utils.TOTPStep(now.Add(time.Minute)))
+	wrong.Set("code", code)
+	w, _ = do(rwt, postForm("/login", wrong))
+	assert.Empty(t, w.Result().Cookies())
+
+	assert.Len(t, loginCode(code).Result().Cookies(), 1)
+	assert.Len(t, loginCode(recoveryCodes[0]).Result().Cookies(), 1)
+	assert.Empty(t, loginCode(recoveryCodes[0]).Result().Cookies())
+
+	now = now.Add(time.Minute)
+	var p Payload
+	assert.Equal(t, http.StatusUnauthorized, api(t, rwt, "POST", "/api/v1/notes/keys", "", `{"password":"secret"}`, &p))
+	now = now.Add(time.Minute)
+	code, _ = utils.TOTPCode(secret, utils.TOTPStep(now))
+	assert.Equal(t, http.StatusOK, api(t, rwt, "POST", "/api/v1/notes/keys", "", `{"password":"secret","code":"`+code+`"}`, &p))
+	assert.NotEmpty(t, p.DomainKey)
+}
@@ -0,0 +1,228 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditAction is what an event in the audit log records.
+type AuditAction string
+
+const (
+	// AuditLogin is a successful login, or a key given out by the API.
+	AuditLogin AuditAction = "login"
+	// AuditLoginFailed is a login with a wrong password or code.
+	AuditLoginFailed AuditAction = "login-failed"
+	// AuditSettings is a change to the options, passwords, members, tokens
+	// or two-factor authentication of a domain.
+	AuditSettings AuditAction = "settings"
+	// AuditCreate is a page that was written for the first time.
+	AuditCreate AuditAction = "create"
+	// AuditSave is a change to a page, or the restore of an old version.
+	AuditSave AuditAction = "save"
+	// AuditDelete is a page that was emptied, which moves it to the trash.
+	AuditDelete AuditAction = "delete"
+	// AuditUpload is a file that was uploaded.
+	AuditUpload AuditAction = "upload"
+)
+
+// AuditActions are all the actions, in the order they are listed in.
+var AuditActions = []AuditAction{AuditLogin, AuditLoginFailed, AuditSettings, AuditCreate, AuditSave, AuditDelete, AuditUpload}
+
+// ParseAuditAction returns the action with the name.
+func ParseAuditAction(s string) (action AuditAction, err error) {
+	action = AuditAction(strings.ToLower(strings.TrimSpace(s)))
+	for _, a := range AuditActions {
+		if a == action {
+			return
+		}
+	}
+	err = errors.New("action must be one of login, login-failed, settings, create, save, delete or upload")
+	return
+}
+
+// Event is an entry in the audit log of a domain.
+type Event struct {
+	ID      int         `json:"id"`
+	Time    time.Time   `json:"time"`
+	Domain  string      `json:"domain"`
+	Action  AuditAction `json:"action"`
+	Page    string      `json:"page,omitempty"`    // the page or upload, if any
+	User    string      `json:"user,omitempty"`    // the member, if it was not the shared password
+	Session string      `json:"session,omitempty"` // the KeyID of the session, or the API token
+	Remote  string      `json:"remote,omitempty"`  // the address of the client
+	Detail  string      `json:"detail,omitempty"`
+}
+
+// AuditFilter selects events from the audit log. Empty fields select
+// everything.
+type AuditFilter struct {
+	Domain string
+	Action AuditAction
+	User   string
+	Page   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// matches returns whether the event is selected by the filter.
+func (f AuditFilter) matches(e Event) bool {
+	return (f.Domain == "" || strings.ToLower(f.Domain) == e.Domain) &&
+		(f.Action == "" || f.Action == e.Action) &&
+		(f.User == "" || strings.ToLower(f.User) == e.User) &&
+		(f.Page == "" || f.Page == e.Page) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// where returns the SQL conditions of the filter and their arguments.
+func (f AuditFilter) where() (where string, args []interface{}) {
+	conditions := []string{"1 = 1"}
+	if f.Domain != "" {
+		conditions = append(conditions, "domain = ?")
+		args = append(args, strings.ToLower(f.Domain))
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, string(f.Action))
+	}
+	if f.User != "" {
+		conditions = append(conditions, "username = ?")
+		args = append(args, strings.ToLower(f.User))
+	}
+	if f.Page != "" {
+		conditions = append(conditions, "page = ?")
+		args = append(args, f.Page)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "created >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "created < ?")
+		args = append(args, f.Until.UTC())
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// AuditStore keeps the audit log. It can only be appended to, events are
+// never changed or deleted.
+type AuditStore interface {
+	// Audit adds the event to the log, at the current time if it has none.
+	Audit(e Event) error
+	// GetAudit returns the events selected by the filter, the most recent
+	// first.
+	GetAudit(filter AuditFilter) ([]Event, error)
+}
+
+// newEvent fills in the time of the event and cleans up its names.
+func newEvent(e Event) (Event, error) {
+	if e.Domain == "" || e.Action == "" {
+		return e, errors.New("event needs a domain and an action")
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Domain = strings.ToLower(e.Domain)
+	e.User = strings.ToLower(e.User)
+	return e, nil
+}
+
+const insertEvent = `INSERT INTO audit (created, domain, action, page, username, session, remote, detail) VALUES (?,?,?,?,?,?,?,?)`
+
+func getAudit(db queryer, bind func(string) string, filter AuditFilter) (events []Event, err error) {
+	where, args := filter.where()
+	query := `SELECT id, created, domain, action, page, username, session, remote, detail FROM audit WHERE ` + where + ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+	stmt, err := db.Prepare(bind(query))
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing audit")
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "get audit")
+	}
+	defer rows.Close()
+	events = []Event{}
+	for rows.Next() {
+		var e Event
+		var action string
+		err = rows.Scan(&e.ID, &e.Time, &e.Domain, &action, &e.Page, &e.User, &e.Session, &e.Remote, &e.Detail)
+		if err != nil {
+			return nil, errors.Wrap(err, "get audit")
+		}
+		e.Action = AuditAction(action)
+		events = append(events, e)
+	}
+	err = rows.Err()
+	return
+}
+
+// Audit adds the event to the log.
+func (fs *FileSystem) Audit(e Event) (err error) {
+	e, err = newEvent(e)
+	if err != nil {
+		return
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.DB.Exec(insertEvent, e.Time, e.Domain, string(e.Action), e.Page, e.User, e.Session, e.Remote, e.Detail)
+	return errors.Wrap(err, "insert event")
+}
+
+// GetAudit returns the events selected by the filter.
+func (fs *FileSystem) GetAudit(filter AuditFilter) (events []Event, err error) {
+	return getAudit(fs.reader, bindSQLite, filter)
+}
+
+// Audit adds the event to the log.
+func (pg *Postgres) Audit(e Event) (err error) {
+	e, err = newEvent(e)
+	if err != nil {
+		return
+	}
+	_, err = pg.exec(insertEvent, e.Time, e.Domain, string(e.Action), e.Page, e.User, e.Session, e.Remote, e.Detail)
+	return errors.Wrap(err, "insert event")
+}
+
+// GetAudit returns the events selected by the filter.
+func (pg *Postgres) GetAudit(filter AuditFilter) (events []Event, err error) {
+	return getAudit(pg.DB, bindPostgres, filter)
+}
+
+// Audit adds the event to the log.
+func (m *Memory) Audit(e Event) (err error) {
+	e, err = newEvent(e)
+	if err != nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	e.ID = len(m.audit) + 1
+	m.audit = append(m.audit, e)
+	return
+}
+
+// GetAudit returns the events selected by the filter.
+func (m *Memory) GetAudit(filter AuditFilter) (events []Event, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	events = []Event{}
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(events) == filter.Limit {
+			break
+		}
+		if filter.matches(m.audit[i]) {
+			events = append(events, m.audit[i])
+		}
+	}
+	return
+}
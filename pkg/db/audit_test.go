@@ -0,0 +1,86 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testAudit(t, s)
+		})
+	}
+}
+
+func TestParseAuditAction(t *testing.T) {
+	action, err := ParseAuditAction(" Login-Failed ")
+	assert.Nil(t, err)
+	assert.Equal(t, AuditLoginFailed, action)
+	_, err = ParseAuditAction("logout")
+	assert.NotNil(t, err)
+}
+
+func testAudit(t *testing.T, s Store) {
+	now := time.Unix(1500000000, 0)
+	assert.NotNil(t, s.Audit(Event{Action: AuditLogin}))
+	assert.NotNil(t, s.Audit(Event{Domain: "work"}))
+
+	assert.Nil(t, s.Audit(Event{Time: now, Domain: "Work", Action: AuditLoginFailed, Remote: "10.0.0.1"}))
+	assert.Nil(t, s.Audit(Event{Time: now.Add(time.Minute), Domain: "work", Action: AuditLogin, User: "Alice", Session: "0123456789ab", Remote: "10.0.0.1"}))
+	assert.Nil(t, s.Audit(Event{Time: now.Add(2 * time.Minute), Domain: "work", Action: AuditCreate, Page: "abc", User: "alice"}))
+	assert.Nil(t, s.Audit(Event{Time: now.Add(3 * time.Minute), Domain: "home", Action: AuditSave, Page: "def"}))
+	assert.Nil(t, s.Audit(Event{Domain: "work", Action: AuditSettings, Detail: "made the domain public"}))
+
+	events, err := s.GetAudit(AuditFilter{Domain: "WORK"})
+	assert.Nil(t, err)
+	if !assert.Len(t, events, 4) {
+		return
+	}
+	assert.Equal(t, AuditSettings, events[0].Action, "the most recent comes first")
+	assert.Equal(t, "made the domain public", events[0].Detail)
+	assert.WithinDuration(t, time.Now(), events[0].Time, time.Minute)
+	assert.Equal(t, AuditCreate, events[1].Action)
+	assert.Equal(t, "abc", events[1].Page)
+	assert.Equal(t, "work", events[2].Domain)
+	assert.Equal(t, "alice", events[2].User)
+	assert.Equal(t, "0123456789ab", events[2].Session)
+	assert.Equal(t, "10.0.0.1", events[2].Remote)
+	assert.True(t, events[2].Time.Equal(now.Add(time.Minute)))
+	assert.Equal(t, AuditLoginFailed, events[3].Action)
+	assert.True(t, events[0].ID > events[1].ID)
+
+	events, _ = s.GetAudit(AuditFilter{Domain: "work", Action: AuditLogin})
+	assert.Len(t, events, 1)
+	events, _ = s.GetAudit(AuditFilter{User: "ALICE"})
+	assert.Len(t, events, 2)
+	events, _ = s.GetAudit(AuditFilter{Page: "def"})
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "home", events[0].Domain)
+	}
+	events, _ = s.GetAudit(AuditFilter{Since: now.Add(time.Minute), Until: now.Add(3 * time.Minute)})
+	assert.Len(t, events, 2)
+	events, _ = s.GetAudit(AuditFilter{Limit: 3})
+	assert.Len(t, events, 3)
+	events, err = s.GetAudit(AuditFilter{Domain: "nodomain"})
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+
+	// the log can not be rewritten, even by going around the store
+	switch s := s.(type) {
+	case *FileSystem:
+		_, err = s.DB.Exec(`UPDATE audit SET detail = 'nothing happened'`)
+		assert.NotNil(t, err)
+		_, err = s.DB.Exec(`DELETE FROM audit`)
+		assert.NotNil(t, err)
+	case *Postgres:
+		_, err = s.DB.Exec(`UPDATE audit SET detail = 'nothing happened'`)
+		assert.NotNil(t, err)
+		_, err = s.DB.Exec(`DELETE FROM audit`)
+		assert.NotNil(t, err)
+	}
+	events, _ = s.GetAudit(AuditFilter{})
+	assert.Len(t, events, 5)
+}
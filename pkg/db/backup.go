@@ -0,0 +1,248 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/schollz/sqlite3dump"
+)
+
+// backupTimeFormat is the timestamp in the name of a backup, in UTC.
+const backupTimeFormat = "20060102-150405"
+
+// oldBackupTimeFormat is the timestamp of backups written before it had
+// seconds, which are still listed and pruned.
+const oldBackupTimeFormat = "20060102-1504"
+
+// Backup is a gzipped SQL dump of the database, which can be restored with
+// Restore.
+type Backup struct {
+	Name string // base name of the database
+	Path string
+	Time time.Time
+	Size int64
+}
+
+// BackupPolicy says which backups PruneBackups keeps: the Last most recent
+// ones, the most recent one of each of the last Daily days and the most
+// recent one of each of the last Weekly weeks that have backups.
+type BackupPolicy struct {
+	Last   int
+	Daily  int
+	Weekly int
+}
+
+// DefaultBackupPolicy keeps the backups of the last twenty minutes or so, a
+// week of daily ones and a month of weekly ones.
+var DefaultBackupPolicy = BackupPolicy{Last: 10, Daily: 7, Weekly: 4}
+
+// Backuper is implemented by stores that can write timestamped backups of
+// themselves.
+type Backuper interface {
+	// Backup writes a new backup to dir, which is created if needed.
+	Backup(dir string) (Backup, error)
+}
+
+// Backup writes a dump of the database to dir as name-YYYYMMDD-HHMMSS.sql.gz,
+// where name is the base name of the database. The dump is taken from a
+// snapshot made with SQLite's online backup API, so neither reads nor writes
+// wait for it, and is only moved into place once it is complete.
+func (fs *FileSystem) Backup(dir string) (b Backup, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	b.Name = filepath.Base(fs.Name)
+	b.Time = time.Now().UTC()
+	b.Path = filepath.Join(dir, fmt.Sprintf("%s-%s.sql.gz", b.Name, b.Time.Format(backupTimeFormat)))
+	err = fs.dump(b.Path)
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(b.Path)
+	if err != nil {
+		return
+	}
+	b.Size = info.Size()
+	return
+}
+
+// dump writes a gzipped dump of a snapshot of the database to filename.
+func (fs *FileSystem) dump(filename string) (err error) {
+	snapshot := filename + ".snapshot"
+	defer os.Remove(snapshot)
+	err = fs.snapshot(snapshot)
+	if err != nil {
+		return
+	}
+	db, err := sql.Open("sqlite3", snapshot)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	// do not let a corrupted database replace a good dump
+	var check string
+	err = db.QueryRow(`PRAGMA quick_check`).Scan(&check)
+	if err != nil {
+		return errors.Wrap(err, "checking snapshot")
+	}
+	if check != "ok" {
+		return fmt.Errorf("%s is corrupted: %s", fs.Name, check)
+	}
+
+	tmp := filename + ".tmp"
+	defer os.Remove(tmp)
+	fi, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	gf := gzip.NewWriter(fi)
+	fw := bufio.NewWriter(gf)
+	err = sqlite3dump.DumpMigration(db, fw)
+	if err == nil {
+		err = fw.Flush()
+	}
+	if err == nil {
+		err = gf.Close()
+	}
+	if errClose := fi.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return errors.Wrap(err, "dumping "+fs.Name)
+	}
+	return os.Rename(tmp, filename)
+}
+
+// snapshot copies the database to filename with SQLite's online backup API,
+// reading from one of the read-only connections.
+func (fs *FileSystem) snapshot(filename string) (err error) {
+	ctx := context.Background()
+	os.Remove(filename)
+	dst, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer dstConn.Close()
+	srcConn, err := fs.reader.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer srcConn.Close()
+
+	err = dstConn.Raw(func(dstDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			to, ok := dstDriver.(*sqlite3.SQLiteConn)
+			from, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("online backup needs the github.com/mattn/go-sqlite3 driver")
+			}
+			backup, err := to.Backup("main", from, "main")
+			if err != nil {
+				return err
+			}
+			// a single step copies everything within one read transaction
+			_, err = backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		err = errors.Wrap(err, "backing up "+fs.Name)
+	}
+	return
+}
+
+// ListBackups returns the backups of the database name in dir, most recent
+// first.
+func ListBackups(dir, name string) (backups []Backup, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	} else if err != nil {
+		return
+	}
+	name = filepath.Base(name)
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `-(\d{8}-\d{4}(?:\d{2})?)\.sql\.gz$`)
+	backups = []Backup{}
+	for _, f := range files {
+		m := pattern.FindStringSubmatch(f.Name())
+		if m == nil || f.IsDir() {
+			continue
+		}
+		t, errParse := time.Parse(backupTimeFormat, m[1])
+		if errParse != nil {
+			t, errParse = time.Parse(oldBackupTimeFormat, m[1])
+		}
+		if errParse != nil {
+			continue
+		}
+		backups = append(backups, Backup{Name: name, Path: filepath.Join(dir, f.Name()), Time: t, Size: f.Size()})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return
+}
+
+// PruneBackups removes the backups of the database name in dir that the
+// policy does not keep, and returns them.
+func PruneBackups(dir, name string, policy BackupPolicy) (removed []Backup, err error) {
+	backups, err := ListBackups(dir, name)
+	if err != nil {
+		return
+	}
+	removed = []Backup{}
+	for _, b := range expiredBackups(backups, policy) {
+		err = os.Remove(b.Path)
+		if err != nil {
+			return
+		}
+		removed = append(removed, b)
+	}
+	return
+}
+
+// expiredBackups returns the backups, sorted most recent first, that the
+// policy does not keep.
+func expiredBackups(backups []Backup, policy BackupPolicy) (expired []Backup) {
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i, b := range backups {
+		keep := i < policy.Last
+		day := b.Time.Format("2006-01-02")
+		if !days[day] && len(days) < policy.Daily {
+			days[day] = true
+			keep = true
+		}
+		year, w := b.Time.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, w)
+		if !weeks[week] && len(weeks) < policy.Weekly {
+			weeks[week] = true
+			keep = true
+		}
+		if !keep {
+			expired = append(expired, b)
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackup(t *testing.T) {
+	removeDatabase("backedup.db")
+	removeDatabase("fromBackup.db")
+	os.RemoveAll("backups")
+	defer removeDatabase("backedup.db")
+	defer removeDatabase("fromBackup.db")
+	defer os.Remove("backedup.db.sql.gz")
+	defer os.RemoveAll("backups")
+	fs, err := New("backedup.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+	f := fs.NewFile("notes", "backed up")
+	assert.Nil(t, fs.Save(f))
+	assert.Nil(t, fs.Audit(Event{Domain: "public", Action: AuditCreate, Page: f.ID}))
+
+	backups, err := ListBackups("backups", "backedup.db")
+	assert.Nil(t, err)
+	assert.Empty(t, backups)
+
+	// a backup does not need the write lock
+	fs.RLock()
+	b, err := fs.Backup("backups")
+	fs.RUnlock()
+	assert.Nil(t, err)
+	assert.True(t, b.Size > 0)
+
+	backups, err = ListBackups("backups", "backedup.db")
+	assert.Nil(t, err)
+	assert.Len(t, backups, 1)
+	assert.Equal(t, b.Path, backups[0].Path)
+
+	// backups are named to the second, and older ones to the minute are
+	// still listed
+	for _, name := range []string{"backedup.db-20190304-123015.sql.gz", "backedup.db-20190304-1230.sql.gz"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join("backups", name), nil, 0644))
+	}
+	backups, err = ListBackups("backups", "backedup.db")
+	assert.Nil(t, err)
+	if assert.Len(t, backups, 3) {
+		assert.Equal(t, b.Path, backups[0].Path)
+		assert.Equal(t, time.Date(2019, 3, 4, 12, 30, 15, 0, time.UTC), backups[1].Time)
+		assert.Equal(t, time.Date(2019, 3, 4, 12, 30, 0, 0, time.UTC), backups[2].Time)
+	}
+
+	_, err = Restore("fromBackup.db", b.Path, false)
+	assert.Nil(t, err)
+	restored, err := Open("fromBackup.db")
+	assert.Nil(t, err)
+	defer restored.Close()
+	files, err := restored.Get(f.ID, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "backed up", files[0].Data)
+
+	// the audit log comes back, and is still append-only
+	events, err := restored.GetAudit(AuditFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	_, err = restored.DB.Exec(`DELETE FROM audit`)
+	assert.NotNil(t, err)
+}
+
+func TestExpiredBackups(t *testing.T) {
+	// a backup every six hours for three weeks, most recent first
+	start := time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC) // a Monday
+	var backups []Backup
+	for i := 21*4 - 1; i >= 0; i-- {
+		backups = append(backups, Backup{Time: start.Add(time.Duration(i) * 6 * time.Hour)})
+	}
+
+	expired := expiredBackups(backups, BackupPolicy{})
+	assert.Len(t, expired, len(backups))
+
+	expired = expiredBackups(backups, BackupPolicy{Last: 5})
+	assert.Len(t, expired, len(backups)-5)
+	assert.Equal(t, backups[5], expired[0])
+
+	// the last of each of the last two days, on top of the last three
+	expired = expiredBackups(backups, BackupPolicy{Last: 3, Daily: 2})
+	assert.Len(t, expired, len(backups)-4)
+	assert.NotContains(t, expired, backups[4])
+
+	// the last of each week
+	expired = expiredBackups(backups, BackupPolicy{Weekly: 10})
+	assert.Len(t, expired, len(backups)-3)
+	for _, i := range []int{0, 28, 56} {
+		assert.NotContains(t, expired, backups[i])
+	}
+}
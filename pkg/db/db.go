@@ -1,17 +1,12 @@
 package db
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -19,16 +14,26 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/pkg/errors"
 	"github.com/schollz/rwtxt/pkg/utils"
-	"github.com/schollz/sqlite3dump"
 	"github.com/schollz/versionedtext"
 )
 
+// FileSystem is the SQLite store. The database runs in WAL mode so that
+// readers never wait on the writer: DB is a single writer connection, and
+// reads go through a separate pool of read-only connections. The mutex is
+// only held by writes, to keep read-modify-write sequences atomic.
 type FileSystem struct {
-	Name string
-	DB   *sql.DB
+	Name   string
+	DB     *sql.DB
+	reader *sql.DB
 	sync.RWMutex
 }
 
+// queryer is implemented by *sql.DB and *sql.Tx, so that the query helpers
+// can run on the reader pool, the writer or inside a transaction.
+type queryer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
 // File is the basic unit that is saved
 type File struct {
 	ID       string                      `json:"id"`
@@ -37,9 +42,10 @@ type File struct {
 	Modified time.Time                   `json:"modified"`
 	Data     string                      `json:"data"`
 	Domain   string                      `json:"domain"`
-	History  versionedtext.VersionedText `json:"history"`
+	History  versionedtext.VersionedText `json:"history"` // only loaded by Get and GetTrash
 	DataHTML template.HTML               `json:"data_html,omitempty"`
 	Views    int                         `json:"views"`
+	Rank     float64                     `json:"rank,omitempty"` // only set by Find, higher is a better match
 }
 
 type DomainOptions struct {
@@ -50,6 +56,9 @@ type DomainOptions struct {
 	CustomIntro string
 	CustomTitle string
 	ShowSearch  bool
+	// NoSharedPassword stops signing in with the password of the domain, so
+	// only its members can.
+	NoSharedPassword bool
 }
 
 func formattedDate(t time.Time, utcOffset int) string {
@@ -68,10 +77,47 @@ func (f File) ModifiedDate(utcOffset int) string {
 	return formattedDate(f.Modified, utcOffset)
 }
 
+// DeletedData returns what a page in the trash contained before it was
+// emptied.
+func (f File) DeletedData() string {
+	n := f.History.NumEdits()
+	if n < 2 {
+		return ""
+	}
+	data, _ := f.History.GetPreviousByIndex(n - 2)
+	return data
+}
+
+// trashed returns the time a page goes to the trash if it is saved with data:
+// now if it is empty but once had content, and nil otherwise. Pages that
+// never had content are not kept, DeleteEmpty purges them.
+func trashed(data string, hadContent bool) *time.Time {
+	if data != "" || !hadContent {
+		return nil
+	}
+	now := time.Now().UTC()
+	return &now
+}
+
 // New will initialize a filesystem by creating DB and calling InitializeDB.
 // Callers should ensure "github.com/mattn/go-sqlite3" is imported in some way
 // before calling this so the sqlite3 driver is available.
 func New(name string) (fs *FileSystem, err error) {
+	fs, err = Open(name)
+	if err != nil {
+		return
+	}
+	err = fs.InitializeDB(true)
+	if err != nil {
+		err = errors.Wrap(err, "could not initialize")
+		return
+	}
+
+	return
+}
+
+// Open will open the database without initializing or migrating it.
+func Open(name string) (fs *FileSystem, err error) {
 	fs = new(FileSystem)
 	if name == "" {
 		err = errors.New("database must have name")
@@ -79,206 +125,172 @@ func New(name string) (fs *FileSystem, err error) {
 	}
 	fs.Name = name
 
-	fs.DB, err = sql.Open("sqlite3", fs.Name)
+	fs.DB, err = sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate", fs.Name))
 	if err != nil {
 		return
 	}
-	err = fs.InitializeDB(true)
+	// SQLite allows one writer at a time anyway, so queue writes in Go
+	// instead of on SQLITE_BUSY
+	fs.DB.SetMaxOpenConns(1)
+	// connect now, which creates the file and switches it to WAL mode
+	// before any read-only connection tries to open it
+	err = fs.DB.Ping()
 	if err != nil {
-		err = errors.Wrap(err, "could not initialize")
+		err = errors.Wrap(err, "could not open "+fs.Name)
+		return
+	}
+	// the search index uses FTS5, which can not be read at all without it
+	ok, err := hasFTS5(fs.DB)
+	if err != nil {
+		return
+	}
+	if !ok {
+		fs.DB.Close()
+		err = errors.New("rwtxt needs SQLite with FTS5 to open " + fs.Name + ", build it with -tags sqlite_fts5")
 		return
 	}
 
+	fs.reader, err = sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", fs.Name))
+	if err != nil {
+		return
+	}
+	fs.reader.SetMaxIdleConns(runtime.NumCPU())
 	return
 }
 
-// InitializeDB will initialize schema if not already done and if dump is true,
+// InitializeDB will apply any pending migrations and if dump is true,
 // will create the an initial DB dump. This is automatically called by New.
 func (fs *FileSystem) InitializeDB(dump bool) (err error) {
-	// if _, errHaveSQL := os.Stat(fs.Name + ".sql.gz"); errHaveSQL == nil {
-	// 	fi, err := os.Open(fs.Name + ".sql.gz")
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	defer fi.Close()
-
-	// 	fz, err := gzip.NewReader(fi)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	defer fz.Close()
-
-	// 	s, err := ioutil.ReadAll(fz)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	_, err = fs.DB.Exec(string(s))
-	// 	return err
-	// }
-	sqlStmt := `CREATE TABLE IF NOT EXISTS 
-		fs (
-			id TEXT NOT NULL PRIMARY KEY,
-			domainid INTEGER,
-			slug TEXT,
-			created TIMESTAMP,
-			modified TIMESTAMP,
-			history TEXT,
-			views INTEGER DEFAULT 0
-		);`
-	_, err = fs.DB.Exec(sqlStmt)
+	_, err = fs.Migrate()
 	if err != nil {
-		err = errors.Wrap(err, "creating table")
 		return
 	}
-
-	sqlStmt = `CREATE VIRTUAL TABLE IF NOT EXISTS 
-		fts USING fts4 (id,data);`
-	_, err = fs.DB.Exec(sqlStmt)
+	err = fs.upgradeSearchIndex()
 	if err != nil {
-		err = errors.Wrap(err, "creating virtual table")
+		return
 	}
 
-	sqlStmt = `CREATE TABLE IF NOT EXISTS 
-	domains (
-		id INTEGER NOT NULL PRIMARY KEY,
-		name TEXT,
-		hashed_pass TEXT,
-		ispublic INTEGER DEFAULT 0,
-		options BLOB
-	);`
-	_, err = fs.DB.Exec(sqlStmt)
+	// the caches are rebuilt on demand, so start each run without them
+	_, err = fs.DB.Exec(`DELETE FROM cached_images; DELETE FROM cached_html;`)
 	if err != nil {
-		err = errors.Wrap(err, "creating domains table")
+		err = errors.Wrap(err, "clearing caches")
+		return
 	}
 
-	sqlStmt = `CREATE TABLE IF NOT EXISTS
-	keys (
-		id INTEGER NOT NULL PRIMARY KEY,
-		domainid INTEGER,
-		key TEXT,
-		lastused TIMESTAMP
-	);`
-	_, err = fs.DB.Exec(sqlStmt)
-	if err != nil {
-		err = errors.Wrap(err, "creating keys table")
+	domainid, _, _, _, _ := fs.getDomainFromName(fs.DB, "public")
+	if domainid == 0 {
+		fs.setDomain("public", "")
+		fs.UpdateDomain("public", "", true, DomainOptions{})
 	}
 
-	sqlStmt = `CREATE TABLE IF NOT EXISTS
-	blobs (
-		id TEXT NOT NULL PRIMARY KEY,
-		name TEXT,
-		data BLOB,
-		views INTEGER DEFAULT 0
-	);`
-	_, err = fs.DB.Exec(sqlStmt)
-	if err != nil {
-		err = errors.Wrap(err, "creating domains table")
+	if dump {
+		fs.DumpSQL()
 	}
+	return
+}
 
-	sqlStmt = `CREATE TABLE IF NOT EXISTS
-	similar (
-		id INTEGER NOT NULL PRIMARY KEY,
-		fsid TEXT,
-		fsid_similar TEXT
-	);`
-	_, err = fs.DB.Exec(sqlStmt)
-	if err != nil {
-		err = errors.Wrap(err, "creating similarities table")
-	}
+// DeleteEmpty deletes the pages that have no content
+func (fs *FileSystem) DeleteEmpty() (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.deleteEmpty()
+}
 
-	sqlStmt = `DROP TABLE IF EXISTS	cached_images;`
-	_, err = fs.DB.Exec(sqlStmt)
-	if err != nil {
-		err = errors.Wrap(err, "dropping cached_images table")
-	}
+func (fs *FileSystem) deleteEmpty() (err error) {
+	_, err = fs.DB.Exec(`
+	DELETE FROM fs WHERE deleted IS NULL AND id IN (SELECT id FROM fts where data == '');
+	DELETE FROM fts WHERE data = '' AND id NOT IN (SELECT id FROM fs);
+	`)
+	return
+}
 
-	sqlStmt = `CREATE TABLE IF NOT EXISTS
-	cached_images (
-		id TEXT NOT NULL PRIMARY KEY,
-		name TEXT,
-		data BLOB,
-		views INTEGER DEFAULT 0
-	);`
-	_, err = fs.DB.Exec(sqlStmt)
+// PurgeTrash deletes the pages that were moved to the trash before the time
+func (fs *FileSystem) PurgeTrash(before time.Time) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	tx, err := fs.DB.Begin()
 	if err != nil {
-		err = errors.Wrap(err, "creating cached_images table")
+		return errors.Wrap(err, "begin PurgeTrash")
 	}
-
-	sqlStmt = `DROP TABLE IF EXISTS	cached_html;`
-	_, err = fs.DB.Exec(sqlStmt)
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM fts WHERE id IN (SELECT id FROM fs WHERE deleted < ?)`, before.UTC())
 	if err != nil {
-		err = errors.Wrap(err, "dropping cached_html table")
+		return errors.Wrap(err, "exec PurgeTrash")
 	}
-
-	sqlStmt = `CREATE TABLE IF NOT EXISTS
-	cached_html (
-		id TEXT NOT NULL PRIMARY KEY,
-		modified TIMESTAMP,
-		tr BLBOB
-	);`
-	_, err = fs.DB.Exec(sqlStmt)
+	_, err = tx.Exec(`DELETE FROM revisions WHERE id IN (SELECT id FROM fs WHERE deleted < ?)`, before.UTC())
 	if err != nil {
-		err = errors.Wrap(err, "creating cached_html table")
+		return errors.Wrap(err, "exec PurgeTrash")
 	}
-
-	sqlStmt = `CREATE INDEX IF NOT EXISTS
-	fsslugs ON fs(slug,domainid);`
-	_, err = fs.DB.Exec(sqlStmt)
+	_, err = tx.Exec(`DELETE FROM shares WHERE fileid IN (SELECT id FROM fs WHERE deleted < ?)`, before.UTC())
 	if err != nil {
-		err = errors.Wrap(err, "creating index")
+		return errors.Wrap(err, "exec PurgeTrash")
 	}
-
-	sqlStmt = `CREATE INDEX IF NOT EXISTS
-	domainsname ON domains(name);`
-	_, err = fs.DB.Exec(sqlStmt)
+	_, err = tx.Exec(`DELETE FROM fs WHERE deleted < ?`, before.UTC())
 	if err != nil {
-		err = errors.Wrap(err, "creating index")
+		return errors.Wrap(err, "exec PurgeTrash")
 	}
-
-	sqlStmt = `CREATE INDEX IF NOT EXISTS
-	similarid ON similar(fsid);`
-	_, err = fs.DB.Exec(sqlStmt)
+	err = tx.Commit()
 	if err != nil {
-		err = errors.Wrap(err, "creating index")
+		return errors.Wrap(err, "commit PurgeTrash")
 	}
+	return
+}
 
-	domainid, _, _, _, _ := fs.getDomainFromName("public")
-	if domainid == 0 {
-		fs.setDomain("public", "")
-		fs.UpdateDomain("public", "", true, DomainOptions{})
+// Compact thins out the history of every page that is not in the trash. Each
+// page is compacted in its own transaction, so writes are only held up
+// briefly.
+func (fs *FileSystem) Compact(now time.Time) (pages, revisions int, err error) {
+	ids, err := historiesToCompact(fs.reader, now)
+	if err != nil {
+		return
 	}
-
-	if dump {
-		fs.DumpSQL()
+	for _, id := range ids {
+		var removed int
+		removed, err = fs.compact(id, now)
+		if err != nil {
+			err = errors.Wrap(err, "compacting "+id)
+			return
+		}
+		if removed > 0 {
+			pages++
+			revisions += removed
+		}
 	}
 	return
 }
 
-// DumpSQL will dump the SQL as text to filename.sql.gz
-func (fs *FileSystem) DumpSQL() (err error) {
+func (fs *FileSystem) compact(id string, now time.Time) (removed int, err error) {
 	fs.Lock()
 	defer fs.Unlock()
-
-	// first purge the database of old stuff
-	_, err = fs.DB.Exec(`
-	DELETE FROM fs WHERE id IN (SELECT id FROM fts where data == '');
-	DELETE FROM fts WHERE data = '';
-	`)
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "begin Compact")
+	}
+	defer tx.Rollback()
+	removed, err = compactPage(tx, "", bindSQLite, id, now)
 	if err != nil {
 		return
 	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "commit Compact")
+	}
+	return
+}
 
-	fi, err := os.Create(fs.Name + ".sql.gz")
+// DumpSQL will purge empty pages and dump the SQL as text to filename.sql.gz.
+// The dump is taken from a snapshot, see Backup, so only the purge holds up
+// writes.
+func (fs *FileSystem) DumpSQL() (err error) {
+	fs.Lock()
+	// first purge the database of old stuff
+	err = fs.deleteEmpty()
+	fs.Unlock()
 	if err != nil {
 		return
 	}
-	gf := gzip.NewWriter(fi)
-	fw := bufio.NewWriter(gf)
-	err = sqlite3dump.DumpMigration(fs.DB, fw)
-	fw.Flush()
-	gf.Close()
-	fi.Close()
-	return
+	return fs.dump(fs.Name + ".sql.gz")
 }
 
 // NewFile returns a new file
@@ -302,6 +314,7 @@ func (fs *FileSystem) SaveBlob(id string, name string, blob []byte) (err error)
 	if err != nil {
 		return errors.Wrap(err, "begin SaveBlob")
 	}
+	defer tx.Rollback()
 	stmt, err := tx.Prepare(`
 	INSERT OR REPLACE INTO
 		blobs
@@ -319,13 +332,13 @@ func (fs *FileSystem) SaveBlob(id string, name string, blob []byte) (err error)
 	if err != nil {
 		return errors.Wrap(err, "stmt SaveBlob")
 	}
+	defer stmt.Close()
 	_, err = stmt.Exec(
 		id, name, blob,
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec SaveBlob")
 	}
-	defer stmt.Close()
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit SaveBlob")
@@ -335,99 +348,17 @@ func (fs *FileSystem) SaveBlob(id string, name string, blob []byte) (err error)
 
 // ExportPosts will save posts to {{TIMESTAMP}}-posts.gz
 func (fs *FileSystem) ExportPosts() error {
-	domains, err := fs.GetDomains()
-	if err != nil {
-		return err
-	}
-
-	dir := os.TempDir()
-	postPaths := []string{}
-	for _, domain := range domains {
-		files, err := fs.GetAll(domain)
-		if err != nil {
-			return err
-		}
-		for _, file := range files {
-			fname := (fmt.Sprintf("%s-%s.md", file.Slug, file.ID))
-			r := strings.NewReader(file.Data)
-			if err != nil {
-				return err
-			}
-			var buf bytes.Buffer
-			_, err = buf.ReadFrom(r)
-			if err != nil {
-				return err
-			}
-			err = os.MkdirAll(filepath.Join(dir, domain), os.ModePerm)
-			if err != nil {
-				return err
-			}
-			fpath := filepath.Join(dir, domain, fname)
-			err = ioutil.WriteFile(fpath, buf.Bytes(), os.ModePerm)
-			if err != nil {
-				return err
-			}
-
-			postPaths = append(postPaths, fpath)
-		}
-	}
-	timestamp := strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
-	for _, f := range postPaths {
-		log.Debug(f)
-	}
-	utils.ZipFiles(fmt.Sprintf("%s-posts.zip", timestamp), postPaths)
-	return nil
-
+	return ExportPosts(fs)
 }
 
 // ExportUploads will save uploads to {{TIMESTAMP}}-uploads.gz
 func (fs *FileSystem) ExportUploads() error {
-	dir := os.TempDir()
-	files := []string{}
-
-	ids, err := fs.GetBlobIDs()
-	if err != nil {
-		return err
-	}
-
-	for _, id := range ids {
-		name, data, _, err := fs.GetBlob(id)
-		if err != nil {
-			return err
-		}
-		fname := fmt.Sprintf("%s-%s", id, name)
-
-		r, err := gzip.NewReader(bytes.NewReader(data))
-		if err != nil {
-			return err
-		}
-		var buf bytes.Buffer
-		_, err = buf.ReadFrom(r)
-		if err != nil {
-			return err
-		}
-		fpath := filepath.Join(dir, fname)
-		err = ioutil.WriteFile(fpath, buf.Bytes(), os.ModePerm)
-		if err != nil {
-			return err
-		}
-
-		files = append(files, fpath)
-	}
-
-	timestamp := strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
-	for _, f := range files {
-		log.Debug(f)
-	}
-	utils.ZipFiles(fmt.Sprintf("%s-uploads.zip", timestamp), files)
-	return nil
+	return ExportUploads(fs)
 }
 
 // GetBlobIDs will return a list of blob ids
 func (fs *FileSystem) GetBlobIDs() ([]string, error) {
-	fs.Lock()
-	defer fs.Unlock()
-	stmt, err := fs.DB.Prepare(`SELECT id FROM blobs`)
+	stmt, err := fs.reader.Prepare(`SELECT id FROM blobs`)
 	if err != nil {
 		return nil, err
 	}
@@ -438,6 +369,7 @@ func (fs *FileSystem) GetBlobIDs() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var id string
 		err = rows.Scan(&id)
@@ -452,9 +384,7 @@ func (fs *FileSystem) GetBlobIDs() ([]string, error) {
 
 // GetDomains will return a list of domains
 func (fs *FileSystem) GetDomains() ([]string, error) {
-	fs.Lock()
-	defer fs.Unlock()
-	stmt, err := fs.DB.Prepare(`SELECT name FROM domains`)
+	stmt, err := fs.reader.Prepare(`SELECT name FROM domains`)
 	if err != nil {
 		return nil, err
 	}
@@ -465,6 +395,7 @@ func (fs *FileSystem) GetDomains() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var domain string
 		err = rows.Scan(&domain)
@@ -486,6 +417,7 @@ func (fs *FileSystem) SaveResizedImage(id string, name string, blob []byte) (err
 	if err != nil {
 		return errors.Wrap(err, "begin SaveResizedImage")
 	}
+	defer tx.Rollback()
 	stmt, err := tx.Prepare(`
 	INSERT OR REPLACE INTO
 		cached_images
@@ -503,13 +435,13 @@ func (fs *FileSystem) SaveResizedImage(id string, name string, blob []byte) (err
 	if err != nil {
 		return errors.Wrap(err, "stmt SaveResizedImage")
 	}
+	defer stmt.Close()
 	_, err = stmt.Exec(
 		id, name, blob,
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec SaveResizedImage")
 	}
-	defer stmt.Close()
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit SaveResizedImage")
@@ -519,46 +451,18 @@ func (fs *FileSystem) SaveResizedImage(id string, name string, blob []byte) (err
 
 // GetResizedImage will resize an image (if it hasn't already been cached) return it
 func (fs *FileSystem) GetResizedImage(id string) (name string, data []byte, views int, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-
-	stmt, err := fs.DB.Prepare("SELECT name,data,views FROM cached_images WHERE id = ?")
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-	err = stmt.QueryRow(id).Scan(&name, &data, &views)
-	if err != nil {
-		return
-	}
-
-	log.Debugf("id :%s, views: %d", id, views)
-
-	// update the views
-	tx, err := fs.DB.Begin()
-	if err != nil {
-		return
-	}
-	stmt, err = tx.Prepare("UPDATE blobs SET views=? WHERE id=?")
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(views+1, id)
-	if err != nil {
-		return
-	}
-	err = tx.Commit()
-
-	return
+	return fs.getBlob("cached_images", id)
 }
 
-// GetBlob will save a blob
+// GetBlob will return a blob
 func (fs *FileSystem) GetBlob(id string) (name string, data []byte, views int, err error) {
-	fs.Lock()
-	defer fs.Unlock()
+	return fs.getBlob("blobs", id)
+}
 
-	stmt, err := fs.DB.Prepare("SELECT name,data,views FROM blobs WHERE id = ?")
+// getBlob reads a blob from the reader pool and then counts the view, so that
+// serving uploads does not hold the write lock for longer than the update.
+func (fs *FileSystem) getBlob(table string, id string) (name string, data []byte, views int, err error) {
+	stmt, err := fs.reader.Prepare("SELECT name,data,views FROM " + table + " WHERE id = ?")
 	if err != nil {
 		return
 	}
@@ -571,52 +475,55 @@ func (fs *FileSystem) GetBlob(id string) (name string, data []byte, views int, e
 	log.Debugf("id :%s, views: %d", id, views)
 
 	// update the views
-	tx, err := fs.DB.Begin()
-	if err != nil {
-		return
-	}
-	stmt, err = tx.Prepare("UPDATE blobs SET views=? WHERE id=?")
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(views+1, id)
-	if err != nil {
-		return
-	}
-	err = tx.Commit()
-
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.DB.Exec("UPDATE "+table+" SET views=views+1 WHERE id=?", id)
 	return
 }
 
-// Save a file to the file system. Will insert or ignore, and then update.
+// Save a file to the file system. The row, its history and its entry in the
+// search index are written in a single transaction, so they can not get out
+// of sync.
 func (fs *FileSystem) Save(f File) (err error) {
 	fs.Lock()
 	defer fs.Unlock()
 
-	// get current history and then update the history
-	files, _ := fs.get(f.ID, f.Domain)
-	if len(files) == 1 {
-		f.History = files[0].History
-		f.History.Update(f.Data)
-	} else {
-		f.History = versionedtext.NewVersionedText(f.Data)
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin Save")
 	}
+	defer tx.Rollback()
+
 	// make sure domain exists
 	if f.Domain == "" {
 		f.Domain = "public"
 	}
-	domainid, _, _, _, _ := fs.getDomainFromName(f.Domain)
+	domainid, _, _, _, _ := fs.getDomainFromName(tx, f.Domain)
 	if domainid == 0 {
 		return errors.New("domain does not exist")
 	}
+	var owner int
+	err = tx.QueryRow(`SELECT domainid FROM fs WHERE id = ?`, f.ID).Scan(&owner)
+	if err == nil && owner != domainid {
+		return errors.New("page belongs to another domain")
+	} else if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "get domain of page")
+	}
 
-	tx, err := fs.DB.Begin()
+	// the index has the current text, so the history is not needed to add
+	// the change to it
+	var previous string
+	err = tx.QueryRow(`SELECT data FROM fts WHERE id = ? LIMIT 1`, f.ID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "get current text")
+	}
+	hadContent, err := addRevision(tx, bindSQLite, f.ID, previous, f.Data)
 	if err != nil {
-		return errors.Wrap(err, "begin Save")
+		return
 	}
 
-	stmt, err := tx.Prepare(`
+	deleted := trashed(f.Data, hadContent)
+	_, err = tx.Exec(`
 	INSERT OR IGNORE INTO
 		fs
 	(
@@ -625,7 +532,7 @@ func (fs *FileSystem) Save(f File) (err error) {
 		slug,
 		created,
 		modified,
-		history
+		deleted
 	) 
 		values 	
 	(
@@ -635,112 +542,78 @@ func (fs *FileSystem) Save(f File) (err error) {
 		?,
 		?,
 		?
-	)`)
-	if err != nil {
-		return errors.Wrap(err, "stmt Save")
-	}
-
-	historyBytes, _ := json.Marshal(f.History)
-
-	_, err = stmt.Exec(
+	)`,
 		f.ID,
 		domainid,
 		f.Slug,
 		f.Created,
 		time.Now().UTC(),
-		string(historyBytes),
+		deleted,
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec Save")
 	}
-	defer stmt.Close()
-	err = tx.Commit()
-	if err != nil {
-		return errors.Wrap(err, "commit Save")
-	}
 
-	// if it was ignored
-	tx2, err := fs.DB.Begin()
-	if err != nil {
-		return errors.Wrap(err, "begin Save")
-	}
-	stmt2, err := tx2.Prepare(`
+	// if it was ignored, keeping the time it went to the trash
+	_, err = tx.Exec(`
 	UPDATE fs SET 
 		slug = ?,
 		modified = ?,
-		history = ?
+		deleted = CASE WHEN ? IS NULL THEN NULL ELSE COALESCE(deleted, ?) END
 	WHERE
 		id = ?
-	`)
-	if err != nil {
-		return errors.Wrap(err, "stmt update")
-	}
-	defer stmt2.Close()
-
-	_, err = stmt2.Exec(
+	`,
 		f.Slug,
 		time.Now().UTC(),
-		string(historyBytes),
+		deleted,
+		deleted,
 		f.ID,
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec update")
 	}
-	err = tx2.Commit()
-	if err != nil {
-		return errors.Wrap(err, "commit update")
-	}
 
 	// check if exists in fts
-	sqlStmt := "INSERT INTO fts(data,id) VALUES (?,?)"
+	sqlStmt := "INSERT INTO fts(data,slug,id) VALUES (?,?,?)"
 	var ftsHasID bool
-	ftsHasID, err = fs.idExists(f.ID)
+	ftsHasID, err = fs.idExists(tx, f.ID)
 	if err != nil {
 		return errors.Wrap(err, "doesExist")
 	}
 	if ftsHasID {
-		sqlStmt = "UPDATE fts SET data=? WHERE id=?"
+		sqlStmt = "UPDATE fts SET data=?, slug=? WHERE id=?"
 	}
 
 	// update the index
-	tx3, err := fs.DB.Begin()
-	if err != nil {
-		return errors.Wrap(err, "begin virtual Save")
-	}
-	stmt3, err := tx3.Prepare(sqlStmt)
-	if err != nil {
-		return errors.Wrap(err, "stmt virtual update")
-	}
-	defer stmt3.Close()
-
-	_, err = stmt3.Exec(
-		f.Data,
-		f.ID,
-	)
+	_, err = tx.Exec(sqlStmt, f.Data, searchSlug(f), f.ID)
 	if err != nil {
 		return errors.Wrap(err, "exec virtual update")
 	}
-	err = tx3.Commit()
+
+	err = tx.Commit()
 	if err != nil {
-		return errors.Wrap(err, "commit virtual update")
+		return errors.Wrap(err, "commit Save")
 	}
 	return
-
 }
 
-// Close will make sure that the lock file is closed
+// Close closes the reader and writer connections
 func (fs *FileSystem) Close() (err error) {
-	return fs.DB.Close()
+	if fs.reader != nil {
+		err = fs.reader.Close()
+	}
+	if err2 := fs.DB.Close(); err == nil {
+		err = err2
+	}
+	return
 }
 
 // Len returns how many things
 func (fs *FileSystem) Len() (l int, err error) {
-	fs.Lock()
-	defer fs.Unlock()
 
 	// prepare statement
 	query := "SELECT COUNT(id) FROM FS"
-	stmt, err := fs.DB.Prepare(query)
+	stmt, err := fs.reader.Prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
@@ -769,12 +642,46 @@ func (fs *FileSystem) Len() (l int, err error) {
 	return
 }
 
-// SetKey will set the key of a domain, throws an error if it already exists
-func (fs *FileSystem) SetKey(domain, password string) (key string, err error) {
-	// first check if it is a domain
-	fs.Lock()
-	defer fs.Unlock()
-	domainid, _, err := fs.validateDomain(domain, password)
+// newKey returns a random session key and the hash it is stored as. Only the
+// hash is kept, so the database and its dumps do not hold keys that could be
+// used to sign in.
+func newKey() (key, hash string, err error) {
+	key, err = randomHex(32)
+	if err != nil {
+		return
+	}
+	return key, hashKey(key), nil
+}
+
+func hashKey(key string) string {
+	return utils.Hash("session key", key)
+}
+
+// keyIDLength is how much of the hash of a key is its id.
+const keyIDLength = 12
+
+// KeyID returns the id of a session key, which tells it apart from the other
+// sessions without giving away the key.
+func KeyID(key string) string {
+	if key == "" {
+		return ""
+	}
+	return hashKey(key)[:keyIDLength]
+}
+
+// sameHash compares the hashes in constant time.
+func sameHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// checkDomainPassword returns the domain id and the role to sign in with if
+// the password, or the reader password, of the domain is correct.
+func (fs *FileSystem) checkDomainPassword(domain, password string) (domainid int, role sql.NullString, err error) {
+	domainid, options, err := fs.validateDomain(fs.reader, domain, password)
+	if err != nil && domainid != 0 && checkReaderPassword(fs.reader, bindSQLite, domainid, password) {
+		err = nil
+		role = sql.NullString{String: string(RoleReader), Valid: true}
+	}
 	if err != nil {
 		return
 	}
@@ -782,17 +689,49 @@ func (fs *FileSystem) SetKey(domain, password string) (key string, err error) {
 		err = errors.New("domain does not exist")
 		return
 	}
+	if options.NoSharedPassword {
+		err = errors.New("domain does not allow the shared password")
+	}
+	return
+}
+
+// CheckPassword checks the password of the user, or of the domain if user is
+// empty, without giving out a key.
+func (fs *FileSystem) CheckPassword(domain, user, password string) (err error) {
+	if user != "" {
+		_, _, err = validateUser(fs.reader, bindSQLite, domain, user, password)
+		return
+	}
+	_, _, err = fs.checkDomainPassword(domain, password)
+	return
+}
+
+// SetKey will set the key of a domain, throws an error if it already exists
+func (fs *FileSystem) SetKey(domain, password string) (key string, err error) {
+	// first check if it is a domain, before locking as bcrypt is slow
+	domainid, role, err := fs.checkDomainPassword(domain, password)
+	if err != nil {
+		return
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
 	tx, err := fs.DB.Begin()
 	if err != nil {
 		return
 	}
-	stmt, err := tx.Prepare("insert into keys(domainid,key,lastused) values(?, ?,?)")
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("insert into keys(domainid,key,created,lastused,role) values(?,?,?,?,?)")
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
-	key = utils.UUID()
-	_, err = stmt.Exec(domainid, key, time.Now().UTC())
+	key, hash, err := newKey()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	_, err = stmt.Exec(domainid, hash, now, now, role)
 	if err != nil {
 		return
 	}
@@ -828,7 +767,7 @@ func (fs *FileSystem) DeleteKey(key string) (err error) {
 		return
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(key)
+	_, err = stmt.Exec(hashKey(key))
 	return
 }
 
@@ -841,6 +780,7 @@ func (fs *FileSystem) UpdateViews(f File) (err error) {
 	if err != nil {
 		return
 	}
+	defer tx.Rollback()
 	stmt, err := tx.Prepare("UPDATE fs SET views=? WHERE id=?")
 	if err != nil {
 		return
@@ -856,14 +796,12 @@ func (fs *FileSystem) UpdateViews(f File) (err error) {
 
 // CheckKeys checks that it is a valid key for a domain
 func (fs *FileSystem) CheckKeys(keys []string) (domains []string, validKeys []string, err error) {
-	fs.Lock()
-	defer fs.Unlock()
 
 	domains = make([]string, len(keys))
 	validKeys = make([]string, len(keys))
 	i := 0
 	for _, key := range keys {
-		_, domain, err := fs.checkKey(key)
+		_, domain, err := fs.checkKey(fs.reader, key)
 		if err != nil || domain == "" {
 			continue
 		}
@@ -876,36 +814,17 @@ func (fs *FileSystem) CheckKeys(keys []string) (domains []string, validKeys []st
 
 // CheckKey checks that it is a valid key for a domain
 func (fs *FileSystem) CheckKey(key string) (domainid int, domain string, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-	return fs.checkKey(key)
+	return fs.checkKey(fs.reader, key)
 }
 
-func (fs *FileSystem) checkKey(key string) (domainid int, domain string, err error) {
-	stmt, err := fs.DB.Prepare(`
-	SELECT 
-	domains.id, domains.name
-	FROM keys 
-	
-	INNER JOIN domains 
-		ON keys.domainid=domains.id 
-
-	WHERE
-		keys.key=?`)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-	err = stmt.QueryRow(key).Scan(&domainid, &domain)
-	if err != nil {
-		return
-	}
-	if domain == "" {
-		err = errors.New("no such key")
-		return
-	}
+func (fs *FileSystem) checkKey(db queryer, key string) (domainid int, domain string, err error) {
+	k, err := getKey(db, bindSQLite, key)
+	return k.DomainID, k.Domain, err
+}
 
-	return
+// GetKey returns the session with the key.
+func (fs *FileSystem) GetKey(key string) (k Key, err error) {
+	return getKey(fs.reader, bindSQLite, key)
 }
 
 // UpdateKeys will update its last use
@@ -916,14 +835,14 @@ func (fs *FileSystem) UpdateKeys(keys []string) (err error) {
 	if err != nil {
 		return
 	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("UPDATE keys SET lastused=? WHERE key=?")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
 	for _, key := range keys {
-		stmt, errUpdate := tx.Prepare("UPDATE keys SET lastused=? WHERE key=?")
-		if errUpdate != nil {
-			err = errUpdate
-			return
-		}
-		defer stmt.Close()
-		_, err = stmt.Exec(time.Now().UTC(), key)
+		_, err = stmt.Exec(time.Now().UTC(), hashKey(key))
 		if err != nil {
 			return
 		}
@@ -934,10 +853,13 @@ func (fs *FileSystem) UpdateKeys(keys []string) (err error) {
 
 // SetDomain will set the key of a domain, throws an error if it already exists
 func (fs *FileSystem) SetDomain(domain, password string) (err error) {
+	if err = checkNewDomain(domain); err != nil {
+		return
+	}
 	// first check if it is a domain
 	fs.Lock()
 	defer fs.Unlock()
-	domainid, _, _, _, _ := fs.getDomainFromName(domain)
+	domainid, _, _, _, _ := fs.getDomainFromName(fs.DB, domain)
 	if domainid != 0 {
 		err = errors.New("domain already exists")
 		return
@@ -951,11 +873,13 @@ func (fs *FileSystem) setDomain(domain, password string) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "begin Save")
 	}
+	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`INSERT INTO domains (name, hashed_pass, ispublic) VALUES (?,?,?)`)
 	if err != nil {
 		return errors.Wrap(err, "stmt Save")
 	}
+	defer stmt.Close()
 
 	hashedPassword, err := utils.HashPassword(password)
 	if err != nil {
@@ -965,7 +889,6 @@ func (fs *FileSystem) setDomain(domain, password string) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "exec Save")
 	}
-	defer stmt.Close()
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit Save")
@@ -978,7 +901,7 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 	defer fs.Unlock()
 
 	// first check if it is a domain
-	domainid, _, _, _, _ := fs.getDomainFromName(domain)
+	domainid, _, _, _, _ := fs.getDomainFromName(fs.DB, domain)
 	if domainid == 0 {
 		err = errors.New("domain does not exist")
 		return
@@ -995,6 +918,7 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 	if err != nil {
 		return errors.Wrap(err, "begin Save")
 	}
+	defer tx.Rollback()
 
 	bOptions, _ := json.Marshal(options)
 
@@ -1007,6 +931,7 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 		if err != nil {
 			return errors.Wrap(err, "stmt Save")
 		}
+		defer stmt.Close()
 		_, err = stmt.Exec(isPublicValue, bOptions, domain)
 		if err != nil {
 			return errors.Wrap(err, "exec Save")
@@ -1025,12 +950,17 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 		if err != nil {
 			return errors.Wrap(err, "stmt Save")
 		}
+		defer stmt.Close()
 		_, err = stmt.Exec(hashedPassword, isPublicValue, bOptions, domain)
 		if err != nil {
 			return errors.Wrap(err, "exec Save")
 		}
+		// whoever knew the old password is signed out
+		err = deleteSessions(tx, bindSQLite, domainid)
+		if err != nil {
+			return err
+		}
 	}
-	defer stmt.Close()
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit Save")
@@ -1047,18 +977,19 @@ func (fs *FileSystem) SetCacheHTML(id string, tr []byte) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "begin SetCache")
 	}
+	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
 	INSERT OR REPLACE INTO cached_html (id,modified,tr) VALUES (?,?,?)`)
 	if err != nil {
 		return errors.Wrap(err, "stmt Save SetCache")
 	}
+	defer stmt.Close()
 
 	_, err = stmt.Exec(id, time.Now().UTC(), tr)
 	if err != nil {
 		return errors.Wrap(err, "exec Save SetCache")
 	}
-	defer stmt.Close()
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit Save SetCache")
@@ -1068,8 +999,6 @@ func (fs *FileSystem) SetCacheHTML(id string, tr []byte) (err error) {
 
 // SetCacheHTML will set the html cache
 func (fs *FileSystem) GetCacheHTML(id string, noCheckLastModified ...bool) (tr []byte, err error) {
-	fs.Lock()
-	defer fs.Unlock()
 
 	doCheckLastModified := true
 	if len(noCheckLastModified) > 0 {
@@ -1080,7 +1009,7 @@ func (fs *FileSystem) GetCacheHTML(id string, noCheckLastModified ...bool) (tr [
 	if doCheckLastModified {
 		fsLastModified, err = func(id string) (fsLastModified time.Time, err error) {
 			// prepare statement
-			stmt, err := fs.DB.Prepare("SELECT modified FROM fs WHERE id=?")
+			stmt, err := fs.reader.Prepare("SELECT modified FROM fs WHERE id=?")
 			if err != nil {
 				err = errors.Wrap(err, "preparing query")
 				return
@@ -1110,7 +1039,7 @@ func (fs *FileSystem) GetCacheHTML(id string, noCheckLastModified ...bool) (tr [
 	}
 
 	// prepare statement
-	stmt, err := fs.DB.Prepare("SELECT modified,tr FROM cached_html WHERE id=?")
+	stmt, err := fs.reader.Prepare("SELECT modified,tr FROM cached_html WHERE id=?")
 	if err != nil {
 		err = errors.Wrap(err, "preparing query")
 		return
@@ -1142,15 +1071,13 @@ func (fs *FileSystem) GetCacheHTML(id string, noCheckLastModified ...bool) (tr [
 
 // ValidateDomain returns the domain id or an error if the password doesn't match or if the domain doesn't exist
 func (fs *FileSystem) ValidateDomain(domain, password string) (domainid int, options DomainOptions, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-	return fs.validateDomain(domain, password)
+	return fs.validateDomain(fs.reader, domain, password)
 }
 
 // ValidateDomain returns the domain id or an error if the password doesn't match or if the domain doesn't exist
-func (fs *FileSystem) validateDomain(domain, password string) (domainid int, options DomainOptions, err error) {
+func (fs *FileSystem) validateDomain(db queryer, domain, password string) (domainid int, options DomainOptions, err error) {
 	domain = strings.ToLower(domain)
-	domainid, hashedPassword, _, options, err := fs.getDomainFromName(domain)
+	domainid, hashedPassword, _, options, err := fs.getDomainFromName(db, domain)
 	if domainid == 0 {
 		err = errors.New("domain " + domain + " does not exist")
 		return
@@ -1167,11 +1094,9 @@ func (fs *FileSystem) validateDomain(domain, password string) (domainid int, opt
 
 // GetDomainFromName returns the domain id, throwing an error if it doesn't exist
 func (fs *FileSystem) GetDomainFromName(domain string) (domainid int, ispublic bool, options DomainOptions, err error) {
-	fs.Lock()
-	defer fs.Unlock()
 	domain = strings.ToLower(domain)
 	var ispublicint int
-	domainid, _, ispublicint, options, err = fs.getDomainFromName(domain)
+	domainid, _, ispublicint, options, err = fs.getDomainFromName(fs.reader, domain)
 	if domainid == 0 {
 		err = errors.New("domain " + domain + " does not exist")
 	}
@@ -1179,10 +1104,10 @@ func (fs *FileSystem) GetDomainFromName(domain string) (domainid int, ispublic b
 	return
 }
 
-func (fs *FileSystem) getDomainFromName(domain string) (domainid int, hashedPassword string, ispublic int, options DomainOptions, err error) {
+func (fs *FileSystem) getDomainFromName(db queryer, domain string) (domainid int, hashedPassword string, ispublic int, options DomainOptions, err error) {
 	// prepare statement
 	query := "SELECT id,hashed_pass,ispublic,options FROM domains WHERE name = ?"
-	stmt, err := fs.DB.Prepare(query)
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
@@ -1216,24 +1141,23 @@ func (fs *FileSystem) getDomainFromName(domain string) (domainid int, hashedPass
 }
 
 func (fs *FileSystem) SetSimilar(id string, similarids []string) (err error) {
-	// first purge the database of previous similarities
-	stmt, err := fs.DB.Prepare(`DELETE FROM similar WHERE fsid=?;`)
+	fs.Lock()
+	defer fs.Unlock()
+
+	tx, err := fs.DB.Begin()
 	if err != nil {
-		return
+		return errors.Wrap(err, "begin setsimilar")
 	}
-	_, err = stmt.Exec(id)
-	stmt.Close()
+	defer tx.Rollback()
+
+	// first purge the database of previous similarities
+	_, err = tx.Exec(`DELETE FROM similar WHERE fsid=?;`, id)
 	if err != nil {
-		return
+		return errors.Wrap(err, "delete setsimilar")
 	}
 
-	for _, similarid := range similarids {
-		// inset new similarities
-		tx, err := fs.DB.Begin()
-		if err != nil {
-			return errors.Wrap(err, "begin setsmiilar")
-		}
-		stmt, err := tx.Prepare(`
+	// insert new similarities
+	stmt, err := tx.Prepare(`
 	INSERT OR REPLACE INTO
 		similar
 	(
@@ -1245,30 +1169,29 @@ func (fs *FileSystem) SetSimilar(id string, similarids []string) (err error) {
 		?,
 		?
 	)`)
-		if err != nil {
-			return errors.Wrap(err, "stmt setsimilar")
-		}
+	if err != nil {
+		return errors.Wrap(err, "stmt setsimilar")
+	}
+	defer stmt.Close()
+	for _, similarid := range similarids {
 		_, err = stmt.Exec(
 			id, similarid,
 		)
 		if err != nil {
 			return errors.Wrap(err, "exec setsimilar")
 		}
-		defer stmt.Close()
-		err = tx.Commit()
-		if err != nil {
-			return errors.Wrap(err, "commit setsimilar")
-		}
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "commit setsimilar")
+	}
 	return
 }
 
 // GetAll returns all the files for a given domain
 func (fs *FileSystem) GetAll(domain string, created ...bool) (files []File, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-	q := `SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
+	q := `SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views FROM fs 
 	INNER JOIN fts ON fs.id=fts.id 
 	INNER JOIN domains ON fs.domainid=domains.id
 	WHERE 
@@ -1280,17 +1203,38 @@ func (fs *FileSystem) GetAll(domain string, created ...bool) (files []File, err
 	} else {
 		q += "ORDER BY fs.modified DESC"
 	}
-	files, err = fs.getAllFromPreparedQuery(q, domain)
+	files, err = fs.getAllFromPreparedQuery(fs.reader, q, domain)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
+
+// GetTrash returns the pages in the trash of a domain, the most recently
+// emptied first
+func (fs *FileSystem) GetTrash(domain string) (files []File, err error) {
+	files, err = fs.getAllFromPreparedQuery(fs.reader, `
+	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views FROM fs 
+	INNER JOIN fts ON fs.id=fts.id 
+	INNER JOIN domains ON fs.domainid=domains.id
+	WHERE 
+		domains.name = ?
+		AND fs.deleted IS NOT NULL
+	ORDER BY fs.deleted DESC`, domain)
+	if err != nil {
+		return
+	}
 	for i := range files {
 		files[i].Domain = domain
 	}
+	err = loadHistories(fs.reader, bindSQLite, files)
 	return
 }
 
 // GetSimilar returns all the files for a given domain
 func (fs *FileSystem) GetSimilar(fileid string) (files []File, err error) {
-	return fs.getAllFromPreparedQuery(`
-	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
+	return fs.getAllFromPreparedQuery(fs.reader, `
+	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views FROM fs 
 	INNER JOIN fts ON fs.id=fts.id 
 	WHERE 
 		fs.id IN (
@@ -1301,10 +1245,8 @@ func (fs *FileSystem) GetSimilar(fileid string) (files []File, err error) {
 
 // GetTopX returns the info from a file
 func (fs *FileSystem) GetTopX(domain string, num int, created ...bool) (files []File, err error) {
-	fs.Lock()
-	defer fs.Unlock()
 	q := `
-	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
+	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views FROM fs 
 	INNER JOIN fts ON fs.id=fts.id 
 	INNER JOIN domains ON fs.domainid=domains.id
 	WHERE 
@@ -1318,15 +1260,13 @@ func (fs *FileSystem) GetTopX(domain string, num int, created ...bool) (files []
 		q += "ORDER BY fs.modified DESC"
 	}
 	q += " LIMIT ?"
-	return fs.getAllFromPreparedQuery(q, domain, num)
+	return fs.getAllFromPreparedQuery(fs.reader, q, domain, num)
 }
 
 // GetTopX returns the info from a file
 func (fs *FileSystem) GetTopXMostViews(domain string, num int) (files []File, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-	return fs.getAllFromPreparedQuery(`
-	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
+	return fs.getAllFromPreparedQuery(fs.reader, `
+	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views FROM fs 
 	INNER JOIN fts ON fs.id=fts.id 
 	INNER JOIN domains ON fs.domainid=domains.id
 	WHERE 
@@ -1337,20 +1277,18 @@ func (fs *FileSystem) GetTopXMostViews(domain string, num int) (files []File, er
 
 // Get returns the info from a file
 func (fs *FileSystem) Get(id string, domain string) (files []File, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-	return fs.get(id, domain)
+	return fs.get(fs.reader, id, domain)
 }
 
-func (fs *FileSystem) get(id string, domain string) (files []File, err error) {
-	haveID, err := fs.isID(id)
+func (fs *FileSystem) get(db queryer, id string, domain string) (files []File, err error) {
+	haveID, err := fs.isID(db, id)
 	if err != nil {
 		err = errors.Wrap(err, "isID")
 		return
 	}
 	if haveID {
-		files, err = fs.getAllFromPreparedQuery(`
-		SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
+		files, err = fs.getAllFromPreparedQuery(db, `
+		SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views FROM fs 
 		INNER JOIN fts ON fs.id=fts.id 
 		WHERE fs.id = ? LIMIT 1`, id)
 		if err != nil {
@@ -1358,8 +1296,8 @@ func (fs *FileSystem) get(id string, domain string) (files []File, err error) {
 			return
 		}
 	} else {
-		files, err = fs.getAllFromPreparedQuery(`
-		SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views
+		files, err = fs.getAllFromPreparedQuery(db, `
+		SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views
 		FROM fs 
 		INNER JOIN fts ON fs.id=fts.id 
 		INNER JOIN domains ON fs.domainid=domains.id
@@ -1373,11 +1311,22 @@ func (fs *FileSystem) get(id string, domain string) (files []File, err error) {
 			return
 		}
 	}
-	if len(files) > 0 {
+	if len(files) == 0 {
+		err = errors.New("no files with that slug or id")
 		return
 	}
+	err = loadHistories(db, bindSQLite, files)
+	return
+}
 
-	err = errors.New("no files with that slug or id")
+// loadHistories gets the history of each file from its revisions.
+func loadHistories(db queryer, bind func(string) string, files []File) (err error) {
+	for i := range files {
+		files[i].History, err = getHistory(db, bind, files[i].ID, files[i].Data)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -1385,7 +1334,7 @@ func (fs *FileSystem) get(id string, domain string) (files []File, err error) {
 func (fs *FileSystem) LastModified() (lastModified time.Time, err error) {
 	// prepare statement
 	query := "SELECT modified FROM fs ORDER BY modified DESC LIMIT 1"
-	stmt, err := fs.DB.Prepare(query)
+	stmt, err := fs.reader.Prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
@@ -1414,24 +1363,72 @@ func (fs *FileSystem) LastModified() (lastModified time.Time, err error) {
 	return
 }
 
-// Find returns the info from a file
+// Find returns the files in the domain matching the search, best match
+// first, with a snippet of each. See parseSearch for what can be searched.
 func (fs *FileSystem) Find(text string, domain string) (files []File, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-
-	files, err = fs.getAllFromPreparedQuery(`
-		SELECT fs.id,fs.slug,fs.created,fs.modified,snippet(fts,'<b>','</b>','...',-1,-30),fs.history,fs.views FROM fts 
-			INNER JOIN fs ON fs.id=fts.id 
-			INNER JOIN domains ON fs.domainid=domains.id
-			WHERE fts.data MATCH ?
-			AND domains.name = ?
-			ORDER BY modified DESC`, text, domain)
+	q, err := parseSearch(text)
+	if err != nil {
+		return
+	}
+	where, filterArgs := q.where(searchColumns{
+		created:  "fs.created",
+		modified: "fs.modified",
+		data:     "fts.data",
+		exclude: func(t searchTerm) (string, interface{}) {
+			return "fs.id NOT IN (SELECT id FROM fts WHERE fts MATCH ?)", ftsQuery([][]searchTerm{{t}})
+		},
+	})
+
+	// without words only the filters are left
+	args := []interface{}{domain}
+	query := `SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.views,0 FROM fs
+		INNER JOIN fts ON fs.id=fts.id
+		INNER JOIN domains ON fs.domainid=domains.id
+		WHERE domains.name = ?
+		AND fts.data != ''` + where + `
+		ORDER BY fs.modified DESC`
+	if len(q.clauses) > 0 {
+		rank := fmt.Sprintf("bm25(fts, %g, %g, %g)", searchWeights[0], searchWeights[1], searchWeights[2])
+		args = []interface{}{ftsQuery(q.clauses), domain}
+		query = `SELECT fs.id,fs.slug,fs.created,fs.modified,
+		snippet(fts, 2, char(2), char(3), '...', 30),fs.views,-` + rank + ` FROM fts
+		INNER JOIN fs ON fs.id=fts.id
+		INNER JOIN domains ON fs.domainid=domains.id
+		WHERE fts MATCH ?
+		AND domains.name = ?` + where + `
+		ORDER BY ` + rank + `, fs.modified DESC`
+	}
+	rows, err := fs.reader.Query(query, append(args, filterArgs...)...)
+	if err != nil {
+		err = errors.Wrap(err, "Find")
+		return
+	}
+	defer rows.Close()
+	files = []File{}
+	for rows.Next() {
+		var f File
+		err = rows.Scan(&f.ID, &f.Slug, &f.Created, &f.Modified, &f.Data, &f.Views, &f.Rank)
+		if err != nil {
+			err = errors.Wrap(err, "get rows of file")
+			return
+		}
+		if len(q.clauses) == 0 {
+			f.Data = snippet(f.Data, tokenize(f.Data), nil)
+		}
+		f.Data, f.DataHTML = highlight(f.Data)
+		files = append(files, f)
+	}
+	err = rows.Err()
+	if err != nil {
+		err = errors.Wrap(err, "Find")
+		return
+	}
 	return
 }
 
 // Exists returns whether specified ID exists exists
-func (fs *FileSystem) idExists(id string) (exists bool, err error) {
-	files, err := fs.getAllFromPreparedQuerySingleString(`
+func (fs *FileSystem) idExists(db queryer, id string) (exists bool, err error) {
+	files, err := fs.getAllFromPreparedQuerySingleString(db, `
 		SELECT id FROM fts WHERE id = ?`, id)
 	if err != nil {
 		err = errors.Wrap(err, "Exists")
@@ -1443,8 +1440,8 @@ func (fs *FileSystem) idExists(id string) (exists bool, err error) {
 }
 
 // isID returns whether specified ID exists exists
-func (fs *FileSystem) isID(id string) (exists bool, err error) {
-	files, err := fs.getAllFromPreparedQuerySingleString(`
+func (fs *FileSystem) isID(db queryer, id string) (exists bool, err error) {
+	files, err := fs.getAllFromPreparedQuerySingleString(db, `
 		SELECT id FROM fs WHERE id = ?`, id)
 	if err != nil {
 		err = errors.Wrap(err, "Exists")
@@ -1462,7 +1459,7 @@ func (fs *FileSystem) LatestEntryFromDomainID(domainid int) (latest time.Time, e
 		return
 	}
 
-	timestamps, err := fs.getAllFromPreparedQuerySingleTimestamp(`
+	timestamps, err := fs.getAllFromPreparedQuerySingleTimestamp(fs.reader, `
 		SELECT modified FROM fs WHERE domainid = ? AND views > 0 ORDER BY modified DESC LIMIT 1
 	`, domainid)
 	if err != nil {
@@ -1484,10 +1481,7 @@ func (fs *FileSystem) Exists(id string, domain string) (trueID string, many bool
 	// 	log.Debugf("checked exists %s/%s in %s", domain, id, time.Since(timeStart))
 	// }()
 
-	// fs.Lock()
-	// defer fs.Unlock()
-
-	ids, err := fs.getAllFromPreparedQuerySingleString(`
+	ids, err := fs.getAllFromPreparedQuerySingleString(fs.reader, `
 		SELECT id FROM fs WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, id, domain)
 	if err != nil {
 		err = errors.Wrap(err, "Exists")
@@ -1498,7 +1492,7 @@ func (fs *FileSystem) Exists(id string, domain string) (trueID string, many bool
 		return
 	}
 
-	ids, err = fs.getAllFromPreparedQuerySingleString(`
+	ids, err = fs.getAllFromPreparedQuerySingleString(fs.reader, `
 	SELECT fs.id FROM fs WHERE fs.slug = ? AND fs.domainid IN (SELECT id FROM domains WHERE name = ?)`, id, domain)
 	if err != nil {
 		err = errors.Wrap(err, "Exists")
@@ -1514,14 +1508,14 @@ func (fs *FileSystem) Exists(id string, domain string) (trueID string, many bool
 	return
 }
 
-func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...interface{}) (files []File, err error) {
+func (fs *FileSystem) getAllFromPreparedQuery(db queryer, query string, args ...interface{}) (files []File, err error) {
 	// timeStart := time.Now().UTC()
 	// defer func() {
 	// 	log.Debugf("getAllFromPreparedQuery %s in %s", query, time.Since(timeStart))
 	// }()
 
 	// prepare statement
-	stmt, err := fs.DB.Prepare(query)
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
@@ -1539,27 +1533,18 @@ func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...interface{})
 	files = []File{}
 	for rows.Next() {
 		var f File
-		var history sql.NullString
 		err = rows.Scan(
 			&f.ID,
 			&f.Slug,
 			&f.Created,
 			&f.Modified,
 			&f.Data,
-			&history,
 			&f.Views,
 		)
 		if err != nil {
 			err = errors.Wrap(err, "get rows of file")
 			return
 		}
-		if history.Valid {
-			err = json.Unmarshal([]byte(history.String), &f.History)
-			if err != nil {
-				err = errors.Wrap(err, "could not parse history")
-				return
-			}
-		}
 		f.DataHTML = template.HTML(f.Data)
 		files = append(files, f)
 	}
@@ -1570,14 +1555,14 @@ func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...interface{})
 	return
 }
 
-func (fs *FileSystem) getAllFromPreparedQuerySingleString(query string, args ...interface{}) (s []string, err error) {
+func (fs *FileSystem) getAllFromPreparedQuerySingleString(db queryer, query string, args ...interface{}) (s []string, err error) {
 	// timeStart := time.Now().UTC()
 	// defer func() {
 	// 	log.Debugf("getAllFromPreparedQuerySingleString %s in %s", query, time.Since(timeStart))
 	// }()
 
 	// prepare statement
-	stmt, err := fs.DB.Prepare(query)
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
@@ -1611,14 +1596,14 @@ func (fs *FileSystem) getAllFromPreparedQuerySingleString(query string, args ...
 	return
 }
 
-func (fs *FileSystem) getAllFromPreparedQuerySingleTimestamp(query string, args ...interface{}) (s []time.Time, err error) {
+func (fs *FileSystem) getAllFromPreparedQuerySingleTimestamp(db queryer, query string, args ...interface{}) (s []time.Time, err error) {
 	// timeStart := time.Now().UTC()
 	// defer func() {
 	// 	log.Debugf("getAllFromPreparedQuerySingleTimestamp %s in %s", query, time.Since(timeStart))
 	// }()
 
 	// prepare statement
-	stmt, err := fs.DB.Prepare(query)
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
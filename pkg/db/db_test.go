@@ -1,7 +1,9 @@
 package db
 
 import (
+	"fmt"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,7 +16,7 @@ func TestBasic(t *testing.T) {
 	fs, err := New("test.db")
 	assert.Nil(t, err)
 
-	f := fs.NewFile("test1", "someslug", "some text")
+	f := fs.NewFile("someslug", "some text")
 	assert.Nil(t, err)
 	err = fs.Save(f)
 	assert.Nil(t, err)
@@ -22,18 +24,95 @@ func TestBasic(t *testing.T) {
 	err = fs.Save(f)
 	assert.Nil(t, err)
 
-	f2, err := fs.Get("test1")
-	assert.Equal(t, f.Data, f2.Data)
+	files, err := fs.Get(f.ID, "public")
 	assert.Nil(t, err)
+	f2 := files[0]
+	assert.Equal(t, f.Data, f2.Data)
 	assert.True(t, f2.Modified.Second()-f.Modified.Second() >= 1)
 
-	exists, err := fs.Exists("doesn't exist")
+	trueID, _, err := fs.Exists("doesn't exist", "public")
 	assert.Nil(t, err)
-	assert.False(t, exists)
-	exists, err = fs.Exists("test1")
+	assert.Empty(t, trueID)
+	trueID, _, err = fs.Exists(f.ID, "public")
 	assert.Nil(t, err)
-	assert.True(t, exists)
+	assert.Equal(t, f.ID, trueID)
 
 	err = fs.DumpSQL()
 	assert.Nil(t, err)
 }
+
+func TestReadsDoNotWaitForWrites(t *testing.T) {
+	os.Remove("test.db")
+	defer os.Remove("test.db")
+	defer os.Remove("test.db.sql.gz")
+	fs, err := New("test.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+	f := fs.NewFile("someslug", "some text")
+	assert.Nil(t, fs.Save(f))
+
+	// hold the write lock as a long write would
+	fs.Lock()
+	defer fs.Unlock()
+	done := make(chan error)
+	go func() {
+		_, err := fs.Get("someslug", "public")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read waited for the write lock")
+	}
+}
+
+// BenchmarkViewEdit measures throughput under a mixed load where one in ten
+// requests edits a page and the rest view one.
+func BenchmarkViewEdit(b *testing.B) {
+	os.Remove("bench.db")
+	defer os.Remove("bench.db")
+	defer os.Remove("bench.db.sql.gz")
+	fs, err := New("bench.db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fs.Close()
+	key, err := fs.SetKey("public", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var pages []File
+	for i := 0; i < 100; i++ {
+		f := fs.NewFile(fmt.Sprintf("page%d", i), fmt.Sprintf("page %d has some text", i))
+		if err = fs.Save(f); err != nil {
+			b.Fatal(err)
+		}
+		pages = append(pages, f)
+	}
+
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			f := pages[i%int64(len(pages))]
+			if i%10 == 0 {
+				f.Data = fmt.Sprintf("edit %d", i)
+				if err := fs.Save(f); err != nil {
+					b.Error(err)
+				}
+				continue
+			}
+			if _, _, err := fs.CheckKey(key); err != nil {
+				b.Error(err)
+			}
+			if _, err := fs.Get(f.ID, "public"); err != nil {
+				b.Error(err)
+			}
+			if _, err := fs.GetTopX("public", 10); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// ExportPosts will save posts to {{TIMESTAMP}}-posts.gz
+func ExportPosts(fs Store) error {
+	domains, err := fs.GetDomains()
+	if err != nil {
+		return err
+	}
+
+	dir := os.TempDir()
+	postPaths := []string{}
+	for _, domain := range domains {
+		files, err := fs.GetAll(domain)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			fname := (fmt.Sprintf("%s-%s.md", file.Slug, file.ID))
+			r := strings.NewReader(file.Data)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			_, err = buf.ReadFrom(r)
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(filepath.Join(dir, domain), os.ModePerm)
+			if err != nil {
+				return err
+			}
+			fpath := filepath.Join(dir, domain, fname)
+			err = ioutil.WriteFile(fpath, buf.Bytes(), os.ModePerm)
+			if err != nil {
+				return err
+			}
+
+			postPaths = append(postPaths, fpath)
+		}
+	}
+	timestamp := strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
+	for _, f := range postPaths {
+		log.Debug(f)
+	}
+	utils.ZipFiles(fmt.Sprintf("%s-posts.zip", timestamp), postPaths)
+	return nil
+
+}
+
+// ExportUploads will save uploads to {{TIMESTAMP}}-uploads.gz
+func ExportUploads(fs Store) error {
+	dir := os.TempDir()
+	files := []string{}
+
+	ids, err := fs.GetBlobIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		name, data, _, err := fs.GetBlob(id)
+		if err != nil {
+			return err
+		}
+		fname := fmt.Sprintf("%s-%s", id, name)
+
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(r)
+		if err != nil {
+			return err
+		}
+		fpath := filepath.Join(dir, fname)
+		err = ioutil.WriteFile(fpath, buf.Bytes(), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, fpath)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
+	for _, f := range files {
+		log.Debug(f)
+	}
+	utils.ZipFiles(fmt.Sprintf("%s-uploads.zip", timestamp), files)
+	return nil
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/versionedtext"
+)
+
+// Inconsistency is a page whose row in fs, revisions and entry in the fts
+// search index disagree.
+type Inconsistency struct {
+	ID      string
+	Problem string
+	// repair fixes the inconsistency inside the transaction of Fsck
+	repair func(tx *sql.Tx) error
+}
+
+func (i Inconsistency) String() string {
+	return fmt.Sprintf("%s: %s", i.ID, i.Problem)
+}
+
+// Checker is implemented by stores that keep pages and their search index
+// apart, and so can find and repair mismatches between them.
+type Checker interface {
+	// Fsck returns every page whose content and search index disagree, and
+	// if repair is true fixes them.
+	Fsck(repair bool) (problems []Inconsistency, err error)
+}
+
+// Fsck compares every page in fs with its entry in fts. The revisions of the
+// page are taken to be the truth, as Save writes them before the index. The
+// pages are read one at a time from the reader pool, so that saves go on
+// during the check. Repairs are done in a single transaction, which checks
+// the pages again first, as they may have been saved in the meantime.
+func (fs *FileSystem) Fsck(repair bool) (problems []Inconsistency, err error) {
+	problems = []Inconsistency{}
+	err = scanPages(fs.reader, "", func(p fsckPage) {
+		problems = append(problems, p.problems()...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortProblems(problems)
+	if !repair || len(problems) == 0 {
+		return
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return problems, errors.Wrap(err, "begin fsck")
+	}
+	defer tx.Rollback()
+	var ids []string
+	for _, p := range problems {
+		if len(ids) == 0 || ids[len(ids)-1] != p.ID {
+			ids = append(ids, p.ID)
+		}
+	}
+	problems = []Inconsistency{}
+	for _, id := range ids {
+		err = scanPages(tx, id, func(p fsckPage) {
+			problems = append(problems, p.problems()...)
+		})
+		if err != nil {
+			return
+		}
+	}
+	sortProblems(problems)
+	for _, p := range problems {
+		err = p.repair(tx)
+		if err != nil {
+			return problems, errors.Wrapf(err, "repairing %s", p)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = errors.Wrap(err, "commit fsck")
+	}
+	return
+}
+
+func sortProblems(problems []Inconsistency) {
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].ID == problems[j].ID {
+			return problems[i].Problem < problems[j].Problem
+		}
+		return problems[i].ID < problems[j].ID
+	})
+}
+
+// fsckPage is what fs, fts and revisions have for a page.
+type fsckPage struct {
+	id     string
+	isPage bool
+	// the index has no unique ids, so keep every entry to find duplicates
+	entries []string
+	history *versionedtext.VersionedText
+}
+
+// scanPages calls f with each page in fs, fts or revisions, or only the page
+// with the id if it is not empty. The rows are read in order of id, so that
+// only one page is kept in memory at a time.
+func scanPages(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, id string, f func(p fsckPage)) (err error) {
+	where := ""
+	var args []interface{}
+	if id != "" {
+		where = " WHERE id = ?"
+		args = []interface{}{id, id, id}
+	}
+	// the rows of fts are kept in the order they were indexed, and those of
+	// revisions in the order they were made
+	rows, err := db.Query(`SELECT id, 0, '', 0, '' FROM fs`+where+`
+		UNION ALL SELECT id, 1, data, rowid, '' FROM fts`+where+`
+		UNION ALL SELECT id, 2, '', ts, delta FROM revisions`+where+`
+		ORDER BY 1, 2, 4`, args...)
+	if err != nil {
+		return errors.Wrap(err, "reading pages")
+	}
+	defer rows.Close()
+	var p fsckPage
+	for rows.Next() {
+		var rowID, data, delta string
+		var table int
+		var ts int64
+		err = rows.Scan(&rowID, &table, &data, &ts, &delta)
+		if err != nil {
+			return errors.Wrap(err, "reading pages")
+		}
+		if rowID != p.id {
+			if p.id != "" {
+				f(p)
+			}
+			p = fsckPage{id: rowID}
+		}
+		switch table {
+		case 0:
+			p.isPage = true
+		case 1:
+			p.entries = append(p.entries, data)
+		case 2:
+			if p.history == nil {
+				p.history = &versionedtext.VersionedText{Diffs: make(map[int64]string)}
+			}
+			p.history.Diffs[ts] = delta
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "reading pages")
+	}
+	if p.id != "" {
+		f(p)
+	}
+	return
+}
+
+// problems returns how the rows of the page disagree.
+func (p fsckPage) problems() (problems []Inconsistency) {
+	id, entries := p.id, p.entries
+	if !p.isPage {
+		if p.history != nil {
+			problems = append(problems, Inconsistency{id, "has history but no page", deleteHistory(id)})
+		}
+		if len(entries) > 0 {
+			problems = append(problems, Inconsistency{id, "is indexed but has no page", deleteIndex(id)})
+		}
+		return
+	}
+
+	var revisions []Revision
+	if p.history != nil {
+		var err error
+		revisions, err = historyRevisions(*p.history)
+		if err != nil {
+			revisions = nil
+			if len(entries) == 0 {
+				return append(problems, Inconsistency{id, "has a broken history and is not indexed", deletePage(id)})
+			}
+			problems = append(problems, Inconsistency{id, "has a broken history", resetHistory(id, entries[0])})
+		}
+	}
+	if len(revisions) == 0 {
+		if len(entries) == 0 {
+			return append(problems, Inconsistency{id, "has no history and is not indexed", deletePage(id)})
+		}
+		// pages that were only ever empty have no revisions
+		if p.history == nil && entries[0] != "" {
+			problems = append(problems, Inconsistency{id, "has no history", resetHistory(id, entries[0])})
+		}
+		if len(entries) > 1 {
+			problems = append(problems, Inconsistency{id, fmt.Sprintf("is indexed %d times", len(entries)), reindex(id, entries[0])})
+		}
+		return
+	}
+
+	current := revisions[len(revisions)-1].Data
+	switch {
+	case len(entries) == 0:
+		problems = append(problems, Inconsistency{id, "is missing from the search index", reindex(id, current)})
+	case len(entries) > 1:
+		problems = append(problems, Inconsistency{id, fmt.Sprintf("is indexed %d times", len(entries)), reindex(id, current)})
+	case entries[0] != current:
+		problems = append(problems, Inconsistency{id, "has an out of date search index", reindex(id, current)})
+	}
+	return
+}
+
+func reindex(id, data string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM fts WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO fts(data,slug,id)
+			SELECT ?, CASE WHEN ? = '' THEN '' ELSE COALESCE(slug, '') END, id FROM fs WHERE id = ?`, data, data, id)
+		return err
+	}
+}
+
+// resetHistory starts the history of the page again with data as its only
+// revision.
+func resetHistory(id, data string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM revisions WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		_, err = addRevision(tx, bindSQLite, id, "", data)
+		return err
+	}
+}
+
+func deletePage(id string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM fs WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM shares WHERE fileid = ?`, id)
+		if err != nil {
+			return err
+		}
+		return deleteHistory(id)(tx)
+	}
+}
+
+func deleteHistory(id string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM revisions WHERE id = ?`, id)
+		return err
+	}
+}
+
+func deleteIndex(id string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM fts WHERE id = ?`, id)
+		return err
+	}
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	os.Remove("fsck.db")
+	defer os.Remove("fsck.db")
+	defer os.Remove("fsck.db.sql.gz")
+	fs, err := New("fsck.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+
+	ok := fs.NewFile("ok", "fine")
+	stale := fs.NewFile("stale", "new text")
+	missing := fs.NewFile("missing", "not indexed")
+	twice := fs.NewFile("twice", "indexed twice")
+	for _, f := range []File{ok, stale, missing, twice} {
+		assert.Nil(t, fs.Save(f))
+	}
+	problems, err := fs.Fsck(false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+
+	// break the index the ways a crash between writes used to
+	_, err = fs.DB.Exec(`UPDATE fts SET data = 'old text' WHERE id = ?`, stale.ID)
+	assert.Nil(t, err)
+	_, err = fs.DB.Exec(`DELETE FROM fts WHERE id = ?`, missing.ID)
+	assert.Nil(t, err)
+	_, err = fs.DB.Exec(`INSERT INTO fts(data,id) VALUES ('indexed twice', ?)`, twice.ID)
+	assert.Nil(t, err)
+	_, err = fs.DB.Exec(`INSERT INTO fts(data,id) VALUES ('orphan', 'nopage')`)
+	assert.Nil(t, err)
+	// and the history
+	_, err = fs.DB.Exec(`UPDATE revisions SET delta = 'not a delta' WHERE id = ?`, ok.ID)
+	assert.Nil(t, err)
+	_, err = fs.DB.Exec(`INSERT INTO revisions (id, ts, delta) VALUES ('nopage', 1, '+orphan')`)
+	assert.Nil(t, err)
+
+	problems, err = fs.Fsck(false)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 6)
+
+	// checking does not hold up saves
+	fs.Lock()
+	done := make(chan bool)
+	go func() {
+		problems, err = fs.Fsck(false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("fsck waited for the lock")
+	}
+	fs.Unlock()
+	<-done
+	assert.Nil(t, err)
+	assert.Len(t, problems, 6, "checking should not repair")
+
+	problems, err = fs.Fsck(true)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 6)
+	problems, err = fs.Fsck(false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+
+	files, err := fs.Find("new", "public")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	files, err = fs.Get(missing.ID, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "not indexed", files[0].Data)
+	files, err = fs.Get(ok.ID, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "fine", files[0].History.GetCurrent())
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/versionedtext"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+const (
+	// keepAllRevisions is how long every revision of a page is kept.
+	keepAllRevisions = 24 * time.Hour
+	// keepHourlyRevisions is how long the last revision of every hour is
+	// kept, after that only the last one of every day is.
+	keepHourlyRevisions = 30 * 24 * time.Hour
+)
+
+// Compactor is implemented by stores that can thin out the history of their
+// pages.
+type Compactor interface {
+	// Compact thins out the history of every page that is not in the trash,
+	// see compactHistory, and returns how many pages were compacted and how
+	// many revisions were removed.
+	Compact(now time.Time) (pages, revisions int, err error)
+}
+
+// Revision is one saved version of a page.
+type Revision struct {
+	// Timestamp is when the revision was saved, in nanoseconds since the
+	// epoch. It is what ?version= takes to show the page at that revision.
+	Timestamp int64
+	Data      string
+	// Delta is how many characters longer the revision is than the one
+	// before it.
+	Delta int
+}
+
+// Modified returns when the revision was saved.
+func (r Revision) Modified() time.Time {
+	return time.Unix(0, r.Timestamp).UTC()
+}
+
+func (r Revision) ModifiedDate(utcOffset int) string {
+	return formattedDate(r.Modified(), utcOffset)
+}
+
+// Size returns the length of the revision in characters.
+func (r Revision) Size() int {
+	return utf8.RuneCountInString(r.Data)
+}
+
+// Revisions returns every version in the history of the page, oldest first.
+// They are rebuilt in a single pass over the diffs.
+func (f File) Revisions() (revisions []Revision, err error) {
+	return historyRevisions(f.History)
+}
+
+func historyRevisions(history versionedtext.VersionedText) (revisions []Revision, err error) {
+	dmp := diffmatchpatch.New()
+	revisions = []Revision{}
+	previous := ""
+	for _, ts := range history.GetSnapshots() {
+		var diffs []diffmatchpatch.Diff
+		diffs, err = dmp.DiffFromDelta(previous, history.Diffs[ts])
+		if err != nil {
+			return
+		}
+		data := dmp.DiffText2(diffs)
+		revisions = append(revisions, Revision{
+			Timestamp: ts,
+			Data:      data,
+			Delta:     utf8.RuneCountInString(data) - utf8.RuneCountInString(previous),
+		})
+		previous = data
+	}
+	return
+}
+
+// compactHistory thins out a history so that it does not grow without bound
+// as pages are saved while they are typed, see keepRevisions. It returns the
+// number of revisions removed, and the history unchanged if there are none.
+func compactHistory(history versionedtext.VersionedText, now time.Time) (compacted versionedtext.VersionedText, removed int, err error) {
+	revisions, err := historyRevisions(history)
+	if err != nil || len(revisions) == 0 {
+		return history, 0, err
+	}
+	timestamps := make([]int64, len(revisions))
+	for i, revision := range revisions {
+		timestamps[i] = revision.Timestamp
+	}
+	keep := keepRevisions(timestamps, now)
+
+	compacted = versionedtext.VersionedText{
+		CurrentText: history.CurrentText,
+		Diffs:       make(map[int64]string),
+	}
+	dmp := diffmatchpatch.New()
+	previous := ""
+	for i, revision := range revisions {
+		// a revision the same as the one kept before it would be an empty diff
+		if !keep[i] || revision.Data == previous {
+			removed++
+			continue
+		}
+		compacted.Diffs[revision.Timestamp] = dmp.DiffToDelta(dmp.DiffMain(previous, revision.Data, true))
+		previous = revision.Data
+	}
+	if removed == 0 {
+		return history, 0, nil
+	}
+	return
+}
+
+// keepRevisions returns which of the revisions saved at the timestamps, in
+// order, to keep: every revision of the last day, the last one of every hour
+// of the last month and the last one of every day before that. The current
+// text is always kept.
+func keepRevisions(timestamps []int64, now time.Time) (keep []bool) {
+	// walk from the most recent, so the first revision seen in a bucket is
+	// the last one saved in it
+	keep = make([]bool, len(timestamps))
+	buckets := make(map[time.Time]bool)
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		modified := time.Unix(0, timestamps[i]).UTC()
+		age := now.Sub(modified)
+		if age < keepAllRevisions {
+			keep[i] = true
+			continue
+		}
+		bucket := modified.Truncate(24 * time.Hour)
+		if age < keepHourlyRevisions {
+			bucket = modified.Truncate(time.Hour)
+		}
+		if !buckets[bucket] {
+			buckets[bucket] = true
+			keep[i] = true
+		}
+	}
+	return
+}
+
+// historiesToCompact returns the pages not in the trash with revisions that
+// keepRevisions would remove. Only the timestamps are read.
+func historiesToCompact(db *sql.DB, now time.Time) (ids []string, err error) {
+	rows, err := db.Query(`SELECT id, ts FROM revisions
+		WHERE id IN (SELECT id FROM fs WHERE deleted IS NULL)
+		ORDER BY id, ts`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading revisions")
+	}
+	defer rows.Close()
+	var page string
+	var timestamps []int64
+	check := func() {
+		for _, keep := range keepRevisions(timestamps, now) {
+			if !keep {
+				ids = append(ids, page)
+				return
+			}
+		}
+	}
+	for rows.Next() {
+		var id string
+		var ts int64
+		err = rows.Scan(&id, &ts)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading revisions")
+		}
+		if id != page {
+			check()
+			page, timestamps = id, nil
+		}
+		timestamps = append(timestamps, ts)
+	}
+	check()
+	err = rows.Err()
+	return
+}
+
+// compactPage compacts the history of the page inside tx. If lock is given it
+// is executed first with the id, to lock the page where the database needs
+// that.
+func compactPage(tx *sql.Tx, lock string, bind func(string) string, id string, now time.Time) (removed int, err error) {
+	if lock != "" {
+		_, err = tx.Exec(lock, id)
+		if err != nil {
+			return 0, errors.Wrap(err, "lock page")
+		}
+	}
+	history, err := getHistory(tx, bind, id, "")
+	if err != nil {
+		return
+	}
+	history, removed, err = compactHistory(history, now)
+	if err != nil || removed == 0 {
+		return
+	}
+	_, err = tx.Exec(bind(`DELETE FROM revisions WHERE id = ?`), id)
+	if err != nil {
+		return 0, errors.Wrap(err, "delete revisions")
+	}
+	err = insertHistory(tx, bind, id, history)
+	return
+}
+
+// getHistory returns the history of a page from its revisions, with current
+// as its current text.
+func getHistory(db queryer, bind func(string) string, id, current string) (history versionedtext.VersionedText, err error) {
+	history = versionedtext.VersionedText{CurrentText: current, Diffs: make(map[int64]string)}
+	stmt, err := db.Prepare(bind(`SELECT ts, delta FROM revisions WHERE id = ?`))
+	if err != nil {
+		return history, errors.Wrap(err, "preparing revisions")
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return history, errors.Wrap(err, "get revisions")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts int64
+		var delta string
+		err = rows.Scan(&ts, &delta)
+		if err != nil {
+			return history, errors.Wrap(err, "get revisions")
+		}
+		history.Diffs[ts] = delta
+	}
+	err = rows.Err()
+	return
+}
+
+// insertHistory saves every diff of the history as a revision of the page.
+func insertHistory(tx *sql.Tx, bind func(string) string, id string, history versionedtext.VersionedText) (err error) {
+	stmt, err := tx.Prepare(bind(`INSERT INTO revisions (id, ts, delta) VALUES (?, ?, ?)`))
+	if err != nil {
+		return errors.Wrap(err, "preparing revisions")
+	}
+	defer stmt.Close()
+	for ts, delta := range history.Diffs {
+		_, err = stmt.Exec(id, ts, delta)
+		if err != nil {
+			return errors.Wrap(err, "insert revision")
+		}
+	}
+	return
+}
+
+// addRevision saves the change from previous to data as a new revision of the
+// page, if there is a change. It returns whether the page has or ever had
+// content, which decides whether an empty page goes to the trash.
+func addRevision(tx *sql.Tx, bind func(string) string, id, previous, data string) (hadContent bool, err error) {
+	if previous != data {
+		dmp := diffmatchpatch.New()
+		delta := dmp.DiffToDelta(dmp.DiffMain(previous, data, true))
+		_, err = tx.Exec(bind(`INSERT INTO revisions (id, ts, delta) VALUES (?, ?, ?)`), id, time.Now().UnixNano(), delta)
+		if err != nil {
+			return false, errors.Wrap(err, "insert revision")
+		}
+		return true, nil
+	}
+	if data != "" {
+		return true, nil
+	}
+	var n int
+	err = tx.QueryRow(bind(`SELECT COUNT(*) FROM revisions WHERE id = ?`), id).Scan(&n)
+	if err != nil {
+		return false, errors.Wrap(err, "count revisions")
+	}
+	return n > 0, nil
+}
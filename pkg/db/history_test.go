@@ -0,0 +1,117 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/versionedtext"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevisions(t *testing.T) {
+	f := File{History: versionedtext.NewVersionedText("one")}
+	f.History.Update("one two")
+	f.History.Update("twö")
+
+	revisions, err := f.Revisions()
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 3)
+	for i, data := range []string{"one", "one two", "twö"} {
+		assert.Equal(t, data, revisions[i].Data)
+		previous, _ := f.History.GetPreviousByTimestamp(revisions[i].Timestamp)
+		assert.Equal(t, previous, revisions[i].Data)
+	}
+	assert.Equal(t, []int{3, 4, -4}, []int{revisions[0].Delta, revisions[1].Delta, revisions[2].Delta})
+	assert.Equal(t, 3, revisions[2].Size())
+
+	revisions, err = File{History: versionedtext.NewVersionedText("")}.Revisions()
+	assert.Nil(t, err)
+	assert.Empty(t, revisions)
+}
+
+// history returns a history with the texts saved at the times.
+func history(times []time.Time, texts []string) (vt versionedtext.VersionedText) {
+	dmp := diffmatchpatch.New()
+	vt = versionedtext.VersionedText{Diffs: make(map[int64]string)}
+	for i, text := range texts {
+		vt.Diffs[times[i].UnixNano()] = dmp.DiffToDelta(dmp.DiffMain(vt.CurrentText, text, true))
+		vt.CurrentText = text
+	}
+	return
+}
+
+func TestCompactHistory(t *testing.T) {
+	now := time.Date(2019, 3, 10, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		time.Date(2019, 1, 28, 10, 0, 0, 0, time.UTC),
+		time.Date(2019, 1, 29, 9, 0, 0, 0, time.UTC), // same day as the next
+		time.Date(2019, 1, 29, 18, 0, 0, 0, time.UTC),
+		time.Date(2019, 3, 8, 12, 10, 0, 0, time.UTC), // same hour as the next
+		time.Date(2019, 3, 8, 12, 20, 0, 0, time.UTC),
+		time.Date(2019, 3, 8, 13, 5, 0, 0, time.UTC),
+		now.Add(-time.Hour),
+		now.Add(-30 * time.Minute),
+	}
+	texts := []string{"f", "e1", "e2", "c1", "c2", "d", "a", "ab"}
+	vt := history(times, texts)
+
+	compacted, removed, err := compactHistory(vt, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, "ab", compacted.GetCurrent())
+	revisions, err := historyRevisions(compacted)
+	assert.Nil(t, err)
+	var kept []string
+	for _, r := range revisions {
+		kept = append(kept, r.Data)
+	}
+	assert.Equal(t, []string{"f", "e2", "c2", "d", "a", "ab"}, kept)
+	assert.Equal(t, times[2].UnixNano(), revisions[1].Timestamp)
+
+	_, removed, err = compactHistory(compacted, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+
+	// going back to the text of a kept revision adds nothing
+	vt = history(times[:3], []string{"x", "y", "x"})
+	compacted, removed, err = compactHistory(vt, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 1, compacted.NumEdits())
+	assert.Equal(t, "x", compacted.GetCurrent())
+}
+
+func TestCompact(t *testing.T) {
+	removeDatabase("compact.db")
+	defer removeDatabase("compact.db")
+	defer os.Remove("compact.db.sql.gz")
+	fs, err := New("compact.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+
+	now := time.Now().UTC()
+	times := []time.Time{now.Add(-72 * time.Hour), now.Add(-71*time.Hour - time.Minute), now.Add(-71 * time.Hour)}
+	f := fs.NewFile("notes", "third")
+	assert.Nil(t, fs.Save(f))
+	_, err = fs.DB.Exec(`DELETE FROM revisions WHERE id = ?`, f.ID)
+	assert.Nil(t, err)
+	tx, err := fs.DB.Begin()
+	assert.Nil(t, err)
+	assert.Nil(t, insertHistory(tx, bindSQLite, f.ID, history(times, []string{"first", "second", "third"})))
+	assert.Nil(t, tx.Commit())
+
+	pages, revisions, err := fs.Compact(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pages)
+	assert.Equal(t, 1, revisions)
+	files, err := fs.Get(f.ID, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "third", files[0].Data)
+	assert.Equal(t, 2, files[0].History.NumEdits())
+
+	pages, _, err = fs.Compact(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pages)
+}
@@ -0,0 +1,634 @@
+package db
+
+import (
+	"database/sql"
+	"html/template"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+	"github.com/schollz/versionedtext"
+)
+
+// Memory is a Store that keeps everything in memory. It is meant for tests,
+// nothing is persisted.
+type Memory struct {
+	files   map[string]*memoryFile
+	domains map[string]*memoryDomain
+	keys    map[string]*memoryKey   // by hash
+	tokens  map[string]*memoryToken // by hash
+	users   map[string]*memoryUser  // by name
+	shares  map[string]*Share       // by hash
+	audit   []Event
+	blobs   map[string]*memoryBlob
+	resized map[string]*memoryBlob
+	similar map[string][]string
+	sync.RWMutex
+
+	lastTokenID int
+	lastShareID int
+}
+
+type memoryFile struct {
+	File
+	domainid int
+	deleted  *time.Time
+}
+
+type memoryDomain struct {
+	id             int
+	name           string
+	hashedPassword string
+	ispublic       bool
+	options        DomainOptions
+	readerPassword string
+	members        map[int]Role // by user id
+	memoryTwoFactor
+}
+
+type memoryKey struct {
+	domainid int
+	userid   int  // 0 for the shared password
+	role     Role // of the shared password, admin or reader
+	created  time.Time
+	lastused time.Time
+}
+
+type memoryUser struct {
+	id             int
+	name           string
+	hashedPassword string
+	memoryTwoFactor
+}
+
+type memoryTwoFactor struct {
+	totpSecret    string
+	totpStep      int64
+	recoveryCodes string // hashes separated by spaces
+}
+
+type memoryToken struct {
+	Token
+	domainid int
+}
+
+type memoryBlob struct {
+	name  string
+	data  []byte
+	views int
+}
+
+// NewMemory returns an empty in-memory store with the public domain.
+func NewMemory() (m *Memory) {
+	m = &Memory{
+		files:   make(map[string]*memoryFile),
+		domains: make(map[string]*memoryDomain),
+		keys:    make(map[string]*memoryKey),
+		tokens:  make(map[string]*memoryToken),
+		users:   make(map[string]*memoryUser),
+		shares:  make(map[string]*Share),
+		blobs:   make(map[string]*memoryBlob),
+		resized: make(map[string]*memoryBlob),
+		similar: make(map[string][]string),
+	}
+	m.setDomain("public", "")
+	m.domains["public"].ispublic = true
+	return
+}
+
+// Close does nothing.
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) domainByID(domainid int) *memoryDomain {
+	for _, d := range m.domains {
+		if d.id == domainid {
+			return d
+		}
+	}
+	return nil
+}
+
+// file returns a copy of the file without its history, like the other stores
+// only Get and GetTrash load it, see withHistory.
+func (m *Memory) file(mf *memoryFile) (f File) {
+	f = mf.File
+	f.History = versionedtext.VersionedText{}
+	if d := m.domainByID(mf.domainid); d != nil {
+		f.Domain = d.name
+	}
+	f.DataHTML = template.HTML(f.Data)
+	return
+}
+
+// withHistory returns a copy of the file with its history.
+func (m *Memory) withHistory(mf *memoryFile) (f File) {
+	f = m.file(mf)
+	f.History.CurrentText = mf.History.CurrentText
+	f.History.Diffs = make(map[int64]string, len(mf.History.Diffs))
+	for timestamp, diff := range mf.History.Diffs {
+		f.History.Diffs[timestamp] = diff
+	}
+	return
+}
+
+// filter returns the files in the domain accepted by keep.
+func (m *Memory) filter(domain string, keep func(f *memoryFile) bool) (files []File) {
+	files = []File{}
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return
+	}
+	for _, mf := range m.files {
+		if mf.domainid == d.id && keep(mf) {
+			files = append(files, m.file(mf))
+		}
+	}
+	return
+}
+
+func sortFiles(files []File, created bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if created {
+			return files[i].Created.After(files[j].Created)
+		}
+		return files[i].Modified.After(files[j].Modified)
+	})
+}
+
+func limitFiles(files []File, num int) []File {
+	if num >= 0 && len(files) > num {
+		return files[:num]
+	}
+	return files
+}
+
+func hasData(f *memoryFile) bool {
+	return len(f.Data) > 0
+}
+
+// Save a file to memory.
+func (m *Memory) Save(f File) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if f.Domain == "" {
+		f.Domain = "public"
+	}
+	d, ok := m.domains[strings.ToLower(f.Domain)]
+	if !ok {
+		return errors.New("domain does not exist")
+	}
+
+	mf, ok := m.files[f.ID]
+	if ok && mf.domainid != d.id {
+		return errors.New("page belongs to another domain")
+	}
+	if !ok {
+		mf = &memoryFile{domainid: d.id}
+		mf.ID = f.ID
+		mf.Created = f.Created
+		mf.History = versionedtext.NewVersionedText(f.Data)
+		m.files[f.ID] = mf
+	} else {
+		mf.History.Update(f.Data)
+	}
+	mf.Slug = f.Slug
+	mf.Data = f.Data
+	mf.Modified = time.Now().UTC()
+	if deleted := trashed(mf.Data, mf.History.NumEdits() > 0); deleted == nil || mf.deleted == nil {
+		mf.deleted = deleted
+	}
+	return
+}
+
+// Get returns the file with the id, or the files in the domain with the slug.
+func (m *Memory) Get(id string, domain string) (files []File, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if mf, ok := m.files[id]; ok {
+		return []File{m.withHistory(mf)}, nil
+	}
+	files = m.filter(domain, func(f *memoryFile) bool {
+		return f.Slug == id
+	})
+	for i := range files {
+		files[i] = m.withHistory(m.files[files[i].ID])
+	}
+	sortFiles(files, false)
+	if len(files) == 0 {
+		err = errors.New("no files with that slug or id")
+	}
+	return
+}
+
+// GetAll returns all the files for a given domain
+func (m *Memory) GetAll(domain string, created ...bool) (files []File, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	files = m.filter(domain, hasData)
+	sortFiles(files, len(created) > 0 && created[0])
+	return
+}
+
+// GetTopX returns the most recent files in a domain
+func (m *Memory) GetTopX(domain string, num int, created ...bool) (files []File, err error) {
+	files, err = m.GetAll(domain, created...)
+	return limitFiles(files, num), err
+}
+
+// GetTopXMostViews returns the most viewed files in a domain
+func (m *Memory) GetTopXMostViews(domain string, num int) (files []File, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	files = m.filter(domain, hasData)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Views > files[j].Views
+	})
+	return limitFiles(files, num), nil
+}
+
+// Find returns the files in the domain matching the search, best match
+// first, with a snippet of each. See parseSearch for what can be searched.
+func (m *Memory) Find(text string, domain string) (files []File, err error) {
+	q, err := parseSearch(text)
+	if err != nil {
+		return
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return findQuery(q, m.filter(domain, hasData)), nil
+}
+
+// Exists returns whether specified id or slug exists
+func (m *Memory) Exists(id string, domain string) (trueID string, many bool, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	files := m.filter(domain, func(f *memoryFile) bool {
+		return f.ID == id
+	})
+	if len(files) == 0 {
+		files = m.filter(domain, func(f *memoryFile) bool {
+			return f.Slug == id
+		})
+	}
+	if len(files) > 0 {
+		trueID = files[0].ID
+	}
+	many = len(files) > 1
+	return
+}
+
+// UpdateViews increments the views of a file
+func (m *Memory) UpdateViews(f File) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if mf, ok := m.files[f.ID]; ok {
+		mf.Views = f.Views + 1
+	}
+	return
+}
+
+// DeleteEmpty deletes the pages that have no content
+func (m *Memory) DeleteEmpty() (err error) {
+	m.Lock()
+	defer m.Unlock()
+	for id, mf := range m.files {
+		if mf.Data == "" && mf.deleted == nil {
+			delete(m.files, id)
+		}
+	}
+	return
+}
+
+// GetTrash returns the pages in the trash of a domain, most recently emptied
+// first
+func (m *Memory) GetTrash(domain string) (files []File, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	files = m.filter(domain, func(f *memoryFile) bool {
+		return f.deleted != nil
+	})
+	for i := range files {
+		files[i] = m.withHistory(m.files[files[i].ID])
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return m.files[files[i].ID].deleted.After(*m.files[files[j].ID].deleted)
+	})
+	return
+}
+
+// PurgeTrash deletes the pages that were moved to the trash before the time
+func (m *Memory) PurgeTrash(before time.Time) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	for id, mf := range m.files {
+		if mf.deleted != nil && mf.deleted.Before(before) {
+			delete(m.files, id)
+			for hash, s := range m.shares {
+				if s.FileID == id {
+					delete(m.shares, hash)
+				}
+			}
+		}
+	}
+	return
+}
+
+// GetSimilar returns the files similar to the file
+func (m *Memory) GetSimilar(fileid string) (files []File, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	files = []File{}
+	for _, id := range m.similar[fileid] {
+		if mf, ok := m.files[id]; ok {
+			files = append(files, m.file(mf))
+		}
+	}
+	sortFiles(files, false)
+	return
+}
+
+// SetSimilar replaces the files similar to the file
+func (m *Memory) SetSimilar(id string, similarids []string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.similar[id] = append([]string{}, similarids...)
+	return
+}
+
+// LastModified returns the last time any file was modified
+func (m *Memory) LastModified() (lastModified time.Time, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, mf := range m.files {
+		if mf.Modified.After(lastModified) {
+			lastModified = mf.Modified
+		}
+	}
+	return
+}
+
+// GetDomains will return a list of domains
+func (m *Memory) GetDomains() (domains []string, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	domains = []string{}
+	for name := range m.domains {
+		domains = append(domains, name)
+	}
+	sort.Strings(domains)
+	return
+}
+
+// GetDomainFromName returns the domain id, throwing an error if it doesn't exist
+func (m *Memory) GetDomainFromName(domain string) (domainid int, ispublic bool, options DomainOptions, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	domain = strings.ToLower(domain)
+	d, ok := m.domains[domain]
+	if !ok {
+		err = errors.New("domain " + domain + " does not exist")
+		return
+	}
+	return d.id, d.ispublic, d.options, nil
+}
+
+// SetDomain creates a domain, throws an error if it already exists
+func (m *Memory) SetDomain(domain, password string) (err error) {
+	if err = checkNewDomain(domain); err != nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.domains[strings.ToLower(domain)]; ok {
+		return errors.New("domain already exists")
+	}
+	return m.setDomain(domain, password)
+}
+
+func (m *Memory) setDomain(domain, password string) (err error) {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	domain = strings.ToLower(domain)
+	m.domains[domain] = &memoryDomain{
+		id:             len(m.domains) + 1,
+		name:           domain,
+		hashedPassword: hashedPassword,
+		members:        make(map[int]Role),
+	}
+	return
+}
+
+// UpdateDomain changes the settings, and the password if given, of a domain
+func (m *Memory) UpdateDomain(domain, password string, ispublic bool, options DomainOptions) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return errors.New("domain does not exist")
+	}
+	if password != "" {
+		d.hashedPassword, err = utils.HashPassword(password)
+		if err != nil {
+			return errors.Wrap(err, "can't hash password")
+		}
+		m.deleteSessions(d.id)
+	}
+	d.ispublic = ispublic
+	d.options = options
+	return
+}
+
+// ValidateDomain returns the domain id or an error if the password doesn't match or if the domain doesn't exist
+func (m *Memory) ValidateDomain(domain, password string) (domainid int, options DomainOptions, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.validateDomain(domain, password)
+}
+
+func (m *Memory) validateDomain(domain, password string) (domainid int, options DomainOptions, err error) {
+	domain = strings.ToLower(domain)
+	d, ok := m.domains[domain]
+	if !ok {
+		err = errors.New("domain " + domain + " does not exist")
+		return
+	}
+	domainid, options = d.id, d.options
+	if utils.CheckPasswordHash(d.hashedPassword, password) != nil {
+		err = errors.New("incorrect password to log into domain")
+	}
+	return
+}
+
+// checkDomainPassword returns the domain id and the role to sign in with if
+// the password, or the reader password, of the domain is correct.
+func (m *Memory) checkDomainPassword(domain, password string) (domainid int, role Role, err error) {
+	domainid, options, err := m.validateDomain(domain, password)
+	role = RoleAdmin
+	if d := m.domainByID(domainid); err != nil && d != nil && d.readerPassword != "" && utils.CheckPasswordHash(d.readerPassword, password) == nil {
+		err = nil
+		role = RoleReader
+	}
+	if err == nil && options.NoSharedPassword {
+		err = errors.New("domain does not allow the shared password")
+	}
+	return
+}
+
+// CheckPassword checks the password of the user, or of the domain if user is
+// empty, without giving out a key.
+func (m *Memory) CheckPassword(domain, user, password string) (err error) {
+	m.RLock()
+	defer m.RUnlock()
+	if user != "" {
+		_, _, err = m.validateUser(domain, user, password)
+		return
+	}
+	_, _, err = m.checkDomainPassword(domain, password)
+	return
+}
+
+// SetKey returns a new key for the domain
+func (m *Memory) SetKey(domain, password string) (key string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	domainid, role, err := m.checkDomainPassword(domain, password)
+	if err != nil {
+		return
+	}
+	key, hash, err := newKey()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	m.keys[hash] = &memoryKey{domainid: domainid, role: role, created: now, lastused: now}
+	return
+}
+
+// CheckKey checks that it is a valid key for a domain
+func (m *Memory) CheckKey(key string) (domainid int, domain string, err error) {
+	k, err := m.GetKey(key)
+	return k.DomainID, k.Domain, err
+}
+
+// GetKey returns the session with the key.
+func (m *Memory) GetKey(key string) (k Key, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	mk, ok := m.keys[hashKey(key)]
+	if !ok {
+		return k, errors.New("no such key")
+	}
+	d := m.domainByID(mk.domainid)
+	if d == nil {
+		return k, errors.New("no such key")
+	}
+	k = Key{DomainID: d.id, Domain: d.name}
+	keyRole := sql.NullString{String: string(mk.role), Valid: mk.role != ""}
+	var role sql.NullString
+	if mk.userid != 0 {
+		for _, u := range m.users {
+			if u.id == mk.userid {
+				k.User = u.name
+			}
+		}
+		if r, ok := d.members[mk.userid]; ok {
+			role = sql.NullString{String: string(r), Valid: true}
+		}
+	}
+	k.Role, err = roleOfKey(k.User, keyRole, role, d.options)
+	return
+}
+
+// UpdateKeys will update their last use
+func (m *Memory) UpdateKeys(keys []string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range keys {
+		if k, ok := m.keys[hashKey(key)]; ok {
+			k.lastused = time.Now().UTC()
+		}
+	}
+	return
+}
+
+// DeleteKey deletes a specific key
+func (m *Memory) DeleteKey(key string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.keys, hashKey(key))
+	return
+}
+
+// DeleteOldKeys deletes keys older than 5 days
+func (m *Memory) DeleteOldKeys() (err error) {
+	m.Lock()
+	defer m.Unlock()
+	for hash, k := range m.keys {
+		if time.Since(k.lastused) >= 5*24*time.Hour {
+			delete(m.keys, hash)
+		}
+	}
+	return
+}
+
+// SaveBlob will save a blob
+func (m *Memory) SaveBlob(id string, name string, blob []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.blobs[id] = &memoryBlob{name: name, data: blob}
+	return
+}
+
+// GetBlob returns a blob and counts the view
+func (m *Memory) GetBlob(id string) (name string, data []byte, views int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	return getMemoryBlob(m.blobs, id)
+}
+
+// GetBlobIDs will return a list of blob ids
+func (m *Memory) GetBlobIDs() (ids []string, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	ids = []string{}
+	for id := range m.blobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return
+}
+
+// SaveResizedImage will save a resized image
+func (m *Memory) SaveResizedImage(id string, name string, blob []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.resized[id] = &memoryBlob{name: name, data: blob}
+	return
+}
+
+// GetResizedImage returns a resized image, or sql.ErrNoRows if there is none
+func (m *Memory) GetResizedImage(id string) (name string, data []byte, views int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	return getMemoryBlob(m.resized, id)
+}
+
+func getMemoryBlob(blobs map[string]*memoryBlob, id string) (name string, data []byte, views int, err error) {
+	b, ok := blobs[id]
+	if !ok {
+		err = sql.ErrNoRows
+		return
+	}
+	name, data, views = b.name, b.data, b.views
+	b.views++
+	return
+}
@@ -0,0 +1,485 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/schollz/versionedtext"
+)
+
+// Migration is a single, ordered step in the evolution of the schema.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *sql.Tx) error
+}
+
+// Migrator is implemented by stores with a versioned schema.
+type Migrator interface {
+	// SchemaVersion returns the version of the most recently applied
+	// migration, or 0 if the database has never been migrated.
+	SchemaVersion() (version int, err error)
+	// PendingMigrations returns the migrations that have not yet been applied.
+	PendingMigrations() (pending []Migration, err error)
+	// Migrate applies all pending migrations in order.
+	Migrate() (applied []Migration, err error)
+}
+
+// migrations are applied in order by Migrate. Never edit or reorder an entry
+// that has been released, only append new ones.
+var migrations = []Migration{
+	{1, "initial schema", migrateInitialSchema},
+	{2, "trash for emptied pages", migrateTrash},
+	{3, "history in its own table", migrateRevisions},
+	{4, "api tokens", migrateTokens},
+	{5, "hashed session keys", migrateHashedKeys},
+	{6, "users and memberships", migrateUsers},
+	{7, "reader passwords", migrateReaderPasswords},
+	{8, "share links", migrateShares},
+	{9, "two-factor authentication", migrateTwoFactor},
+	{10, "audit log", migrateAudit},
+	{11, "creation time of keys", migrateKeysCreated},
+	{12, "ranked search", migrateSearchRanking},
+}
+
+// LatestSchemaVersion is the SQLite schema version this build of rwtxt expects.
+func LatestSchemaVersion() int {
+	return latestVersion(migrations)
+}
+
+func latestVersion(migrations []Migration) int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the most recently applied migration,
+// or 0 if the database has never been migrated.
+func (fs *FileSystem) SchemaVersion() (version int, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return schemaVersion(fs.DB, migrations)
+}
+
+// PendingMigrations returns the migrations that have not yet been applied.
+func (fs *FileSystem) PendingMigrations() (pending []Migration, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	version, err := schemaVersion(fs.DB, migrations)
+	if err != nil {
+		return
+	}
+	return pendingMigrations(migrations, version, LatestSchemaVersion()), nil
+}
+
+// Migrate applies all pending migrations in order. Each migration runs in its
+// own transaction together with the bump of schema_version, so a failure
+// leaves the database at the last successfully applied version.
+func (fs *FileSystem) Migrate() (applied []Migration, err error) {
+	return fs.MigrateTo(LatestSchemaVersion())
+}
+
+// MigrateTo applies pending migrations up to and including version.
+func (fs *FileSystem) MigrateTo(version int) (applied []Migration, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return migrateTo(fs.DB, migrations, version, "", bindSQLite)
+}
+
+func schemaVersion(db *sql.DB, migrations []Migration) (version int, err error) {
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS
+	schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		description TEXT,
+		applied TIMESTAMP
+	);`)
+	if err != nil {
+		err = errors.Wrap(err, "creating schema_version table")
+		return
+	}
+	var v sql.NullInt64
+	err = db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&v)
+	if err != nil {
+		err = errors.Wrap(err, "getting schema version")
+		return
+	}
+	version = int(v.Int64)
+	if version > latestVersion(migrations) {
+		err = fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, latestVersion(migrations))
+	}
+	return
+}
+
+func pendingMigrations(migrations []Migration, from, to int) (pending []Migration) {
+	pending = []Migration{}
+	for _, m := range migrations {
+		if m.Version > from && m.Version <= to {
+			pending = append(pending, m)
+		}
+	}
+	return
+}
+
+// migrateTo applies the pending migrations up to version. If lock is given it
+// is executed at the start of every migration's transaction, so that several
+// processes sharing a database do not apply the same migration twice.
+func migrateTo(db *sql.DB, migrations []Migration, version int, lock string, bind func(string) string) (applied []Migration, err error) {
+	current, err := schemaVersion(db, migrations)
+	if err != nil {
+		return
+	}
+	applied = []Migration{}
+	for _, m := range pendingMigrations(migrations, current, version) {
+		startTime := time.Now()
+		var didApply bool
+		didApply, err = applyMigration(db, m, lock, bind)
+		if err != nil {
+			err = errors.Wrapf(err, "migration %d (%s)", m.Version, m.Description)
+			return
+		}
+		if !didApply {
+			continue
+		}
+		log.Infof("applied migration %d (%s) in %s", m.Version, m.Description, time.Since(startTime))
+		applied = append(applied, m)
+	}
+	return
+}
+
+func applyMigration(db *sql.DB, m Migration, lock string, bind func(string) string) (didApply bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "begin migration")
+	}
+	defer func() {
+		if err != nil || !didApply {
+			tx.Rollback()
+		}
+	}()
+
+	if lock != "" {
+		_, err = tx.Exec(lock)
+		if err != nil {
+			return false, errors.Wrap(err, "locking")
+		}
+	}
+	// another process may have applied it while we waited
+	var exists int
+	err = tx.QueryRow(bind(`SELECT COUNT(*) FROM schema_version WHERE version = ?`), m.Version).Scan(&exists)
+	if err != nil || exists > 0 {
+		return
+	}
+
+	err = m.up(tx)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(bind(`INSERT INTO schema_version (version, description, applied) VALUES (?,?,?)`),
+		m.Version, m.Description, time.Now().UTC())
+	if err != nil {
+		return false, errors.Wrap(err, "recording schema version")
+	}
+	err = tx.Commit()
+	didApply = err == nil
+	return
+}
+
+// bindSQLite leaves the ? placeholders of query as they are.
+func bindSQLite(query string) string {
+	return query
+}
+
+// execAll runs each statement in order, stopping at the first error.
+func execAll(tx *sql.Tx, stmts ...string) (err error) {
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return errors.Wrap(err, stmt)
+		}
+	}
+	return
+}
+
+// migrateInitialSchema creates the schema as it existed before versioned
+// migrations. Everything is IF NOT EXISTS so that databases created by older
+// versions of rwtxt are adopted as-is.
+func migrateInitialSchema(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS
+		fs (
+			id TEXT NOT NULL PRIMARY KEY,
+			domainid INTEGER,
+			slug TEXT,
+			created TIMESTAMP,
+			modified TIMESTAMP,
+			history TEXT,
+			views INTEGER DEFAULT 0
+		);`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS
+		fts USING fts4 (id,data);`,
+		`CREATE TABLE IF NOT EXISTS
+		domains (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name TEXT,
+			hashed_pass TEXT,
+			ispublic INTEGER DEFAULT 0,
+			options BLOB
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		keys (
+			id INTEGER NOT NULL PRIMARY KEY,
+			domainid INTEGER,
+			key TEXT,
+			lastused TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		blobs (
+			id TEXT NOT NULL PRIMARY KEY,
+			name TEXT,
+			data BLOB,
+			views INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		similar (
+			id INTEGER NOT NULL PRIMARY KEY,
+			fsid TEXT,
+			fsid_similar TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		cached_images (
+			id TEXT NOT NULL PRIMARY KEY,
+			name TEXT,
+			data BLOB,
+			views INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		cached_html (
+			id TEXT NOT NULL PRIMARY KEY,
+			modified TIMESTAMP,
+			tr BLOB
+		);`,
+		`CREATE INDEX IF NOT EXISTS
+		fsslugs ON fs(slug,domainid);`,
+		`CREATE INDEX IF NOT EXISTS
+		domainsname ON domains(name);`,
+		`CREATE INDEX IF NOT EXISTS
+		similarid ON similar(fsid);`,
+	)
+}
+
+// migrateTrash adds the time a page was emptied, and moves the pages that are
+// already empty but once had content to the trash.
+func migrateTrash(tx *sql.Tx) error {
+	err := execAll(tx, `ALTER TABLE fs ADD COLUMN deleted TIMESTAMP;`)
+	if err != nil {
+		return err
+	}
+	return trashEmptiedPages(tx, `SELECT id, history FROM fs WHERE id IN (SELECT id FROM fts WHERE data = '')`, bindSQLite)
+}
+
+// trashEmptiedPages sets deleted on the pages returned by query, which
+// selects the id and history of empty pages, if they ever had content.
+func trashEmptiedPages(tx *sql.Tx, query string, bind func(string) string) (err error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return errors.Wrap(err, query)
+	}
+	var ids []string
+	for rows.Next() {
+		var f File
+		var history sql.NullString
+		err = rows.Scan(&f.ID, &history)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "getRows")
+		}
+		if history.Valid && json.Unmarshal([]byte(history.String), &f.History) == nil && f.History.NumEdits() > 0 {
+			ids = append(ids, f.ID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "getRows")
+	}
+	for _, id := range ids {
+		_, err = tx.Exec(bind(`UPDATE fs SET deleted = ? WHERE id = ?`), time.Now().UTC(), id)
+		if err != nil {
+			return errors.Wrap(err, "trashing "+id)
+		}
+	}
+	return
+}
+
+// migrateRevisions moves the history of every page out of fs, where it was a
+// JSON blob read with every row, into a row per revision.
+func migrateRevisions(tx *sql.Tx) error {
+	err := execAll(tx, `CREATE TABLE revisions (
+			id TEXT NOT NULL,
+			ts INTEGER NOT NULL,
+			delta TEXT NOT NULL,
+			PRIMARY KEY (id, ts)
+		);`)
+	if err != nil {
+		return err
+	}
+	err = moveHistories(tx, bindSQLite)
+	if err != nil {
+		return err
+	}
+	return execAll(tx, `ALTER TABLE fs DROP COLUMN history;`)
+}
+
+// moveHistories saves the history of every page as its revisions. Histories
+// are read one at a time, as they can be large. A history that can not be
+// parsed is left out, fsck starts it again from the current text.
+func moveHistories(tx *sql.Tx, bind func(string) string) (err error) {
+	rows, err := tx.Query(`SELECT id FROM fs WHERE history IS NOT NULL`)
+	if err != nil {
+		return errors.Wrap(err, "getting pages")
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "getRows")
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "getRows")
+	}
+
+	for _, id := range ids {
+		var history string
+		err = tx.QueryRow(bind(`SELECT history FROM fs WHERE id = ?`), id).Scan(&history)
+		if err != nil {
+			return errors.Wrap(err, "getting history of "+id)
+		}
+		var vt versionedtext.VersionedText
+		if errParse := json.Unmarshal([]byte(history), &vt); errParse != nil {
+			log.Warnf("could not parse the history of %s: %s", id, errParse)
+			continue
+		}
+		err = insertHistory(tx, bind, id, vt)
+		if err != nil {
+			return errors.Wrap(err, "moving history of "+id)
+		}
+	}
+	return
+}
+
+func migrateTokens(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE tokens (
+			id INTEGER NOT NULL PRIMARY KEY,
+			domainid INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			scope TEXT NOT NULL,
+			created TIMESTAMP,
+			expires TIMESTAMP,
+			lastused TIMESTAMP
+		);`,
+		`CREATE INDEX tokensdomain ON tokens(domainid);`,
+	)
+}
+
+// migrateHashedKeys signs everyone out, as the keys stored so far are the
+// keys themselves rather than their hashes.
+func migrateHashedKeys(tx *sql.Tx) error {
+	return execAll(tx,
+		`DELETE FROM keys;`,
+		`CREATE INDEX IF NOT EXISTS keyskey ON keys(key);`,
+	)
+}
+
+func migrateUsers(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE users (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			hashed_pass TEXT NOT NULL,
+			created TIMESTAMP
+		);`,
+		`CREATE TABLE memberships (
+			domainid INTEGER NOT NULL,
+			userid INTEGER NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (domainid, userid)
+		);`,
+		`ALTER TABLE keys ADD COLUMN userid INTEGER;`,
+	)
+}
+
+// migrateReaderPasswords adds the read-only password of domains, and the role
+// of the keys it hands out.
+func migrateReaderPasswords(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE domains ADD COLUMN reader_pass TEXT;`,
+		`ALTER TABLE keys ADD COLUMN role TEXT;`,
+	)
+}
+
+func migrateShares(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE shares (
+			id INTEGER NOT NULL PRIMARY KEY,
+			domainid INTEGER NOT NULL,
+			fileid TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			created TIMESTAMP,
+			expires TIMESTAMP,
+			maxviews INTEGER NOT NULL DEFAULT 0,
+			views INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX sharesfile ON shares(fileid);`,
+	)
+}
+
+// migrateTwoFactor adds the TOTP secrets and recovery codes of domains and
+// users, and the period of the last code used, which can not be used again.
+func migrateTwoFactor(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE domains ADD COLUMN totp_secret TEXT;`,
+		`ALTER TABLE domains ADD COLUMN totp_step INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE domains ADD COLUMN recovery_codes TEXT;`,
+		`ALTER TABLE users ADD COLUMN totp_secret TEXT;`,
+		`ALTER TABLE users ADD COLUMN totp_step INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE users ADD COLUMN recovery_codes TEXT;`,
+	)
+}
+
+// migrateAudit adds the audit log, with triggers that keep its events from
+// being changed or deleted.
+func migrateAudit(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE audit (
+			id INTEGER NOT NULL PRIMARY KEY,
+			created TIMESTAMP NOT NULL,
+			domain TEXT NOT NULL,
+			action TEXT NOT NULL,
+			page TEXT NOT NULL DEFAULT '',
+			username TEXT NOT NULL DEFAULT '',
+			session TEXT NOT NULL DEFAULT '',
+			remote TEXT NOT NULL DEFAULT '',
+			detail TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX auditdomain ON audit(domain, created);`,
+		`CREATE TRIGGER auditnoupdate BEFORE UPDATE ON audit BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;`,
+		`CREATE TRIGGER auditnodelete BEFORE DELETE ON audit BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;`,
+	)
+}
+
+// migrateKeysCreated adds when each key was handed out. Keys from before are
+// taken to be as old as their last use.
+func migrateKeysCreated(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE keys ADD COLUMN created TIMESTAMP;`,
+		`UPDATE keys SET created = lastused;`,
+	)
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/versionedtext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	os.Remove("migrate.db")
+	defer os.Remove("migrate.db")
+
+	fs, err := Open("migrate.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+
+	version, err := fs.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, version)
+
+	pending, err := fs.PendingMigrations()
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), len(pending))
+
+	applied, err := fs.Migrate()
+	assert.Nil(t, err)
+	assert.Equal(t, len(pending), len(applied))
+
+	version, err = fs.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, LatestSchemaVersion(), version)
+
+	// migrating again is a no-op
+	applied, err = fs.Migrate()
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+
+	// a database from a newer build is refused
+	_, err = fs.DB.Exec(`INSERT INTO schema_version (version) VALUES (?)`, LatestSchemaVersion()+1)
+	assert.Nil(t, err)
+	_, err = fs.Migrate()
+	assert.NotNil(t, err)
+}
+
+func TestMigrateRevisions(t *testing.T) {
+	os.Remove("revisions.db")
+	defer os.Remove("revisions.db")
+
+	fs, err := Open("revisions.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+	_, err = fs.MigrateTo(2)
+	assert.Nil(t, err)
+
+	vt := versionedtext.NewVersionedText("first")
+	vt.Update("second")
+	b, _ := json.Marshal(vt)
+	_, err = fs.DB.Exec(`INSERT INTO fs (id, slug, history) VALUES ('page', 'page', ?), ('broken', 'broken', '{')`, string(b))
+	assert.Nil(t, err)
+	_, err = fs.DB.Exec(`INSERT INTO fts (id, data) VALUES ('page', 'second'), ('broken', 'broken')`)
+	assert.Nil(t, err)
+
+	_, err = fs.MigrateTo(3)
+	assert.Nil(t, err)
+
+	history, err := getHistory(fs.DB, bindSQLite, "page", "second")
+	assert.Nil(t, err)
+	assert.Equal(t, vt.Diffs, history.Diffs)
+	revisions, err := historyRevisions(history)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", revisions[0].Data)
+	assert.Equal(t, "second", revisions[1].Data)
+
+	// the unparsable history is left for fsck to start again
+	problems, err := fs.Fsck(true)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 1)
+}
+
+func TestMigrateHashedKeys(t *testing.T) {
+	os.Remove("keys.db")
+	defer os.Remove("keys.db")
+
+	fs, err := Open("keys.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+	_, err = fs.MigrateTo(4)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.setDomain("notes", "secret"))
+	_, err = fs.DB.Exec(`INSERT INTO keys (domainid, key, lastused) SELECT id, 'plaintext', ? FROM domains WHERE name = 'notes'`, time.Now().UTC())
+	assert.Nil(t, err)
+
+	_, err = fs.Migrate()
+	assert.Nil(t, err)
+	var n int
+	assert.Nil(t, fs.DB.QueryRow(`SELECT COUNT(*) FROM keys`).Scan(&n))
+	assert.Equal(t, 0, n, "old keys are signed out")
+
+	key, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+	assert.Len(t, key, 64)
+	var stored string
+	assert.Nil(t, fs.DB.QueryRow(`SELECT key FROM keys`).Scan(&stored))
+	assert.NotEqual(t, key, stored, "only the hash is stored")
+	_, domain, err := fs.CheckKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "notes", domain)
+}
+
+func TestMigrateSearchRanking(t *testing.T) {
+	os.Remove("search.db")
+	defer os.Remove("search.db")
+
+	fs, err := Open("search.db")
+	assert.Nil(t, err)
+	defer fs.Close()
+	_, err = fs.MigrateTo(11)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.setDomain("notes", "secret"))
+	_, err = fs.DB.Exec(`INSERT INTO fs (id, domainid, slug, created, modified)
+		SELECT 'page1', id, 'groceries', ?, ? FROM domains WHERE name = 'notes'
+		UNION ALL SELECT 'page2', id, 'recipes', ?, ? FROM domains WHERE name = 'notes'`,
+		time.Now().UTC(), time.Now().UTC(), time.Now().UTC(), time.Now().UTC())
+	assert.Nil(t, err)
+	_, err = fs.DB.Exec(`INSERT INTO fts (id, data) VALUES ('page1', 'milk and bread'), ('page2', '')`)
+	assert.Nil(t, err)
+
+	_, err = fs.Migrate()
+	assert.Nil(t, err)
+	files, err := fs.Find("milk", "notes")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	files, err = fs.Find("groceries", "notes")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1, "slugs are indexed")
+	files, err = fs.Find("recipes", "notes")
+	assert.Nil(t, err)
+	assert.Empty(t, files, "but not those of pages in the trash")
+
+	// the index is on FTS5, and one still on FTS4 is moved to it
+	module, err := searchIndexModule(fs.DB)
+	assert.Nil(t, err)
+	assert.Equal(t, "fts5", module)
+	_, err = fs.DB.Exec(`CREATE VIRTUAL TABLE fts4 USING fts4 (id, slug, data, notindexed=id, tokenize=unicode61);
+		INSERT INTO fts4(id, slug, data) SELECT id, slug, data FROM fts;
+		DROP TABLE fts;
+		ALTER TABLE fts4 RENAME TO fts;`)
+	assert.Nil(t, err)
+	module, _ = searchIndexModule(fs.DB)
+	assert.Equal(t, "fts4", module)
+	assert.Nil(t, fs.upgradeSearchIndex())
+	module, _ = searchIndexModule(fs.DB)
+	assert.Equal(t, "fts5", module)
+	files, err = fs.Find("groceries", "notes")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,951 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	// register the postgres driver
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// Postgres is a Store backed by PostgreSQL. Unlike FileSystem it takes no
+// process-wide lock, so several rwtxt instances can share one database.
+// Full-text search uses a tsvector column in place of the fts table.
+type Postgres struct {
+	DSN string
+	DB  *sql.DB
+}
+
+// postgresMigrationLock is the pg_advisory_xact_lock key taken while
+// migrating, so replicas starting together don't race each other.
+const postgresMigrationLock = 7274678
+
+var postgresMigrations = []Migration{
+	{1, "initial schema", migratePostgresInitialSchema},
+	{2, "trash for emptied pages", migratePostgresTrash},
+	{3, "history in its own table", migratePostgresRevisions},
+	{4, "api tokens", migratePostgresTokens},
+	{5, "hashed session keys", migrateHashedKeys},
+	{6, "users and memberships", migratePostgresUsers},
+	{7, "reader passwords", migratePostgresReaderPasswords},
+	{8, "share links", migratePostgresShares},
+	{9, "two-factor authentication", migratePostgresTwoFactor},
+	{10, "audit log", migratePostgresAudit},
+	{11, "creation time of keys", migratePostgresKeysCreated},
+	{12, "ranked search", migratePostgresSearchRanking},
+}
+
+// IsPostgres returns whether name is a PostgreSQL DSN rather than the name of
+// a SQLite database.
+func IsPostgres(name string) bool {
+	return strings.HasPrefix(name, "postgres://") || strings.HasPrefix(name, "postgresql://")
+}
+
+// NewPostgres connects to the PostgreSQL database at dsn and migrates it.
+func NewPostgres(dsn string) (pg *Postgres, err error) {
+	pg, err = OpenPostgres(dsn)
+	if err != nil {
+		return
+	}
+	_, err = pg.Migrate()
+	if err != nil {
+		err = errors.Wrap(err, "could not initialize")
+		return
+	}
+	domainid, _, _, _ := pg.GetDomainFromName("public")
+	if domainid == 0 {
+		err = pg.SetDomain("public", "")
+		if err == nil {
+			err = pg.UpdateDomain("public", "", true, DomainOptions{})
+		}
+	}
+	return
+}
+
+// OpenPostgres connects to the PostgreSQL database at dsn without migrating it.
+func OpenPostgres(dsn string) (pg *Postgres, err error) {
+	pg = &Postgres{DSN: dsn}
+	pg.DB, err = sql.Open("postgres", dsn)
+	if err != nil {
+		return
+	}
+	err = pg.DB.Ping()
+	return
+}
+
+// bindPostgres rewrites the ? placeholders of query as $1, $2, ...
+func bindPostgres(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (pg *Postgres) exec(query string, args ...interface{}) (sql.Result, error) {
+	return pg.DB.Exec(bindPostgres(query), args...)
+}
+
+func (pg *Postgres) queryRow(query string, args ...interface{}) *sql.Row {
+	return pg.DB.QueryRow(bindPostgres(query), args...)
+}
+
+// Close closes the connections to the database.
+func (pg *Postgres) Close() error {
+	return pg.DB.Close()
+}
+
+// SchemaVersion returns the version of the most recently applied migration.
+func (pg *Postgres) SchemaVersion() (version int, err error) {
+	return schemaVersion(pg.DB, postgresMigrations)
+}
+
+// PendingMigrations returns the migrations that have not yet been applied.
+func (pg *Postgres) PendingMigrations() (pending []Migration, err error) {
+	version, err := schemaVersion(pg.DB, postgresMigrations)
+	if err != nil {
+		return
+	}
+	return pendingMigrations(postgresMigrations, version, latestVersion(postgresMigrations)), nil
+}
+
+// Migrate applies all pending migrations in order.
+func (pg *Postgres) Migrate() (applied []Migration, err error) {
+	return migrateTo(pg.DB, postgresMigrations, latestVersion(postgresMigrations),
+		"SELECT pg_advisory_xact_lock("+strconv.Itoa(postgresMigrationLock)+")", bindPostgres)
+}
+
+func migratePostgresInitialSchema(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS
+		domains (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			hashed_pass TEXT,
+			ispublic INTEGER DEFAULT 0,
+			options TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		fs (
+			id TEXT NOT NULL PRIMARY KEY,
+			domainid INTEGER REFERENCES domains(id),
+			slug TEXT,
+			created TIMESTAMPTZ,
+			modified TIMESTAMPTZ,
+			history TEXT,
+			views INTEGER DEFAULT 0,
+			data TEXT NOT NULL DEFAULT '',
+			search TSVECTOR
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		keys (
+			id SERIAL PRIMARY KEY,
+			domainid INTEGER REFERENCES domains(id),
+			key TEXT,
+			lastused TIMESTAMPTZ
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		blobs (
+			id TEXT NOT NULL PRIMARY KEY,
+			name TEXT,
+			data BYTEA,
+			views INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		similar (
+			id SERIAL PRIMARY KEY,
+			fsid TEXT,
+			fsid_similar TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		cached_images (
+			id TEXT NOT NULL PRIMARY KEY,
+			name TEXT,
+			data BYTEA,
+			views INTEGER DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS fsslugs ON fs(slug,domainid);`,
+		`CREATE INDEX IF NOT EXISTS fssearch ON fs USING GIN(search);`,
+		`CREATE INDEX IF NOT EXISTS keyskey ON keys(key);`,
+		`CREATE INDEX IF NOT EXISTS similarid ON similar(fsid);`,
+	)
+}
+
+func migratePostgresTrash(tx *sql.Tx) error {
+	err := execAll(tx, `ALTER TABLE fs ADD COLUMN IF NOT EXISTS deleted TIMESTAMPTZ;`)
+	if err != nil {
+		return err
+	}
+	return trashEmptiedPages(tx, `SELECT id, history FROM fs WHERE data = ''`, bindPostgres)
+}
+
+func migratePostgresRevisions(tx *sql.Tx) error {
+	err := execAll(tx, `CREATE TABLE IF NOT EXISTS
+		revisions (
+			id TEXT NOT NULL,
+			ts BIGINT NOT NULL,
+			delta TEXT NOT NULL,
+			PRIMARY KEY (id, ts)
+		);`)
+	if err != nil {
+		return err
+	}
+	err = moveHistories(tx, bindPostgres)
+	if err != nil {
+		return err
+	}
+	return execAll(tx, `ALTER TABLE fs DROP COLUMN history;`)
+}
+
+func migratePostgresTokens(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS
+		tokens (
+			id SERIAL PRIMARY KEY,
+			domainid INTEGER NOT NULL REFERENCES domains(id),
+			name TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			scope TEXT NOT NULL,
+			created TIMESTAMPTZ,
+			expires TIMESTAMPTZ,
+			lastused TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS tokensdomain ON tokens(domainid);`,
+	)
+}
+
+func migratePostgresUsers(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS
+		users (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			hashed_pass TEXT NOT NULL,
+			created TIMESTAMPTZ
+		);`,
+		`CREATE TABLE IF NOT EXISTS
+		memberships (
+			domainid INTEGER NOT NULL REFERENCES domains(id),
+			userid INTEGER NOT NULL REFERENCES users(id),
+			role TEXT NOT NULL,
+			PRIMARY KEY (domainid, userid)
+		);`,
+		`ALTER TABLE keys ADD COLUMN IF NOT EXISTS userid INTEGER REFERENCES users(id);`,
+	)
+}
+
+func migratePostgresReaderPasswords(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS reader_pass TEXT;`,
+		`ALTER TABLE keys ADD COLUMN IF NOT EXISTS role TEXT;`,
+	)
+}
+
+func migratePostgresShares(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS
+		shares (
+			id SERIAL PRIMARY KEY,
+			domainid INTEGER NOT NULL REFERENCES domains(id),
+			fileid TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			created TIMESTAMPTZ,
+			expires TIMESTAMPTZ,
+			maxviews INTEGER NOT NULL DEFAULT 0,
+			views INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS sharesfile ON shares(fileid);`,
+	)
+}
+
+func migratePostgresTwoFactor(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS totp_secret TEXT;`,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS totp_step BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS recovery_codes TEXT;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_step BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS recovery_codes TEXT;`,
+	)
+}
+
+func migratePostgresAudit(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS
+		audit (
+			id SERIAL PRIMARY KEY,
+			created TIMESTAMPTZ NOT NULL,
+			domain TEXT NOT NULL,
+			action TEXT NOT NULL,
+			page TEXT NOT NULL DEFAULT '',
+			username TEXT NOT NULL DEFAULT '',
+			session TEXT NOT NULL DEFAULT '',
+			remote TEXT NOT NULL DEFAULT '',
+			detail TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS auditdomain ON audit(domain, created);`,
+		`CREATE OR REPLACE FUNCTION auditappendonly() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'the audit log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;`,
+		`DROP TRIGGER IF EXISTS auditappendonly ON audit;`,
+		`CREATE TRIGGER auditappendonly BEFORE UPDATE OR DELETE ON audit
+			FOR EACH ROW EXECUTE PROCEDURE auditappendonly();`,
+	)
+}
+
+func migratePostgresKeysCreated(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE keys ADD COLUMN IF NOT EXISTS created TIMESTAMPTZ;`,
+		`UPDATE keys SET created = lastused WHERE created IS NULL;`,
+	)
+}
+
+// postgresSearch is the search column of a page from its slug and data, with
+// the slug weighted A and the data B.
+const postgresSearch = `setweight(to_tsvector('simple', %s), 'A') || setweight(to_tsvector('simple', %s), 'B')`
+
+func migratePostgresSearchRanking(tx *sql.Tx) error {
+	return execAll(tx,
+		`UPDATE fs SET search = `+fmt.Sprintf(postgresSearch, `CASE WHEN data = '' THEN '' ELSE COALESCE(slug, '') END`, `data`)+`;`,
+	)
+}
+
+// postgresFileColumns are the columns scanned by getFiles, with fs aliased as
+// f and domains as d.
+const postgresFileColumns = `f.id,f.slug,f.created,f.modified,f.data,f.views,d.name`
+
+func (pg *Postgres) getFiles(query string, args ...interface{}) (files []File, err error) {
+	rows, err := pg.DB.Query(bindPostgres(query), args...)
+	if err != nil {
+		err = errors.Wrap(err, query)
+		return
+	}
+	defer rows.Close()
+	files = []File{}
+	for rows.Next() {
+		var f File
+		err = rows.Scan(&f.ID, &f.Slug, &f.Created, &f.Modified, &f.Data, &f.Views, &f.Domain)
+		if err != nil {
+			err = errors.Wrap(err, "get rows of file")
+			return
+		}
+		f.DataHTML = template.HTML(f.Data)
+		files = append(files, f)
+	}
+	err = rows.Err()
+	return
+}
+
+func orderBy(created []bool) string {
+	if len(created) > 0 && created[0] {
+		return " ORDER BY f.created DESC"
+	}
+	return " ORDER BY f.modified DESC"
+}
+
+// Save a file, adding the change to its history as a new revision. The row is
+// locked while doing so, so concurrent saves from other instances are not lost.
+func (pg *Postgres) Save(f File) (err error) {
+	if f.Domain == "" {
+		f.Domain = "public"
+	}
+	domainid, _, _, err := pg.GetDomainFromName(f.Domain)
+	if err != nil {
+		return errors.New("domain does not exist")
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		var inserted bool
+		inserted, err = pg.save(f, domainid)
+		if err != nil || inserted {
+			return
+		}
+	}
+	return errors.New("could not save, too much contention")
+}
+
+// save returns inserted false if the row appeared between checking for it
+// and inserting it, in which case it should be tried again.
+func (pg *Postgres) save(f File, domainid int) (inserted bool, err error) {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "begin Save")
+	}
+	defer tx.Rollback()
+
+	var previous string
+	var owner int
+	err = tx.QueryRow(`SELECT data, domainid FROM fs WHERE id = $1 FOR UPDATE`, f.ID).Scan(&previous, &owner)
+	if err != nil && err != sql.ErrNoRows {
+		return false, errors.Wrap(err, "get data")
+	}
+	exists := err == nil
+	if exists && owner != domainid {
+		return false, errors.New("page belongs to another domain")
+	}
+
+	hadContent, err := addRevision(tx, bindPostgres, f.ID, previous, f.Data)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		_, err = tx.Exec(`UPDATE fs SET slug = $1, modified = $2, data = $3,
+			search = `+fmt.Sprintf(postgresSearch, `$6::text`, `$3::text`)+`,
+			deleted = CASE WHEN $5::timestamptz IS NULL THEN NULL ELSE COALESCE(deleted, $5) END
+			WHERE id = $4`,
+			f.Slug, time.Now().UTC(), f.Data, f.ID, trashed(f.Data, hadContent), searchSlug(f))
+		if err != nil {
+			return false, errors.Wrap(err, "exec update")
+		}
+	} else {
+		var res sql.Result
+		res, err = tx.Exec(`INSERT INTO fs (id, domainid, slug, created, modified, data, search, deleted)
+			VALUES ($1, $2, $3, $4, $5, $6, `+fmt.Sprintf(postgresSearch, `$8::text`, `$6::text`)+`, $7) ON CONFLICT (id) DO NOTHING`,
+			f.ID, domainid, f.Slug, f.Created, time.Now().UTC(), f.Data, trashed(f.Data, hadContent), searchSlug(f))
+		if err != nil {
+			return false, errors.Wrap(err, "exec insert")
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return false, nil
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, errors.Wrap(err, "commit Save")
+	}
+	return true, nil
+}
+
+// Get returns the file with the id, or the files in the domain with the slug.
+func (pg *Postgres) Get(id string, domain string) (files []File, err error) {
+	files, err = pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE f.id = ?`, id)
+	if err == nil && len(files) == 0 {
+		files, err = pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+			INNER JOIN domains d ON f.domainid = d.id
+			WHERE f.slug = ? AND d.name = ?
+			ORDER BY f.modified DESC`, id, domain)
+		if err == nil && len(files) == 0 {
+			err = errors.New("no files with that slug or id")
+		}
+	}
+	if err != nil {
+		return
+	}
+	err = loadHistories(pg.DB, bindPostgres, files)
+	return
+}
+
+// GetAll returns all the files for a given domain
+func (pg *Postgres) GetAll(domain string, created ...bool) (files []File, err error) {
+	return pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE d.name = ? AND LENGTH(f.data) > 0`+orderBy(created), domain)
+}
+
+// GetTopX returns the most recent files in a domain
+func (pg *Postgres) GetTopX(domain string, num int, created ...bool) (files []File, err error) {
+	return pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE d.name = ? AND LENGTH(f.data) > 0`+orderBy(created)+` LIMIT ?`, domain, num)
+}
+
+// GetTopXMostViews returns the most viewed files in a domain
+func (pg *Postgres) GetTopXMostViews(domain string, num int) (files []File, err error) {
+	return pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE d.name = ? AND LENGTH(f.data) > 0
+		ORDER BY f.views DESC LIMIT ?`, domain, num)
+}
+
+// Find returns the files in the domain matching the search, best match
+// first, with a snippet of each. See parseSearch for what can be searched.
+func (pg *Postgres) Find(text string, domain string) (files []File, err error) {
+	q, err := parseSearch(text)
+	if err != nil {
+		return
+	}
+	where, filterArgs := q.where(searchColumns{
+		created:  "f.created",
+		modified: "f.modified",
+		data:     "f.data",
+		exclude: func(t searchTerm) (string, interface{}) {
+			return "NOT f.search @@ to_tsquery('simple', ?)", tsQuery([][]searchTerm{{t}})
+		},
+	})
+
+	// without words only the filters are left
+	args := []interface{}{domain}
+	query := `SELECT ` + postgresFileColumns + `,0 FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE d.name = ? AND LENGTH(f.data) > 0` + where + `
+		ORDER BY f.modified DESC`
+	if len(q.clauses) > 0 {
+		options := "StartSel=" + snippetStart + ", StopSel=" + snippetStop + ", MaxWords=30, MinWords=15, MaxFragments=1, FragmentDelimiter=..."
+		args = []interface{}{options, tsQuery(q.clauses), domain}
+		// the weights of D, C, B and A, making a match in the slug count
+		// ten times as much as one in the data
+		query = `SELECT f.id,f.slug,f.created,f.modified,
+		ts_headline('simple', f.data, q, ?),
+		f.views,d.name,ts_rank('{0, 0, 0.1, 1}', f.search, q)
+		FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id,
+		to_tsquery('simple', ?) q
+		WHERE f.search @@ q AND d.name = ?` + where + `
+		ORDER BY 8 DESC, f.modified DESC`
+	}
+	rows, err := pg.DB.Query(bindPostgres(query), append(args, filterArgs...)...)
+	if err != nil {
+		err = errors.Wrap(err, "Find")
+		return
+	}
+	defer rows.Close()
+	files = []File{}
+	for rows.Next() {
+		var f File
+		err = rows.Scan(&f.ID, &f.Slug, &f.Created, &f.Modified, &f.Data, &f.Views, &f.Domain, &f.Rank)
+		if err != nil {
+			err = errors.Wrap(err, "get rows of file")
+			return
+		}
+		if len(q.clauses) == 0 {
+			f.Data = snippet(f.Data, tokenize(f.Data), nil)
+		}
+		f.Data, f.DataHTML = highlight(f.Data)
+		files = append(files, f)
+	}
+	err = rows.Err()
+	return
+}
+
+// Exists returns whether specified id or slug exists
+func (pg *Postgres) Exists(id string, domain string) (trueID string, many bool, err error) {
+	ids, err := pg.getStrings(`SELECT f.id FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE f.id = ? AND d.name = ?`, id, domain)
+	if err != nil {
+		return
+	}
+	if len(ids) == 0 {
+		ids, err = pg.getStrings(`SELECT f.id FROM fs f
+			INNER JOIN domains d ON f.domainid = d.id
+			WHERE f.slug = ? AND d.name = ?`, id, domain)
+		if err != nil {
+			return
+		}
+	}
+	if len(ids) > 0 {
+		trueID = ids[0]
+	}
+	many = len(ids) > 1
+	return
+}
+
+func (pg *Postgres) getStrings(query string, args ...interface{}) (s []string, err error) {
+	rows, err := pg.DB.Query(bindPostgres(query), args...)
+	if err != nil {
+		err = errors.Wrap(err, query)
+		return
+	}
+	defer rows.Close()
+	s = []string{}
+	for rows.Next() {
+		var stemp string
+		err = rows.Scan(&stemp)
+		if err != nil {
+			return
+		}
+		s = append(s, stemp)
+	}
+	err = rows.Err()
+	return
+}
+
+// UpdateViews increments the views of a file
+func (pg *Postgres) UpdateViews(f File) (err error) {
+	_, err = pg.exec(`UPDATE fs SET views = views + 1 WHERE id = ?`, f.ID)
+	return
+}
+
+// DeleteEmpty deletes the pages that have no content and never had any
+func (pg *Postgres) DeleteEmpty() (err error) {
+	_, err = pg.exec(`DELETE FROM fs WHERE data = '' AND deleted IS NULL`)
+	return
+}
+
+// GetTrash returns the pages in the trash of a domain, most recently emptied
+// first
+func (pg *Postgres) GetTrash(domain string) (files []File, err error) {
+	files, err = pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE d.name = ? AND f.deleted IS NOT NULL
+		ORDER BY f.deleted DESC`, domain)
+	if err != nil {
+		return
+	}
+	err = loadHistories(pg.DB, bindPostgres, files)
+	return
+}
+
+// PurgeTrash deletes the pages that were moved to the trash before the time
+func (pg *Postgres) PurgeTrash(before time.Time) (err error) {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin PurgeTrash")
+	}
+	defer tx.Rollback()
+	// lock the pages so that one restored by another instance meanwhile
+	// keeps its history and shares, or is purged with them
+	rows, err := tx.Query(`SELECT id FROM fs WHERE deleted < $1 FOR UPDATE`, before.UTC())
+	if err != nil {
+		return errors.Wrap(err, "query PurgeTrash")
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scan PurgeTrash")
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return errors.Wrap(err, "query PurgeTrash")
+	}
+	for _, id := range ids {
+		for _, query := range []string{
+			`DELETE FROM revisions WHERE id = $1`,
+			`DELETE FROM shares WHERE fileid = $1`,
+			`DELETE FROM fs WHERE id = $1`,
+		} {
+			_, err = tx.Exec(query, id)
+			if err != nil {
+				return errors.Wrap(err, "exec PurgeTrash")
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "commit PurgeTrash")
+	}
+	return
+}
+
+// Compact thins out the history of every page that is not in the trash. Each
+// page is compacted in its own transaction, with its row locked so that
+// saves from other instances are not lost.
+func (pg *Postgres) Compact(now time.Time) (pages, revisions int, err error) {
+	ids, err := historiesToCompact(pg.DB, now)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		var removed int
+		removed, err = pg.compact(id, now)
+		if err != nil {
+			err = errors.Wrap(err, "compacting "+id)
+			return
+		}
+		if removed > 0 {
+			pages++
+			revisions += removed
+		}
+	}
+	return
+}
+
+func (pg *Postgres) compact(id string, now time.Time) (removed int, err error) {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "begin Compact")
+	}
+	defer tx.Rollback()
+	removed, err = compactPage(tx, `SELECT id FROM fs WHERE id = $1 FOR UPDATE`, bindPostgres, id, now)
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "commit Compact")
+	}
+	return
+}
+
+// GetSimilar returns the files similar to the file
+func (pg *Postgres) GetSimilar(fileid string) (files []File, err error) {
+	return pg.getFiles(`SELECT `+postgresFileColumns+` FROM fs f
+		INNER JOIN domains d ON f.domainid = d.id
+		WHERE f.id IN (SELECT fsid_similar FROM similar WHERE fsid = ?)
+		ORDER BY f.modified DESC`, fileid)
+}
+
+// SetSimilar replaces the files similar to the file
+func (pg *Postgres) SetSimilar(id string, similarids []string) (err error) {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin setsimilar")
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM similar WHERE fsid = $1`, id)
+	if err != nil {
+		return
+	}
+	for _, similarid := range similarids {
+		_, err = tx.Exec(`INSERT INTO similar (fsid, fsid_similar) VALUES ($1, $2)`, id, similarid)
+		if err != nil {
+			return errors.Wrap(err, "exec setsimilar")
+		}
+	}
+	return tx.Commit()
+}
+
+// LastModified get the last modified time
+func (pg *Postgres) LastModified() (lastModified time.Time, err error) {
+	var t sql.NullTime
+	err = pg.queryRow(`SELECT MAX(modified) FROM fs`).Scan(&t)
+	lastModified = t.Time
+	return
+}
+
+// GetDomains will return a list of domains
+func (pg *Postgres) GetDomains() ([]string, error) {
+	return pg.getStrings(`SELECT name FROM domains ORDER BY name`)
+}
+
+// GetDomainFromName returns the domain id, throwing an error if it doesn't exist
+func (pg *Postgres) GetDomainFromName(domain string) (domainid int, ispublic bool, options DomainOptions, err error) {
+	domain = strings.ToLower(domain)
+	domainid, _, ispublic, options, err = pg.getDomainFromName(domain)
+	if err == sql.ErrNoRows {
+		err = errors.New("domain " + domain + " does not exist")
+	}
+	return
+}
+
+func (pg *Postgres) getDomainFromName(domain string) (domainid int, hashedPassword string, ispublic bool, options DomainOptions, err error) {
+	var ispublicint sql.NullInt64
+	var b sql.NullString
+	err = pg.queryRow(`SELECT id,hashed_pass,ispublic,options FROM domains WHERE name = ?`, domain).
+		Scan(&domainid, &hashedPassword, &ispublicint, &b)
+	if err != nil {
+		return
+	}
+	ispublic = ispublicint.Int64 == 1
+	json.Unmarshal([]byte(b.String), &options)
+	return
+}
+
+// SetDomain creates a domain, throws an error if it already exists
+func (pg *Postgres) SetDomain(domain, password string) (err error) {
+	if err = checkNewDomain(domain); err != nil {
+		return
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	res, err := pg.exec(`INSERT INTO domains (name, hashed_pass, ispublic) VALUES (?,?,0)
+		ON CONFLICT (name) DO NOTHING`, strings.ToLower(domain), hashedPassword)
+	if err != nil {
+		return errors.Wrap(err, "exec Save")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("domain already exists")
+	}
+	return
+}
+
+// UpdateDomain changes the settings, and the password if given, of a domain
+func (pg *Postgres) UpdateDomain(domain, password string, ispublic bool, options DomainOptions) (err error) {
+	isPublicValue := 0
+	if ispublic {
+		isPublicValue = 1
+	}
+	bOptions, _ := json.Marshal(options)
+	var res sql.Result
+	if password == "" {
+		res, err = pg.exec(`UPDATE domains SET ispublic = ?, options = ? WHERE name = ?`,
+			isPublicValue, string(bOptions), strings.ToLower(domain))
+	} else {
+		return pg.updateDomainPassword(domain, password, isPublicValue, bOptions)
+	}
+	if err != nil {
+		return errors.Wrap(err, "exec Save")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("domain does not exist")
+	}
+	return
+}
+
+// updateDomainPassword changes the password along with the options, and
+// signs out whoever knew the old password.
+func (pg *Postgres) updateDomainPassword(domain, password string, isPublicValue int, bOptions []byte) (err error) {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin UpdateDomain")
+	}
+	defer tx.Rollback()
+	var domainid int
+	err = tx.QueryRow(bindPostgres(`UPDATE domains SET hashed_pass = ?, ispublic = ?, options = ? WHERE name = ? RETURNING id`),
+		hashedPassword, isPublicValue, string(bOptions), strings.ToLower(domain)).Scan(&domainid)
+	if err == sql.ErrNoRows {
+		return errors.New("domain does not exist")
+	} else if err != nil {
+		return errors.Wrap(err, "exec Save")
+	}
+	if err = deleteSessions(tx, bindPostgres, domainid); err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit UpdateDomain")
+}
+
+// ValidateDomain returns the domain id or an error if the password doesn't match or if the domain doesn't exist
+func (pg *Postgres) ValidateDomain(domain, password string) (domainid int, options DomainOptions, err error) {
+	domain = strings.ToLower(domain)
+	domainid, hashedPassword, _, options, err := pg.getDomainFromName(domain)
+	if err == sql.ErrNoRows {
+		err = errors.New("domain " + domain + " does not exist")
+		return
+	}
+	if err != nil {
+		return
+	}
+	if utils.CheckPasswordHash(hashedPassword, password) != nil {
+		err = errors.New("incorrect password to log into domain")
+	}
+	return
+}
+
+// checkDomainPassword returns the domain id and the role to sign in with if
+// the password, or the reader password, of the domain is correct.
+func (pg *Postgres) checkDomainPassword(domain, password string) (domainid int, role sql.NullString, err error) {
+	domainid, options, err := pg.ValidateDomain(domain, password)
+	if err != nil && domainid != 0 && checkReaderPassword(pg.DB, bindPostgres, domainid, password) {
+		err = nil
+		role = sql.NullString{String: string(RoleReader), Valid: true}
+	}
+	if err != nil {
+		return
+	}
+	if options.NoSharedPassword {
+		err = errors.New("domain does not allow the shared password")
+	}
+	return
+}
+
+// CheckPassword checks the password of the user, or of the domain if user is
+// empty, without giving out a key.
+func (pg *Postgres) CheckPassword(domain, user, password string) (err error) {
+	if user != "" {
+		_, _, err = validateUser(pg.DB, bindPostgres, domain, user, password)
+		return
+	}
+	_, _, err = pg.checkDomainPassword(domain, password)
+	return
+}
+
+// SetKey returns a new key for the domain
+func (pg *Postgres) SetKey(domain, password string) (key string, err error) {
+	domainid, role, err := pg.checkDomainPassword(domain, password)
+	if err != nil {
+		return
+	}
+	key, hash, err := newKey()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	_, err = pg.exec(`INSERT INTO keys (domainid, key, created, lastused, role) VALUES (?,?,?,?,?)`, domainid, hash, now, now, role)
+	return
+}
+
+// CheckKey checks that it is a valid key for a domain
+func (pg *Postgres) CheckKey(key string) (domainid int, domain string, err error) {
+	k, err := pg.GetKey(key)
+	return k.DomainID, k.Domain, err
+}
+
+// GetKey returns the session with the key.
+func (pg *Postgres) GetKey(key string) (k Key, err error) {
+	return getKey(pg.DB, bindPostgres, key)
+}
+
+// UpdateKeys will update their last use
+func (pg *Postgres) UpdateKeys(keys []string) (err error) {
+	for _, key := range keys {
+		_, err = pg.exec(`UPDATE keys SET lastused = ? WHERE key = ?`, time.Now().UTC(), hashKey(key))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DeleteKey deletes a specific key
+func (pg *Postgres) DeleteKey(key string) (err error) {
+	_, err = pg.exec(`DELETE FROM keys WHERE key = ?`, hashKey(key))
+	return
+}
+
+// DeleteOldKeys deletes keys older than 5 days
+func (pg *Postgres) DeleteOldKeys() (err error) {
+	_, err = pg.exec(`DELETE FROM keys WHERE lastused <= NOW() - INTERVAL '5 days'`)
+	return
+}
+
+// SaveBlob will save a blob
+func (pg *Postgres) SaveBlob(id string, name string, blob []byte) (err error) {
+	_, err = pg.exec(`INSERT INTO blobs (id, name, data) VALUES (?,?,?)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, data = EXCLUDED.data`, id, name, blob)
+	return
+}
+
+// GetBlob returns a blob and counts the view
+func (pg *Postgres) GetBlob(id string) (name string, data []byte, views int, err error) {
+	err = pg.queryRow(`UPDATE blobs SET views = views + 1 WHERE id = ?
+		RETURNING name, data, views - 1`, id).Scan(&name, &data, &views)
+	return
+}
+
+// GetBlobIDs will return a list of blob ids
+func (pg *Postgres) GetBlobIDs() ([]string, error) {
+	return pg.getStrings(`SELECT id FROM blobs ORDER BY id`)
+}
+
+// SaveResizedImage will save a resized image
+func (pg *Postgres) SaveResizedImage(id string, name string, blob []byte) (err error) {
+	_, err = pg.exec(`INSERT INTO cached_images (id, name, data) VALUES (?,?,?)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, data = EXCLUDED.data`, id, name, blob)
+	return
+}
+
+// GetResizedImage returns a resized image, or sql.ErrNoRows if there is none
+func (pg *Postgres) GetResizedImage(id string) (name string, data []byte, views int, err error) {
+	err = pg.queryRow(`UPDATE cached_images SET views = views + 1 WHERE id = ?
+		RETURNING name, data, views - 1`, id).Scan(&name, &data, &views)
+	return
+}
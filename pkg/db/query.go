@@ -0,0 +1,293 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// QueryError is a search that can not be understood. Its message is meant
+// for the one who wrote the search.
+type QueryError struct {
+	Query  string
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return "can not search for '" + e.Query + "': " + e.Reason
+}
+
+// searchTerm is a word, or a phrase of words in a row, that a page must
+// contain to match a search. If prefix is set the last word also matches
+// longer words starting with it, and if slug is set it only matches the
+// slug.
+type searchTerm struct {
+	words  []string
+	prefix bool
+	slug   bool
+}
+
+// searchFilter compares the time a page was created or modified with a
+// day, or checks that the page has an upload.
+type searchFilter struct {
+	field  string // created, modified or has
+	op     byte   // <, > or =
+	day    time.Time
+	negate bool
+}
+
+// searchQuery is a parsed search. A page matches if it matches at least one
+// term of every clause, none of the excluded terms and all the filters.
+type searchQuery struct {
+	clauses  [][]searchTerm
+	excluded []searchTerm
+	filters  []searchFilter
+}
+
+// terms returns the terms of all the clauses.
+func (q searchQuery) terms() (terms []searchTerm) {
+	for _, clause := range q.clauses {
+		terms = append(terms, clause...)
+	}
+	return
+}
+
+// parseSearch parses a search of words, "quoted phrases" and prefixes*, which
+// a page must all contain unless they are joined by OR. A term starting with
+// - must not be in the page. Besides those,
+//
+//	slug:word             matches only the slug
+//	created:>2026-01-01   created after the day, < before it, or on it without either
+//	modified:<2026-01-01  likewise for the last change
+//	has:upload            links to an upload
+//
+// and any of these can also start with -. Anything that is not a letter or a
+// digit is left out of words, so no syntax of the full-text query languages
+// gets through.
+func parseSearch(text string) (q searchQuery, err error) {
+	fail := func(format string, a ...interface{}) (searchQuery, error) {
+		return searchQuery{}, &QueryError{Query: text, Reason: fmt.Sprintf(format, a...)}
+	}
+	// or is set after an OR, and afterTerm after a term that can take one
+	or, afterTerm := false, false
+	s := text
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			break
+		}
+		negate := strings.HasPrefix(s, "-")
+		s = strings.TrimPrefix(s, "-")
+		field := ""
+		if i := strings.IndexFunc(s, func(r rune) bool { return r == ':' || r == '"' || unicode.IsSpace(r) }); i > 0 && s[i] == ':' {
+			switch name := strings.ToLower(s[:i]); name {
+			case "slug", "created", "modified", "has":
+				field = name
+				s = s[i+1:]
+			}
+		}
+		var value string
+		quoted := strings.HasPrefix(s, `"`)
+		if quoted {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				return fail("a quote is not closed")
+			}
+			value, s = s[1:end+1], s[end+2:]
+			if strings.HasPrefix(s, "*") {
+				value, s = value+"*", s[1:]
+			}
+		} else {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+
+		if !quoted && !negate && field == "" {
+			switch value {
+			case "OR":
+				if !afterTerm || or {
+					return fail("OR needs a word on both sides")
+				}
+				or = true
+				continue
+			case "AND":
+				continue
+			}
+		}
+
+		switch field {
+		case "", "slug":
+			t := searchTerm{words: searchWords(value), prefix: strings.HasSuffix(value, "*"), slug: field == "slug"}
+			if len(t.words) == 0 {
+				if field != "" {
+					return fail("%s: needs a word", field)
+				}
+				continue
+			}
+			switch {
+			case negate && or:
+				return fail("OR can not be used with -%s", value)
+			case negate:
+				q.excluded = append(q.excluded, t)
+				afterTerm = false
+			case or:
+				q.clauses[len(q.clauses)-1] = append(q.clauses[len(q.clauses)-1], t)
+				or = false
+			default:
+				q.clauses = append(q.clauses, []searchTerm{t})
+				afterTerm = true
+			}
+			continue
+		case "created", "modified":
+			f := searchFilter{field: field, op: '=', negate: negate}
+			if value != "" && (value[0] == '<' || value[0] == '>') {
+				f.op, value = value[0], value[1:]
+			}
+			f.day, err = time.Parse("2006-01-02", value)
+			if err != nil {
+				return fail("%s: needs a day like %s:>2026-01-01", field, field)
+			}
+			q.filters = append(q.filters, f)
+		case "has":
+			if v := strings.ToLower(value); v != "upload" && v != "uploads" {
+				return fail("has: can only be has:upload")
+			}
+			q.filters = append(q.filters, searchFilter{field: field, negate: negate})
+		}
+		if or {
+			return fail("OR can not be used with %s:", field)
+		}
+		afterTerm = false
+	}
+	if or {
+		return fail("OR needs a word on both sides")
+	}
+	if len(q.clauses) == 0 && len(q.excluded) == 0 && len(q.filters) == 0 {
+		return fail("there is nothing to search for")
+	}
+	return
+}
+
+// ftsQuery returns the clauses as a query for MATCH on the fts table. Words
+// only have letters and digits, and are lowercase or quoted, so none is taken
+// as an operator.
+func ftsQuery(clauses [][]searchTerm) string {
+	parts := make([]string, len(clauses))
+	for i, clause := range clauses {
+		phrases := make([]string, len(clause))
+		for j, t := range clause {
+			phrases[j] = ftsPhrase(t)
+		}
+		parts[i] = strings.Join(phrases, " OR ")
+		if len(phrases) > 1 {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// ftsPhrase returns a term as a phrase of the query for MATCH.
+func ftsPhrase(t searchTerm) string {
+	switch {
+	case t.slug:
+		return "slug:" + ftsPhrase(searchTerm{words: t.words, prefix: t.prefix})
+	case t.prefix:
+		return `"` + strings.Join(t.words, " ") + `"*`
+	}
+	return `"` + strings.Join(t.words, " ") + `"`
+}
+
+// tsQuery returns the clauses as a query for to_tsquery of PostgreSQL, where
+// the slug of a page is weighted A.
+func tsQuery(clauses [][]searchTerm) string {
+	parts := make([]string, len(clauses))
+	for i, clause := range clauses {
+		phrases := make([]string, len(clause))
+		for j, t := range clause {
+			words := make([]string, len(t.words))
+			for k, word := range t.words {
+				words[k] = "'" + word + "'"
+				if t.prefix && k == len(t.words)-1 {
+					words[k] += ":*"
+					if t.slug {
+						words[k] += "A"
+					}
+				} else if t.slug {
+					words[k] += ":A"
+				}
+			}
+			phrases[j] = strings.Join(words, " <-> ")
+		}
+		parts[i] = strings.Join(phrases, " | ")
+		if len(phrases) > 1 {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " & ")
+}
+
+// searchColumns are what the SQL of a store compares the filters of a search
+// with, and how it leaves out the pages with a term.
+type searchColumns struct {
+	created, modified, data string
+	exclude                 func(t searchTerm) (predicate string, arg interface{})
+}
+
+// where returns the exclusions and filters of the search as SQL to add to a
+// WHERE clause, with its arguments.
+func (q searchQuery) where(c searchColumns) (where string, args []interface{}) {
+	for _, t := range q.excluded {
+		predicate, arg := c.exclude(t)
+		where += " AND " + predicate
+		args = append(args, arg)
+	}
+	for _, f := range q.filters {
+		var predicate string
+		column := c.created
+		if f.field == "modified" {
+			column = c.modified
+		}
+		next := f.day.AddDate(0, 0, 1)
+		switch {
+		case f.field == "has":
+			predicate = c.data + ` LIKE '%/uploads/%'`
+		case f.op == '>':
+			predicate = column + " >= ?"
+			args = append(args, next)
+		case f.op == '<':
+			predicate = column + " < ?"
+			args = append(args, f.day)
+		default:
+			predicate = column + " >= ? AND " + column + " < ?"
+			args = append(args, f.day, next)
+		}
+		if f.negate {
+			predicate = "NOT (" + predicate + ")"
+		}
+		where += " AND " + predicate
+	}
+	return
+}
+
+// matches returns whether f passes the filter.
+func (f searchFilter) matches(file File) (ok bool) {
+	t := file.Created
+	if f.field == "modified" {
+		t = file.Modified
+	}
+	switch {
+	case f.field == "has":
+		ok = strings.Contains(file.Data, "/uploads/")
+	case f.op == '>':
+		ok = !t.Before(f.day.AddDate(0, 0, 1))
+	case f.op == '<':
+		ok = t.Before(f.day)
+	default:
+		ok = !t.Before(f.day) && t.Before(f.day.AddDate(0, 0, 1))
+	}
+	return ok != f.negate
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindQuery(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testFindQuery(t, s)
+		})
+	}
+}
+
+func testFindQuery(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("work", "secret"))
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, f := range []File{
+		{ID: "milk", Slug: "groceries", Data: "buy milk and bread"},
+		{ID: "bread", Slug: "bakery", Data: "bread, the sourdough kind"},
+		{ID: "photo", Slug: "holiday", Data: "the beach ![beach](/uploads/abc123) and bread crumbs"},
+		{ID: "old", Slug: "milk-prices", Data: "prices of milk", Created: time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)},
+	} {
+		f.Domain = "work"
+		if f.Created.IsZero() {
+			f.Created = time.Now().UTC()
+		}
+		assert.Nil(t, s.Save(f))
+	}
+	find := func(text string) (ids []string) {
+		files, err := s.Find(text, "work")
+		assert.Nil(t, err, text)
+		for _, f := range files {
+			ids = append(ids, f.ID)
+		}
+		return
+	}
+
+	assert.ElementsMatch(t, []string{"milk", "bread", "photo"}, find("bread"))
+	assert.ElementsMatch(t, []string{"bread", "photo"}, find("bread -milk"))
+	assert.ElementsMatch(t, []string{"bread"}, find(`bread -milk -"bread crumbs"`))
+	assert.ElementsMatch(t, []string{"milk", "old", "photo"}, find("milk OR beach"))
+	assert.ElementsMatch(t, []string{"milk", "photo"}, find("milk OR beach bread"))
+	assert.ElementsMatch(t, []string{"milk"}, find("milk AND bread"))
+
+	// slug: only looks at the slug
+	assert.Equal(t, []string{"old"}, find("slug:milk"))
+	assert.Equal(t, []string{"old"}, find("slug:mil*"))
+	assert.Equal(t, []string{"old"}, find(`slug:"milk prices"`))
+	assert.Equal(t, []string{"milk"}, find("milk -slug:milk"))
+	assert.ElementsMatch(t, []string{"bread", "old"}, find("slug:bakery OR slug:milk"))
+
+	// filters, with and without words
+	assert.Equal(t, []string{"old"}, find("created:<2020-01-01"))
+	assert.Equal(t, []string{"old"}, find("milk created:2019-03-01"))
+	assert.Equal(t, []string{"milk"}, find("milk created:>2020-01-01"))
+	assert.Equal(t, []string{"milk"}, find("milk -created:<2020-01-01"))
+	assert.Empty(t, find("created:>"+today))
+	assert.Len(t, find("modified:"+today), 4)
+	assert.Empty(t, find("modified:<"+today))
+	assert.Equal(t, []string{"photo"}, find("has:upload"))
+	assert.Equal(t, []string{"photo"}, find("bread has:upload"))
+	assert.ElementsMatch(t, []string{"milk", "bread"}, find("bread -has:upload"))
+	assert.Len(t, find("-nothing"), 4)
+
+	files, err := s.Find("has:upload", "work")
+	assert.Nil(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Contains(t, files[0].Data, "the beach")
+		assert.Zero(t, files[0].Rank)
+	}
+
+	// invalid searches say why
+	for text, reason := range map[string]string{
+		`"milk`:                    "a quote is not closed",
+		`OR milk`:                  "OR needs a word on both sides",
+		`milk OR`:                  "OR needs a word on both sides",
+		`milk OR OR bread`:         "OR needs a word on both sides",
+		`milk OR -bread`:           "OR can not be used with -bread",
+		`milk OR has:upload`:       "OR can not be used with has:",
+		`created:>yesterday`:       "created: needs a day like created:>2026-01-01",
+		`modified:2026-13-01`:      "modified: needs a day like modified:>2026-01-01",
+		`has:image`:                "has: can only be has:upload",
+		`slug:`:                    "slug: needs a word",
+		`" " *`:                    "there is nothing to search for",
+		`created:<2026-01-01 OR a`: "OR needs a word on both sides",
+	} {
+		_, err := s.Find(text, "work")
+		if assert.IsType(t, &QueryError{}, err, text) {
+			assert.Equal(t, reason, err.(*QueryError).Reason, text)
+		}
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	q, err := parseSearch(`Milk "new  York" bre* e-mail "san fran"* OR slug:sf -"los angeles" -slug:la`)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]searchTerm{
+		{{words: []string{"milk"}}},
+		{{words: []string{"new", "york"}}},
+		{{words: []string{"bre"}, prefix: true}},
+		{{words: []string{"e", "mail"}}},
+		{{words: []string{"san", "fran"}, prefix: true}, {words: []string{"sf"}, slug: true}},
+	}, q.clauses)
+	assert.Equal(t, []searchTerm{{words: []string{"los", "angeles"}}, {words: []string{"la"}, slug: true}}, q.excluded)
+	assert.Empty(t, q.filters)
+
+	q, err = parseSearch(`milk OR "new york" bre* slug:sf*`)
+	assert.Nil(t, err)
+	assert.Equal(t, `("milk" OR "new york") AND "bre"* AND slug:"sf"*`, ftsQuery(q.clauses))
+	assert.Equal(t, `('milk' | 'new' <-> 'york') & 'bre':* & 'sf':*A`, tsQuery(q.clauses))
+
+	q, err = parseSearch(`created:>2026-01-01 -modified:<2026-02-01 has:upload`)
+	assert.Nil(t, err)
+	assert.Empty(t, q.clauses)
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []searchFilter{
+		{field: "created", op: '>', day: day},
+		{field: "modified", op: '<', day: day.AddDate(0, 1, 0), negate: true},
+		{field: "has"},
+	}, q.filters)
+	where, args := q.where(searchColumns{created: "c", modified: "m", data: "d"})
+	assert.Equal(t, ` AND c >= ? AND NOT (m < ?) AND d LIKE '%/uploads/%'`, where)
+	assert.Equal(t, []interface{}{day.AddDate(0, 0, 1), day.AddDate(0, 1, 0)}, args)
+}
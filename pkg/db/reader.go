@@ -0,0 +1,112 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// checkReaderPassword returns whether password is the reader password of the
+// domain.
+func checkReaderPassword(db queryer, bind func(string) string, domainid int, password string) bool {
+	stmt, err := db.Prepare(bind(`SELECT reader_pass FROM domains WHERE id = ?`))
+	if err != nil {
+		return false
+	}
+	defer stmt.Close()
+	var hashedPassword sql.NullString
+	err = stmt.QueryRow(domainid).Scan(&hashedPassword)
+	return err == nil && hashedPassword.String != "" && utils.CheckPasswordHash(hashedPassword.String, password) == nil
+}
+
+// hashReaderPassword returns the hash to store for the reader password, or
+// NULL to remove it.
+func hashReaderPassword(password string) (hashedPassword sql.NullString, err error) {
+	if password == "" {
+		return
+	}
+	hashedPassword.String, err = utils.HashPassword(password)
+	if err != nil {
+		err = errors.Wrap(err, "can't hash password")
+	}
+	hashedPassword.Valid = err == nil
+	return
+}
+
+func setReaderPassword(tx *sql.Tx, bind func(string) string, domain string, hashedPassword sql.NullString) (err error) {
+	var domainid int
+	err = tx.QueryRow(bind(`SELECT id FROM domains WHERE name = ?`), strings.ToLower(domain)).Scan(&domainid)
+	if err == sql.ErrNoRows {
+		return errors.New("domain does not exist")
+	} else if err != nil {
+		return errors.Wrap(err, "get domain")
+	}
+	_, err = tx.Exec(bind(`UPDATE domains SET reader_pass = ? WHERE id = ?`), hashedPassword, domainid)
+	if err != nil {
+		return errors.Wrap(err, "update domain")
+	}
+	// sign out whoever used the old one
+	_, err = tx.Exec(bind(`DELETE FROM keys WHERE domainid = ? AND role = ?`), domainid, string(RoleReader))
+	return errors.Wrap(err, "delete keys")
+}
+
+// SetReaderPassword sets the read-only password of a domain.
+func (fs *FileSystem) SetReaderPassword(domain, password string) (err error) {
+	hashedPassword, err := hashReaderPassword(password)
+	if err != nil {
+		return
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin SetReaderPassword")
+	}
+	defer tx.Rollback()
+	err = setReaderPassword(tx, bindSQLite, domain, hashedPassword)
+	if err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit SetReaderPassword")
+}
+
+// SetReaderPassword sets the read-only password of a domain.
+func (pg *Postgres) SetReaderPassword(domain, password string) (err error) {
+	hashedPassword, err := hashReaderPassword(password)
+	if err != nil {
+		return
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin SetReaderPassword")
+	}
+	defer tx.Rollback()
+	err = setReaderPassword(tx, bindPostgres, domain, hashedPassword)
+	if err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit SetReaderPassword")
+}
+
+// SetReaderPassword sets the read-only password of a domain.
+func (m *Memory) SetReaderPassword(domain, password string) (err error) {
+	hashedPassword, err := hashReaderPassword(password)
+	if err != nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return errors.New("domain does not exist")
+	}
+	d.readerPassword = hashedPassword.String
+	for hash, k := range m.keys {
+		if k.domainid == d.id && k.role == RoleReader {
+			delete(m.keys, hash)
+		}
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderPassword(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testReaderPassword(t, s)
+		})
+	}
+}
+
+func testReaderPassword(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("client", "secret"))
+	assert.NotNil(t, s.SetReaderPassword("nodomain", "look"))
+	_, err := s.SetKey("client", "look")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, s.SetReaderPassword("client", "look"))
+	key, err := s.SetKey("client", "look")
+	assert.Nil(t, err)
+	k, err := s.GetKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", k.Domain)
+	assert.Equal(t, "", k.User)
+	assert.Equal(t, RoleReader, k.Role)
+	_, _, err = s.ValidateDomain("client", "look")
+	assert.NotNil(t, err, "the reader password can not change the domain")
+
+	admin, err := s.SetKey("client", "secret")
+	assert.Nil(t, err)
+	k, err = s.GetKey(admin)
+	assert.Nil(t, err)
+	assert.Equal(t, RoleAdmin, k.Role)
+
+	// changing or removing it signs out its readers, and only them
+	assert.Nil(t, s.SetReaderPassword("client", ""))
+	_, err = s.GetKey(key)
+	assert.NotNil(t, err)
+	_, err = s.GetKey(admin)
+	assert.Nil(t, err)
+	_, err = s.SetKey("client", "look")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ReservedDomains are the names of domains that rwtxt uses for paths of its
+// own, such as /s/{token} for share links and /api/ for the API, and which
+// would hide a domain with the name.
+var ReservedDomains = []string{"s", "api"}
+
+// ReservedSlugs are the slugs that rwtxt uses for pages of a domain, such as
+// /{domain}/trash, and which would hide a page with the slug.
+var ReservedSlugs = []string{"trash", "tokens", "members", "twofactor", "audit", "sessions"}
+
+// IsReservedDomain returns whether the name is taken by a path of rwtxt.
+func IsReservedDomain(domain string) bool {
+	return isReserved(ReservedDomains, domain)
+}
+
+// IsReservedSlug returns whether the slug is taken by a page of rwtxt.
+func IsReservedSlug(slug string) bool {
+	return isReserved(ReservedSlugs, slug)
+}
+
+func isReserved(names []string, name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, reserved := range names {
+		if name == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNewDomain validates the name of a domain to be created.
+func checkNewDomain(domain string) error {
+	if IsReservedDomain(domain) {
+		return fmt.Errorf("domain name %s is reserved", strings.ToLower(domain))
+	}
+	return nil
+}
+
+// FindReserved returns a line for each domain and page that was made before
+// its name was reserved, and which rwtxt now hides behind its own paths.
+// Pages in the trash are left out, as they are not reached by their slug.
+func FindReserved(s Store) (hidden []string, err error) {
+	domains, err := s.GetDomains()
+	if err != nil {
+		return nil, errors.Wrap(err, "get domains")
+	}
+	for _, domain := range domains {
+		if IsReservedDomain(domain) {
+			hidden = append(hidden, fmt.Sprintf("domain %s is hidden by the paths /%s/ of rwtxt", domain, domain))
+		}
+		var files []File
+		files, err = s.GetAll(domain)
+		if err != nil {
+			return nil, errors.Wrap(err, "get pages of "+domain)
+		}
+		for _, f := range files {
+			if IsReservedSlug(f.Slug) {
+				hidden = append(hidden, fmt.Sprintf("page %s of domain %s is hidden by /%s/%s, it is still at /%s/%s", f.ID, domain, domain, f.Slug, domain, f.ID))
+			}
+		}
+	}
+	return
+}
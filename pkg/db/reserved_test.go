@@ -0,0 +1,54 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserved(t *testing.T) {
+	assert.True(t, IsReservedDomain("S"))
+	assert.True(t, IsReservedDomain("api"))
+	assert.False(t, IsReservedDomain("notes"))
+	assert.True(t, IsReservedSlug("trash"))
+	assert.False(t, IsReservedSlug("trash-day"))
+	assert.False(t, IsReservedSlug("history"), "reached at /{domain}/{page}/history")
+
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testReserved(t, s)
+		})
+	}
+}
+
+func testReserved(t *testing.T, s Store) {
+	assert.NotNil(t, s.SetDomain("s", "secret"))
+	assert.NotNil(t, s.SetDomain("api", "secret"))
+	_, _, _, err := s.GetDomainFromName("s")
+	assert.NotNil(t, err, "reserved domains are not created")
+
+	assert.Nil(t, s.SetDomain("notes", "secret"))
+	assert.Nil(t, s.Save(File{ID: "page1", Slug: "groceries", Data: "milk", Domain: "notes"}))
+	hidden, err := FindReserved(s)
+	assert.Nil(t, err)
+	assert.Empty(t, hidden)
+
+	// those made before their names were reserved are reported
+	switch store := s.(type) {
+	case *FileSystem:
+		assert.Nil(t, store.setDomain("s", "secret"))
+	case *Memory:
+		assert.Nil(t, store.setDomain("s", "secret"))
+	case *Postgres:
+		_, err = store.exec(`INSERT INTO domains (name, hashed_pass, ispublic) VALUES ('s', '', 0)`)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, s.Save(File{ID: "page2", Slug: "trash", Data: "take out the trash", Domain: "notes"}))
+	assert.Nil(t, s.Save(File{ID: "page3", Slug: "audit", Data: "", Domain: "notes"}))
+	hidden, err = FindReserved(s)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"domain s is hidden by the paths /s/ of rwtxt",
+		"page page2 of domain notes is hidden by /notes/trash, it is still at /notes/page2",
+	}, hidden)
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+var (
+	dumpInsert        = regexp.MustCompile(`^INSERT INTO "([^"]+)"`)
+	dumpSchemaVersion = regexp.MustCompile(`^INSERT INTO "schema_version"\([^)]*\) VALUES\((\d+),`)
+)
+
+// Restore rebuilds the SQLite database name from a dump written by DumpSQL
+// and returns the number of rows restored in each table. The dump has no
+// tables, so they are created by migrating to the schema version recorded in
+// the dump before its rows are inserted, and the result is then migrated to
+// the latest version. The database is built next to name and only replaces it
+// once the row counts and the search index have been checked, so a failed
+// restore leaves name untouched. A database with pages, uploads or domains
+// other than public is only replaced if force is true. Nothing may have the
+// database open while it is restored.
+func Restore(name, from string, force bool) (rows map[string]int, err error) {
+	if !force {
+		var empty bool
+		empty, err = isEmpty(name)
+		if err != nil {
+			return
+		}
+		if !empty {
+			err = fmt.Errorf("%s is not empty, refusing to overwrite it", name)
+			return
+		}
+	}
+
+	statements, err := readDump(from)
+	if err != nil {
+		return
+	}
+
+	restored := name + ".restore"
+	removeDatabase(restored)
+	fs, err := Open(restored)
+	if err != nil {
+		return
+	}
+	defer removeDatabase(restored)
+	rows, err = fs.restore(statements)
+	fs.Close()
+	if err != nil {
+		return
+	}
+
+	err = removeDatabase(name)
+	if err != nil {
+		return
+	}
+	err = os.Rename(restored, name)
+	return
+}
+
+func (fs *FileSystem) restore(statements []string) (rows map[string]int, err error) {
+	// dumps written before the schema was versioned are at the initial schema
+	version := 1
+	for _, stmt := range statements {
+		if m := dumpSchemaVersion.FindStringSubmatch(stmt); m != nil {
+			v, _ := strconv.Atoi(m[1])
+			if v > version {
+				version = v
+			}
+		}
+	}
+	if version > LatestSchemaVersion() {
+		err = fmt.Errorf("dump is at schema version %d, newer than this build supports (%d)", version, LatestSchemaVersion())
+		return
+	}
+	_, err = fs.MigrateTo(version)
+	if err != nil {
+		return
+	}
+
+	rows, err = fs.insertDump(statements)
+	if err != nil {
+		return
+	}
+	for table, n := range rows {
+		var count int
+		err = fs.DB.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, table)).Scan(&count)
+		if err != nil {
+			err = errors.Wrap(err, "counting "+table)
+			return
+		}
+		if count != n {
+			err = fmt.Errorf("restored %d rows into %s, but the dump has %d", count, table, n)
+			return
+		}
+	}
+
+	_, err = fs.Migrate()
+	if err != nil {
+		return
+	}
+	problems, err := fs.Fsck(false)
+	if err != nil {
+		return
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			log.Warn(p)
+		}
+		err = fmt.Errorf("restored database has %d pages out of sync with the search index", len(problems))
+	}
+	return
+}
+
+// insertDump executes the rows, indexes and triggers of the dump in one
+// transaction.
+// The schema versions are left to the migrations, which record them.
+func (fs *FileSystem) insertDump(statements []string) (rows map[string]int, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "begin restore")
+	}
+	defer tx.Rollback()
+
+	rows = make(map[string]int)
+	for _, stmt := range statements {
+		switch {
+		case stmt == "BEGIN TRANSACTION" || stmt == "COMMIT":
+			continue
+		case strings.HasPrefix(stmt, "CREATE INDEX "):
+			stmt = "CREATE INDEX IF NOT EXISTS " + strings.TrimPrefix(stmt, "CREATE INDEX ")
+		case strings.HasPrefix(stmt, "CREATE TRIGGER "):
+			stmt = "CREATE TRIGGER IF NOT EXISTS " + strings.TrimPrefix(stmt, "CREATE TRIGGER ")
+		case strings.HasPrefix(stmt, `INSERT INTO "schema_version"`):
+			continue
+		}
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "restoring '%s'", truncate(stmt, 80))
+		}
+		if m := dumpInsert.FindStringSubmatch(stmt); m != nil {
+			rows[m[1]]++
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "commit restore")
+	}
+	return
+}
+
+// readDump returns the statements of a gzipped dump, without their
+// terminating semicolons. Statements end at a semicolon outside of a quoted
+// string or identifier, as text in the dump can span lines.
+func readDump(from string) (statements []string, err error) {
+	fi, err := os.Open(from)
+	if err != nil {
+		return
+	}
+	defer fi.Close()
+	fz, err := gzip.NewReader(fi)
+	if err != nil {
+		err = errors.Wrap(err, "reading "+from)
+		return
+	}
+	defer fz.Close()
+	b, err := ioutil.ReadAll(fz)
+	if err != nil {
+		err = errors.Wrap(err, "reading "+from)
+		return
+	}
+
+	var quote byte
+	start := 0
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case quote != 0:
+			// a doubled quote is an escaped quote, and toggles straight back
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ';':
+			stmt := strings.TrimSpace(string(b[start:i]))
+			// the statements in the body of a trigger end in semicolons too
+			if strings.HasPrefix(stmt, "CREATE TRIGGER ") && !strings.HasSuffix(stmt, "END") {
+				continue
+			}
+			if stmt != "" {
+				statements = append(statements, stmt)
+			}
+			start = i + 1
+		}
+	}
+	if quote != 0 || strings.TrimSpace(string(b[start:])) != "" {
+		err = fmt.Errorf("%s ends in the middle of a statement", from)
+	}
+	return
+}
+
+// isEmpty returns whether name is missing, or only has the public domain.
+func isEmpty(name string) (empty bool, err error) {
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", name))
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	var n int
+	err = db.QueryRow(`SELECT
+	(SELECT COUNT(*) FROM fs) +
+	(SELECT COUNT(*) FROM blobs) +
+	(SELECT COUNT(*) FROM domains WHERE name != 'public')`).Scan(&n)
+	if err != nil {
+		err = errors.Wrap(err, "checking "+name+" is empty")
+		return
+	}
+	return n == 0, nil
+}
+
+// removeDatabase removes a SQLite database along with its WAL files.
+func removeDatabase(name string) (err error) {
+	for _, suffix := range []string{"-wal", "-shm", ""} {
+		err = os.Remove(name + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestore(t *testing.T) {
+	for _, name := range []string{"dumped.db", "restored.db"} {
+		removeDatabase(name)
+		defer removeDatabase(name)
+		defer os.Remove(name + ".sql.gz")
+	}
+	fs, err := New("dumped.db")
+	assert.Nil(t, err)
+	assert.Nil(t, fs.SetDomain("work", "secret"))
+	f := fs.NewFile("notes", "it's a page;\nover two lines")
+	f.Domain = "work"
+	assert.Nil(t, fs.Save(f))
+	assert.Nil(t, fs.SaveBlob("blob", "a.png", []byte{0, ';', '\''}))
+	emptied := fs.NewFile("emptied", "gone soon")
+	assert.Nil(t, fs.Save(emptied))
+	emptied.Data = ""
+	assert.Nil(t, fs.Save(emptied))
+	assert.Nil(t, fs.DumpSQL())
+	fs.Close()
+
+	rows, err := Restore("restored.db", "dumped.db.sql.gz", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, rows["fs"])
+	assert.Equal(t, 1, rows["blobs"])
+
+	fs, err = New("restored.db")
+	assert.Nil(t, err)
+	files, err := fs.Get(f.ID, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, f.Data, files[0].Data)
+	files, err = fs.Find("lines", "work")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	files, err = fs.GetTrash("public")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "gone soon", files[0].DeletedData())
+	_, data, _, err := fs.GetBlob("blob")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, ';', '\''}, data)
+	_, _, err = fs.ValidateDomain("work", "secret")
+	assert.Nil(t, err)
+	fs.Close()
+
+	// the restored database has pages now
+	_, err = Restore("restored.db", "dumped.db.sql.gz", false)
+	assert.NotNil(t, err)
+	_, err = Restore("restored.db", "dumped.db.sql.gz", true)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,316 @@
+package db
+
+import (
+	"database/sql"
+	"html"
+	"html/template"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// searchWeights are the weights of the columns of the fts table, id, slug
+// and data, when ranking matches. A match in the slug counts ten times as
+// much as one in the text.
+var searchWeights = []float64{0, 10, 1}
+
+// The matches in a snippet are marked with these until it is escaped for
+// HTML, so that the text of the page can not add markup of its own.
+const (
+	snippetStart = "\x02"
+	snippetStop  = "\x03"
+)
+
+// searchSlug returns the slug of f to index, which is left out once the page
+// is in the trash, as its data is.
+func searchSlug(f File) string {
+	if f.Data == "" {
+		return ""
+	}
+	return f.Slug
+}
+
+// searchWords returns the lowercased words of s.
+func searchWords(s string) (words []string) {
+	for _, t := range tokenize(s) {
+		words = append(words, t.word)
+	}
+	return
+}
+
+// token is a lowercased word of a text, and where it is in the text.
+type token struct {
+	word       string
+	start, end int
+}
+
+func tokenize(s string) (tokens []token) {
+	start := -1
+	for i, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(s[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(s[start:]), start, len(s)})
+	}
+	return
+}
+
+// bm25 scores a page the way the bm25 function of FTS5 does, from freqs,
+// the weighted number of times each phrase is in the page, docs, the number
+// of the n pages that have each phrase, and the length of the page and the
+// average length of all pages in words. Higher scores are better matches.
+func bm25(freqs []float64, docs []int, n int, length, avgLength float64) (score float64) {
+	const k1, b = 1.2, 0.75
+	if avgLength <= 0 {
+		avgLength = 1
+	}
+	for i, freq := range freqs {
+		idf := math.Log((float64(n-docs[i]) + 0.5) / (float64(docs[i]) + 0.5))
+		if idf <= 0 {
+			idf = 1e-6
+		}
+		score += idf * freq * (k1 + 1) / (freq + k1*(1-b+b*length/avgLength))
+	}
+	return
+}
+
+// highlight returns a snippet with its marks removed, and as HTML with the
+// matches in bold.
+func highlight(snippet string) (text string, h template.HTML) {
+	text = strings.NewReplacer(snippetStart, "", snippetStop, "").Replace(snippet)
+	h = template.HTML(strings.NewReplacer(snippetStart, "<b>", snippetStop, "</b>").Replace(html.EscapeString(snippet)))
+	return
+}
+
+// searchIndexModule returns the module of the fts table, fts4 or fts5.
+func searchIndexModule(db queryer) (module string, err error) {
+	stmt, err := db.Prepare(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'fts'`)
+	if err != nil {
+		return "", errors.Wrap(err, "finding the search index")
+	}
+	defer stmt.Close()
+	var create string
+	err = stmt.QueryRow().Scan(&create)
+	if err != nil {
+		return "", errors.Wrap(err, "finding the search index")
+	}
+	if strings.Contains(strings.ToLower(create), "fts5") {
+		return "fts5", nil
+	}
+	return "fts4", nil
+}
+
+// hasFTS5 returns whether SQLite was built with FTS5, which go-sqlite3 only
+// does with the sqlite_fts5 build tag.
+func hasFTS5(db queryer) (ok bool, err error) {
+	stmt, err := db.Prepare(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`)
+	if err != nil {
+		return false, errors.Wrap(err, "checking for FTS5")
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow().Scan(&ok)
+	if err != nil {
+		return false, errors.Wrap(err, "checking for FTS5")
+	}
+	return
+}
+
+// rebuildSearchIndex replaces the fts table with one using FTS5 that has the
+// slug of each page in its own column. The slug of a page in the trash is
+// left out, as its text is.
+func rebuildSearchIndex(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE VIRTUAL TABLE fts_new USING fts5 (id UNINDEXED, slug, data);`,
+		`INSERT INTO fts_new(id, slug, data)
+			SELECT fts.id, CASE WHEN fts.data = '' THEN '' ELSE COALESCE(fs.slug, '') END, fts.data
+			FROM fts LEFT JOIN fs ON fs.id = fts.id;`,
+		`DROP TABLE fts;`,
+		`ALTER TABLE fts_new RENAME TO fts;`,
+	)
+}
+
+// migrateSearchRanking indexes the slugs of pages with FTS5, so that they
+// can be ranked higher.
+func migrateSearchRanking(tx *sql.Tx) error {
+	return rebuildSearchIndex(tx)
+}
+
+// upgradeSearchIndex moves the search index to FTS5 if it is still using
+// FTS4, as it is in a database migrated by a build without FTS5.
+func (fs *FileSystem) upgradeSearchIndex() (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	module, err := searchIndexModule(fs.DB)
+	if err != nil || module == "fts5" {
+		return
+	}
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin rebuilding the search index")
+	}
+	defer tx.Rollback()
+	err = rebuildSearchIndex(tx)
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "commit rebuilding the search index")
+	}
+	return
+}
+
+// findQuery returns the files among files that match the search, with a
+// snippet of the data and their bm25 rank, best first. It is the search of
+// Memory, which has no index.
+func findQuery(q searchQuery, files []File) (found []File) {
+	found = []File{}
+	terms := q.terms()
+	type page struct {
+		f          File
+		slug, data []token
+		freqs      []float64
+	}
+	var pages []page
+	docs := make([]int, len(terms))
+	var totalLength float64
+	for _, f := range files {
+		p := page{f: f, slug: tokenize(f.Slug), data: tokenize(f.Data), freqs: make([]float64, len(terms))}
+		totalLength += float64(len(p.slug) + len(p.data))
+		for i, t := range terms {
+			inSlug, inData := t.count(p.slug, p.data)
+			p.freqs[i] = searchWeights[1]*float64(inSlug) + searchWeights[2]*float64(inData)
+			if p.freqs[i] > 0 {
+				docs[i]++
+			}
+		}
+		pages = append(pages, p)
+	}
+
+next:
+	for _, p := range pages {
+		i := 0
+		for _, clause := range q.clauses {
+			var freq float64
+			for range clause {
+				freq += p.freqs[i]
+				i++
+			}
+			if freq == 0 {
+				continue next
+			}
+		}
+		for _, t := range q.excluded {
+			if inSlug, inData := t.count(p.slug, p.data); inSlug+inData > 0 {
+				continue next
+			}
+		}
+		for _, filter := range q.filters {
+			if !filter.matches(p.f) {
+				continue next
+			}
+		}
+		f := p.f
+		if len(terms) > 0 {
+			f.Rank = bm25(p.freqs, docs, len(pages), float64(len(p.slug)+len(p.data)), totalLength/float64(len(pages)))
+		}
+		f.Data, f.DataHTML = highlight(snippet(f.Data, p.data, terms))
+		found = append(found, f)
+	}
+	sortFiles(found, false)
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Rank > found[j].Rank
+	})
+	return
+}
+
+// count returns the number of times the term is in the slug and the data.
+func (t searchTerm) count(slug, data []token) (inSlug, inData int) {
+	inSlug = len(termHits(t, slug))
+	if !t.slug {
+		inData = len(termHits(t, data))
+	}
+	return
+}
+
+// termHits returns the index in tokens of the first word of each occurrence
+// of the term.
+func termHits(t searchTerm, tokens []token) (hits []int) {
+	for i := 0; i+len(t.words) <= len(tokens); i++ {
+		matches := true
+		for j, word := range t.words {
+			last := j == len(t.words)-1
+			if tokens[i+j].word != word && !(last && t.prefix && strings.HasPrefix(tokens[i+j].word, word)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			hits = append(hits, i)
+		}
+	}
+	return
+}
+
+// snippet returns up to 30 words of data around the first match of the
+// terms, with the matches marked, like the snippet function of FTS.
+func snippet(data string, tokens []token, terms []searchTerm) string {
+	const size = 30
+	marked := make([]bool, len(tokens))
+	first := len(tokens)
+	for _, t := range terms {
+		if t.slug {
+			continue
+		}
+		for _, hit := range termHits(t, tokens) {
+			for j := range t.words {
+				marked[hit+j] = true
+			}
+			if hit < first {
+				first = hit
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return ""
+	}
+	start := first - size/4
+	if start < 0 || first == len(tokens) {
+		start = 0
+	}
+	end := start + size
+	if end > len(tokens) {
+		end = len(tokens)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	pos := tokens[start].start
+	for i := start; i < end; i++ {
+		b.WriteString(data[pos:tokens[i].start])
+		if marked[i] {
+			b.WriteString(snippetStart + data[tokens[i].start:tokens[i].end] + snippetStop)
+		} else {
+			b.WriteString(data[tokens[i].start:tokens[i].end])
+		}
+		pos = tokens[i].end
+	}
+	if end < len(tokens) {
+		b.WriteString("...")
+	} else {
+		b.WriteString(data[pos:])
+	}
+	return b.String()
+}
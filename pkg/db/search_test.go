@@ -0,0 +1,87 @@
+package db
+
+import (
+	"html/template"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFind(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testFind(t, s)
+		})
+	}
+}
+
+func testFind(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("work", "secret"))
+	save := func(id, slug, data string) {
+		f := File{ID: id, Slug: slug, Data: data, Domain: "work"}
+		assert.Nil(t, s.Save(f))
+	}
+	save("mentions", "notes", "we should buy a new printer for the office, the printer is broken")
+	save("titled", "printer", "the old one jams on every page")
+	save("other", "lunch", "sandwiches from the new place")
+	save("markup", "markup", "a printer <script>alert(1)</script> that prints")
+	save("trashed", "printer-manual", "printer")
+	save("trashed", "printer-manual", "")
+	ids := func(files []File) (ids []string) {
+		for _, f := range files {
+			ids = append(ids, f.ID)
+		}
+		return
+	}
+
+	// a match in the slug ranks first
+	files, err := s.Find("printer", "work")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"titled", "mentions", "markup"}, ids(files))
+	for i := 1; i < len(files); i++ {
+		assert.True(t, files[i-1].Rank >= files[i].Rank)
+	}
+	assert.True(t, files[2].Rank > 0)
+
+	// snippets mark the matches, and nothing else is markup
+	assert.Contains(t, string(files[1].DataHTML), "<b>printer</b>")
+	assert.Contains(t, files[1].Data, "new printer")
+	assert.NotContains(t, files[1].Data, "<b>")
+	assert.Contains(t, string(files[2].DataHTML), "&lt;script&gt;")
+	assert.NotContains(t, string(files[2].DataHTML), "<script>")
+
+	// prefixes and phrases
+	files, err = s.Find("print*", "work")
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+	files, err = s.Find(`"new printer"`, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mentions"}, ids(files))
+	files, err = s.Find(`"printer for"`, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mentions"}, ids(files))
+	files, err = s.Find(`"for printer"`, "work")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+	files, err = s.Find(`"the new pla"*`, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"other"}, ids(files))
+
+	// every term must match
+	files, err = s.Find("new sandwiches", "work")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"other"}, ids(files))
+
+	// what would be syntax of the full-text query languages is searched for
+	// as text
+	for _, text := range []string{`printer NOT`, `printer:`, `(printer) NEAR`, `data:printer`, `printer^`, `{slug}:printer`} {
+		_, err = s.Find(text, "work")
+		assert.Nil(t, err, text)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	text, h := highlight("a <i>" + snippetStart + "word" + snippetStop + "</i>")
+	assert.Equal(t, "a <i>word</i>", text)
+	assert.Equal(t, template.HTML("a &lt;i&gt;<b>word</b>&lt;/i&gt;"), h)
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Session is a key handed out by signing in to a domain, as listed to the
+// admins of the domain. The key itself is never listed.
+type Session struct {
+	ID       string // the KeyID of the key
+	User     string // empty for the password or read-only password of the domain
+	Role     Role
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// SessionStore lists and revokes the sessions of a domain.
+type SessionStore interface {
+	// GetSessions returns the sessions of the domain, the most recently used
+	// first.
+	GetSessions(domain string) ([]Session, error)
+	// DeleteSession revokes the session of the domain with the id.
+	DeleteSession(domain, id string) error
+	// DeleteSessions revokes every session of the domain.
+	DeleteSessions(domain string) error
+}
+
+func getSessions(db queryer, bind func(string) string, domain string) (sessions []Session, err error) {
+	stmt, err := db.Prepare(bind(`SELECT keys.key, keys.created, keys.lastused, keys.role, users.name, memberships.role, domains.options
+		FROM keys
+		INNER JOIN domains ON keys.domainid = domains.id
+		LEFT JOIN users ON keys.userid = users.id
+		LEFT JOIN memberships ON memberships.domainid = keys.domainid AND memberships.userid = keys.userid
+		WHERE domains.name = ?`))
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing sessions")
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(strings.ToLower(domain))
+	if err != nil {
+		return nil, errors.Wrap(err, "get sessions")
+	}
+	defer rows.Close()
+	sessions = []Session{}
+	for rows.Next() {
+		var s Session
+		var hash string
+		var created, lastused sql.NullTime
+		var options []byte
+		var keyRole, user, role sql.NullString
+		err = rows.Scan(&hash, &created, &lastused, &keyRole, &user, &role, &options)
+		if err != nil {
+			return nil, errors.Wrap(err, "get sessions")
+		}
+		var domainOptions DomainOptions
+		json.Unmarshal(options, &domainOptions)
+		s.User = user.String
+		s.Role, err = roleOfKey(s.User, keyRole, role, domainOptions)
+		if err != nil {
+			// the key no longer signs in to anything
+			err = nil
+			continue
+		}
+		s.ID = hash[:keyIDLength]
+		s.Created, s.LastUsed = created.Time, lastused.Time
+		sessions = append(sessions, s)
+	}
+	err = rows.Err()
+	sortSessions(sessions)
+	return
+}
+
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+}
+
+func deleteSession(tx *sql.Tx, bind func(string) string, domain, id string) (err error) {
+	if len(id) != keyIDLength {
+		return errors.New("no such session")
+	}
+	res, err := tx.Exec(bind(`DELETE FROM keys WHERE substr(key, 1, ?) = ? AND domainid = (SELECT id FROM domains WHERE name = ?)`),
+		keyIDLength, id, strings.ToLower(domain))
+	if err != nil {
+		return errors.Wrap(err, "delete session")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("no such session")
+	}
+	return
+}
+
+// deleteSessions deletes the keys of the domain, see DeleteSessions.
+func deleteSessions(tx *sql.Tx, bind func(string) string, domainid int) (err error) {
+	_, err = tx.Exec(bind(`DELETE FROM keys WHERE domainid = ?`), domainid)
+	return errors.Wrap(err, "delete sessions")
+}
+
+// GetSessions returns the sessions of the domain.
+func (fs *FileSystem) GetSessions(domain string) (sessions []Session, err error) {
+	return getSessions(fs.reader, bindSQLite, domain)
+}
+
+// DeleteSession revokes a session of the domain.
+func (fs *FileSystem) DeleteSession(domain, id string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin DeleteSession")
+	}
+	defer tx.Rollback()
+	if err = deleteSession(tx, bindSQLite, domain, id); err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit DeleteSession")
+}
+
+// DeleteSessions revokes every session of the domain.
+func (fs *FileSystem) DeleteSessions(domain string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	domainid, _, _, _, _ := fs.getDomainFromName(fs.DB, domain)
+	if domainid == 0 {
+		return errors.New("domain does not exist")
+	}
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin DeleteSessions")
+	}
+	defer tx.Rollback()
+	if err = deleteSessions(tx, bindSQLite, domainid); err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit DeleteSessions")
+}
+
+// GetSessions returns the sessions of the domain.
+func (pg *Postgres) GetSessions(domain string) (sessions []Session, err error) {
+	return getSessions(pg.DB, bindPostgres, domain)
+}
+
+// DeleteSession revokes a session of the domain.
+func (pg *Postgres) DeleteSession(domain, id string) (err error) {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin DeleteSession")
+	}
+	defer tx.Rollback()
+	if err = deleteSession(tx, bindPostgres, domain, id); err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit DeleteSession")
+}
+
+// DeleteSessions revokes every session of the domain.
+func (pg *Postgres) DeleteSessions(domain string) (err error) {
+	domainid, _, _, _, err := pg.getDomainFromName(domain)
+	if err == sql.ErrNoRows {
+		return errors.New("domain does not exist")
+	} else if err != nil {
+		return
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin DeleteSessions")
+	}
+	defer tx.Rollback()
+	if err = deleteSessions(tx, bindPostgres, domainid); err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit DeleteSessions")
+}
+
+// GetSessions returns the sessions of the domain.
+func (m *Memory) GetSessions(domain string) (sessions []Session, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	sessions = []Session{}
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return
+	}
+	for hash, mk := range m.keys {
+		if mk.domainid != d.id {
+			continue
+		}
+		s := Session{ID: hash[:keyIDLength], Created: mk.created, LastUsed: mk.lastused}
+		keyRole := sql.NullString{String: string(mk.role), Valid: mk.role != ""}
+		var role sql.NullString
+		if mk.userid != 0 {
+			for _, u := range m.users {
+				if u.id == mk.userid {
+					s.User = u.name
+				}
+			}
+			if r, ok := d.members[mk.userid]; ok {
+				role = sql.NullString{String: string(r), Valid: true}
+			}
+		}
+		if s.Role, err = roleOfKey(s.User, keyRole, role, d.options); err != nil {
+			err = nil
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sortSessions(sessions)
+	return
+}
+
+// DeleteSession revokes a session of the domain.
+func (m *Memory) DeleteSession(domain, id string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	if ok && len(id) == keyIDLength {
+		for hash, mk := range m.keys {
+			if mk.domainid == d.id && hash[:keyIDLength] == id {
+				delete(m.keys, hash)
+				return
+			}
+		}
+	}
+	return errors.New("no such session")
+}
+
+// DeleteSessions revokes every session of the domain.
+func (m *Memory) DeleteSessions(domain string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return errors.New("domain does not exist")
+	}
+	m.deleteSessions(d.id)
+	return
+}
+
+func (m *Memory) deleteSessions(domainid int) {
+	for hash, mk := range m.keys {
+		if mk.domainid == domainid {
+			delete(m.keys, hash)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testSessions(t, s)
+		})
+	}
+}
+
+func testSessions(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("work", "secret"))
+	assert.Nil(t, s.SetDomain("home", "secret"))
+	assert.Nil(t, s.CreateUser("alice", "alicepass"))
+	assert.Nil(t, s.SetMembership("work", "alice", RoleEditor))
+	assert.Nil(t, s.SetReaderPassword("work", "readonly"))
+
+	admin, err := s.SetKey("work", "secret")
+	assert.Nil(t, err)
+	reader, err := s.SetKey("work", "readonly")
+	assert.Nil(t, err)
+	alice, err := s.SetUserKey("work", "alice", "alicepass")
+	assert.Nil(t, err)
+	home, err := s.SetKey("home", "secret")
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, s.UpdateKeys([]string{reader}))
+
+	sessions, err := s.GetSessions("WORK")
+	assert.Nil(t, err)
+	if !assert.Len(t, sessions, 3) {
+		return
+	}
+	assert.Equal(t, KeyID(reader), sessions[0].ID, "the most recently used first")
+	assert.Equal(t, RoleReader, sessions[0].Role)
+	assert.True(t, sessions[0].LastUsed.After(sessions[0].Created))
+	byID := map[string]Session{}
+	for _, session := range sessions {
+		byID[session.ID] = session
+		assert.WithinDuration(t, time.Now(), session.Created, time.Minute)
+		assert.NotContains(t, []string{admin, reader, alice}, session.ID)
+	}
+	assert.Equal(t, RoleAdmin, byID[KeyID(admin)].Role)
+	assert.Empty(t, byID[KeyID(admin)].User)
+	assert.Equal(t, RoleEditor, byID[KeyID(alice)].Role)
+	assert.Equal(t, "alice", byID[KeyID(alice)].User)
+
+	sessions, err = s.GetSessions("nodomain")
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+
+	// a session is only revoked in its own domain
+	assert.NotNil(t, s.DeleteSession("work", KeyID(home)))
+	assert.NotNil(t, s.DeleteSession("work", ""))
+	assert.NotNil(t, s.DeleteSession("work", KeyID(alice)[:4]))
+	assert.Nil(t, s.DeleteSession("work", KeyID(alice)))
+	_, err = s.GetKey(alice)
+	assert.NotNil(t, err)
+	_, err = s.GetKey(home)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.DeleteSession("work", KeyID(alice)), "it is gone")
+
+	assert.Nil(t, s.DeleteSessions("work"))
+	assert.NotNil(t, s.DeleteSessions("nodomain"))
+	sessions, _ = s.GetSessions("work")
+	assert.Empty(t, sessions)
+	_, err = s.GetKey(admin)
+	assert.NotNil(t, err)
+	_, err = s.GetKey(home)
+	assert.Nil(t, err)
+
+	// changing the password signs everyone out, changing only the options
+	// does not
+	admin, _ = s.SetKey("work", "secret")
+	alice, _ = s.SetUserKey("work", "alice", "alicepass")
+	assert.Nil(t, s.UpdateDomain("work", "", true, DomainOptions{}))
+	sessions, _ = s.GetSessions("work")
+	assert.Len(t, sessions, 2)
+	assert.Nil(t, s.UpdateDomain("work", "newsecret", true, DomainOptions{}))
+	sessions, _ = s.GetSessions("work")
+	assert.Empty(t, sessions)
+	_, err = s.GetKey(alice)
+	assert.NotNil(t, err)
+	_, err = s.GetKey(home)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// Share is a secret link to read one page without signing in. Like API
+// tokens, the link is only known when it is created.
+type Share struct {
+	ID       int
+	Domain   string
+	FileID   string
+	Created  time.Time
+	Expires  *time.Time // nil if the link does not expire
+	MaxViews int        // 0 if the link can be viewed any number of times
+	Views    int
+}
+
+// Expired returns whether the link has expired or was viewed as often as it
+// may be.
+func (s Share) Expired() bool {
+	return (s.Expires != nil && !time.Now().Before(*s.Expires)) || (s.MaxViews > 0 && s.Views >= s.MaxViews)
+}
+
+// ShareStore keeps the share links of pages.
+type ShareStore interface {
+	// CreateShare returns a new link to the page of the domain. It can not
+	// be shown again, as only its hash is stored.
+	CreateShare(domain, fileid string, expires *time.Time, maxViews int) (token string, s Share, err error)
+	// UseShare returns the share, and counts the view, if it exists and
+	// has not expired.
+	UseShare(token string) (s Share, err error)
+	// GetShares returns the links to a page, the most recently created first.
+	GetShares(domain, fileid string) ([]Share, error)
+	// DeleteShare revokes the link of the domain with the id.
+	DeleteShare(domain string, id int) error
+}
+
+// newShare returns a random share token and the hash it is stored as.
+func newShare() (token, hash string, err error) {
+	token, err = randomHex(16)
+	if err != nil {
+		return
+	}
+	return token, hashShare(token), nil
+}
+
+func hashShare(token string) string {
+	return utils.Hash("rwtxt share link", token)
+}
+
+// checkNewShare validates a share to be created.
+func checkNewShare(expires *time.Time, maxViews int) (err error) {
+	if expires != nil && !expires.After(time.Now()) {
+		return errors.New("link would already be expired")
+	}
+	if maxViews < 0 {
+		return errors.New("views can not be negative")
+	}
+	return
+}
+
+// CreateShare returns a new link to the page.
+func (fs *FileSystem) CreateShare(domain, fileid string, expires *time.Time, maxViews int) (token string, s Share, err error) {
+	if err = checkNewShare(expires, maxViews); err != nil {
+		return
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	var domainid int
+	err = fs.DB.QueryRow(`SELECT domainid FROM fs WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`,
+		fileid, strings.ToLower(domain)).Scan(&domainid)
+	if err == sql.ErrNoRows {
+		err = errors.New("page does not exist")
+	}
+	if err != nil {
+		return
+	}
+	token, hash, err := newShare()
+	if err != nil {
+		return
+	}
+	s = Share{Domain: strings.ToLower(domain), FileID: fileid, Created: time.Now().UTC(), Expires: expires, MaxViews: maxViews}
+	res, err := fs.DB.Exec(`INSERT INTO shares (domainid, fileid, hash, created, expires, maxviews, views) VALUES (?,?,?,?,?,?,0)`,
+		domainid, fileid, hash, s.Created, s.Expires, s.MaxViews)
+	if err != nil {
+		return "", s, errors.Wrap(err, "insert share")
+	}
+	id, err := res.LastInsertId()
+	s.ID = int(id)
+	return
+}
+
+// UseShare returns the share if it exists and has not expired.
+func (fs *FileSystem) UseShare(token string) (s Share, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return useShare(fs.DB, bindSQLite, token)
+}
+
+// GetShares returns the links to a page.
+func (fs *FileSystem) GetShares(domain, fileid string) (shares []Share, err error) {
+	return getShares(fs.reader, bindSQLite, `domains.name = ? AND shares.fileid = ?`, strings.ToLower(domain), fileid)
+}
+
+// DeleteShare revokes a link of the domain.
+func (fs *FileSystem) DeleteShare(domain string, id int) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	res, err := fs.DB.Exec(`DELETE FROM shares WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, id, strings.ToLower(domain))
+	if err != nil {
+		return errors.Wrap(err, "delete share")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("no such share link")
+	}
+	return
+}
+
+// useShare counts a view of the share, as long as that does not go over its
+// limit.
+func useShare(db *sql.DB, bind func(string) string, token string) (s Share, err error) {
+	shares, err := getShares(db, bind, `shares.hash = ?`, hashShare(token))
+	if err != nil {
+		return
+	}
+	if len(shares) == 0 {
+		return s, errors.New("no such share link")
+	}
+	s = shares[0]
+	if s.Expired() {
+		return s, errors.New("share link has expired")
+	}
+	res, err := db.Exec(bind(`UPDATE shares SET views = views + 1 WHERE id = ? AND (maxviews = 0 OR views < maxviews)`), s.ID)
+	if err != nil {
+		return s, errors.Wrap(err, "update share")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return s, errors.New("share link has expired")
+	}
+	s.Views++
+	return
+}
+
+// getShares returns the shares matching where, the most recently created
+// first.
+func getShares(db queryer, bind func(string) string, where string, args ...interface{}) (shares []Share, err error) {
+	stmt, err := db.Prepare(bind(`SELECT shares.id, domains.name, shares.fileid, shares.created, shares.expires, shares.maxviews, shares.views
+		FROM shares INNER JOIN domains ON shares.domainid = domains.id
+		WHERE ` + where + ` ORDER BY shares.created DESC, shares.id DESC`))
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing shares")
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "get shares")
+	}
+	defer rows.Close()
+	shares = []Share{}
+	for rows.Next() {
+		var s Share
+		err = rows.Scan(&s.ID, &s.Domain, &s.FileID, &s.Created, &s.Expires, &s.MaxViews, &s.Views)
+		if err != nil {
+			return nil, errors.Wrap(err, "get shares")
+		}
+		shares = append(shares, s)
+	}
+	err = rows.Err()
+	return
+}
+
+// CreateShare returns a new link to the page.
+func (pg *Postgres) CreateShare(domain, fileid string, expires *time.Time, maxViews int) (token string, s Share, err error) {
+	if err = checkNewShare(expires, maxViews); err != nil {
+		return
+	}
+	var domainid int
+	err = pg.queryRow(`SELECT f.domainid FROM fs f INNER JOIN domains d ON f.domainid = d.id WHERE f.id = ? AND d.name = ?`,
+		fileid, strings.ToLower(domain)).Scan(&domainid)
+	if err == sql.ErrNoRows {
+		err = errors.New("page does not exist")
+	}
+	if err != nil {
+		return
+	}
+	token, hash, err := newShare()
+	if err != nil {
+		return
+	}
+	s = Share{Domain: strings.ToLower(domain), FileID: fileid, Created: time.Now().UTC(), Expires: expires, MaxViews: maxViews}
+	err = pg.queryRow(`INSERT INTO shares (domainid, fileid, hash, created, expires, maxviews, views) VALUES (?,?,?,?,?,?,0) RETURNING id`,
+		domainid, fileid, hash, s.Created, s.Expires, s.MaxViews).Scan(&s.ID)
+	if err != nil {
+		return "", s, errors.Wrap(err, "insert share")
+	}
+	return
+}
+
+// UseShare returns the share if it exists and has not expired.
+func (pg *Postgres) UseShare(token string) (s Share, err error) {
+	return useShare(pg.DB, bindPostgres, token)
+}
+
+// GetShares returns the links to a page.
+func (pg *Postgres) GetShares(domain, fileid string) (shares []Share, err error) {
+	return getShares(pg.DB, bindPostgres, `domains.name = ? AND shares.fileid = ?`, strings.ToLower(domain), fileid)
+}
+
+// DeleteShare revokes a link of the domain.
+func (pg *Postgres) DeleteShare(domain string, id int) (err error) {
+	res, err := pg.exec(`DELETE FROM shares WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, id, strings.ToLower(domain))
+	if err != nil {
+		return errors.Wrap(err, "delete share")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("no such share link")
+	}
+	return
+}
+
+// CreateShare returns a new link to the page.
+func (m *Memory) CreateShare(domain, fileid string, expires *time.Time, maxViews int) (token string, s Share, err error) {
+	if err = checkNewShare(expires, maxViews); err != nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	f, okFile := m.files[fileid]
+	if !ok || !okFile || f.domainid != d.id {
+		err = errors.New("page does not exist")
+		return
+	}
+	token, hash, err := newShare()
+	if err != nil {
+		return
+	}
+	m.lastShareID++
+	s = Share{ID: m.lastShareID, Domain: d.name, FileID: fileid, Created: time.Now().UTC(), Expires: expires, MaxViews: maxViews}
+	m.shares[hash] = &s
+	return
+}
+
+// UseShare returns the share if it exists and has not expired.
+func (m *Memory) UseShare(token string) (s Share, err error) {
+	m.Lock()
+	defer m.Unlock()
+	ms, ok := m.shares[hashShare(token)]
+	if !ok || m.domains[ms.Domain] == nil {
+		return s, errors.New("no such share link")
+	}
+	if ms.Expired() {
+		return *ms, errors.New("share link has expired")
+	}
+	ms.Views++
+	return *ms, nil
+}
+
+// GetShares returns the links to a page.
+func (m *Memory) GetShares(domain, fileid string) (shares []Share, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	shares = []Share{}
+	for _, s := range m.shares {
+		if s.Domain == strings.ToLower(domain) && s.FileID == fileid {
+			shares = append(shares, *s)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ID > shares[j].ID
+	})
+	return
+}
+
+// DeleteShare revokes a link of the domain.
+func (m *Memory) DeleteShare(domain string, id int) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	for hash, s := range m.shares {
+		if s.ID == id && s.Domain == strings.ToLower(domain) {
+			delete(m.shares, hash)
+			return
+		}
+	}
+	return errors.New("no such share link")
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShares(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testShares(t, s)
+		})
+	}
+}
+
+func testShares(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("work", "secret"))
+	assert.Nil(t, s.Save(File{ID: "page1", Slug: "plan", Data: "the plan", Domain: "work"}))
+
+	_, _, err := s.CreateShare("work", "nopage", nil, 0)
+	assert.NotNil(t, err)
+	_, _, err = s.CreateShare("public", "page1", nil, 0)
+	assert.NotNil(t, err, "the page has to be in the domain")
+	past := time.Now().Add(-time.Hour)
+	_, _, err = s.CreateShare("work", "page1", &past, 0)
+	assert.NotNil(t, err)
+
+	token, share, err := s.CreateShare("work", "page1", nil, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "page1", share.FileID)
+	future := time.Now().Add(time.Hour)
+	forever, _, err := s.CreateShare("work", "page1", &future, 0)
+	assert.Nil(t, err)
+
+	_, err = s.UseShare("nope")
+	assert.NotNil(t, err)
+	for i := 1; i <= 2; i++ {
+		share, err = s.UseShare(token)
+		assert.Nil(t, err)
+		assert.Equal(t, "work", share.Domain)
+		assert.Equal(t, i, share.Views)
+	}
+	_, err = s.UseShare(token)
+	assert.NotNil(t, err, "the link was viewed as often as it may be")
+
+	shares, err := s.GetShares("work", "page1")
+	assert.Nil(t, err)
+	if assert.Len(t, shares, 2) {
+		assert.NotNil(t, shares[0].Expires)
+		assert.True(t, shares[1].Expired())
+	}
+
+	assert.NotNil(t, s.DeleteShare("public", shares[0].ID))
+	assert.Nil(t, s.DeleteShare("work", shares[0].ID))
+	_, err = s.UseShare(forever)
+	assert.NotNil(t, err)
+
+	// purging a page from the trash deletes its links
+	_, _, err = s.CreateShare("work", "page1", nil, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Save(File{ID: "page1", Data: "", Domain: "work"}))
+	assert.Nil(t, s.PurgeTrash(time.Now().Add(time.Hour)))
+	shares, err = s.GetShares("work", "page1")
+	assert.Nil(t, err)
+	assert.Empty(t, shares)
+}
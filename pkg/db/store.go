@@ -0,0 +1,156 @@
+package db
+
+import "time"
+
+// Store is the storage backend behind rwtxt. FileSystem, backed by SQLite, is
+// the default implementation, Postgres lets several instances share one
+// database and Memory keeps everything in memory for tests.
+type Store interface {
+	PageStore
+	DomainStore
+	KeyStore
+	TokenStore
+	UserStore
+	ShareStore
+	SessionStore
+	TwoFactorStore
+	AuditStore
+	BlobStore
+	Close() error
+}
+
+// PageStore saves, retrieves and searches pages.
+type PageStore interface {
+	// Save inserts the file, or updates its slug and data if it already
+	// exists, and saves the change as a new revision in its history. A page
+	// can not be saved to another domain than the one it is in.
+	Save(f File) error
+	// Get returns the file with the given id, or else every file in the
+	// domain with the given slug. Only Get and GetTrash load the history of
+	// the files they return.
+	Get(id string, domain string) ([]File, error)
+	// GetAll returns all non-empty files in a domain, most recently modified
+	// (or created, if created is true) first.
+	GetAll(domain string, created ...bool) ([]File, error)
+	GetTopX(domain string, num int, created ...bool) ([]File, error)
+	GetTopXMostViews(domain string, num int) ([]File, error)
+	// Find returns the files in a domain that match the text, best match
+	// first, with a snippet of the match as their data.
+	Find(text string, domain string) ([]File, error)
+	// Exists returns the id of the file with the given id or slug in the
+	// domain, and whether the slug is shared by many files.
+	Exists(id string, domain string) (trueID string, many bool, err error)
+	UpdateViews(f File) error
+	// DeleteEmpty deletes the pages that have no content and never had any.
+	// Pages that are emptied go to the trash instead.
+	DeleteEmpty() error
+	// GetTrash returns the pages in the trash of a domain, the most recently
+	// emptied first. They can be restored by saving their DeletedData.
+	GetTrash(domain string) ([]File, error)
+	// PurgeTrash deletes the pages that were moved to the trash before the
+	// time, together with their history.
+	PurgeTrash(before time.Time) error
+	GetSimilar(fileid string) ([]File, error)
+	SetSimilar(id string, similarids []string) error
+	LastModified() (time.Time, error)
+}
+
+// DomainStore manages domains and their passwords and options.
+type DomainStore interface {
+	GetDomains() ([]string, error)
+	// GetDomainFromName returns an error if the domain does not exist.
+	GetDomainFromName(domain string) (domainid int, ispublic bool, options DomainOptions, err error)
+	// SetDomain creates a domain, returning an error if it already exists or
+	// its name is reserved.
+	SetDomain(domain, password string) error
+	// UpdateDomain changes the settings of a domain, and its password unless
+	// password is empty.
+	UpdateDomain(domain, password string, ispublic bool, options DomainOptions) error
+	ValidateDomain(domain, password string) (domainid int, options DomainOptions, err error)
+	// SetReaderPassword sets a second password of the domain, which signs in
+	// with the reader role, or removes it if password is empty. Either signs
+	// out those who used the old one.
+	SetReaderPassword(domain, password string) error
+}
+
+// KeyStore manages the session keys handed out when signing in to a domain.
+type KeyStore interface {
+	// SetKey returns a new key for the domain if the password, or its reader
+	// password, is correct.
+	SetKey(domain, password string) (key string, err error)
+	// CheckPassword returns nil if SetKey, or SetUserKey if user is not
+	// empty, would give out a key for the password, without giving one out.
+	CheckPassword(domain, user, password string) error
+	CheckKey(key string) (domainid int, domain string, err error)
+	// GetKey returns the session with the key, with the role it has in its
+	// domain.
+	GetKey(key string) (Key, error)
+	// UpdateKeys marks the keys as just used.
+	UpdateKeys(keys []string) error
+	DeleteKey(key string) error
+	// DeleteOldKeys deletes keys that have not been used for 5 days.
+	DeleteOldKeys() error
+}
+
+// BlobStore keeps uploads and resized copies of uploaded images.
+type BlobStore interface {
+	SaveBlob(id string, name string, blob []byte) error
+	GetBlob(id string) (name string, data []byte, views int, err error)
+	GetBlobIDs() ([]string, error)
+	SaveResizedImage(id string, name string, blob []byte) error
+	// GetResizedImage returns sql.ErrNoRows if the image was not resized yet.
+	GetResizedImage(id string) (name string, data []byte, views int, err error)
+}
+
+// Dumper is implemented by stores that can periodically write out a dump of
+// themselves, and purge deleted pages while doing so.
+type Dumper interface {
+	DumpSQL() error
+}
+
+var (
+	_ Store     = (*FileSystem)(nil)
+	_ Dumper    = (*FileSystem)(nil)
+	_ Backuper  = (*FileSystem)(nil)
+	_ Migrator  = (*FileSystem)(nil)
+	_ Checker   = (*FileSystem)(nil)
+	_ Compactor = (*FileSystem)(nil)
+	_ Store     = (*Postgres)(nil)
+	_ Migrator  = (*Postgres)(nil)
+	_ Compactor = (*Postgres)(nil)
+	_ Store     = (*Memory)(nil)
+)
+
+// NewStore opens and initializes the store named by name. A postgres:// DSN
+// selects PostgreSQL, anything else is the filename of a SQLite database.
+func NewStore(name string) (Store, error) {
+	if IsPostgres(name) {
+		pg, err := NewPostgres(name)
+		if err != nil {
+			return nil, err
+		}
+		return pg, nil
+	}
+	fs, err := New(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// OpenStore opens the store named by name like NewStore, but without
+// initializing or migrating it.
+func OpenStore(name string) (Store, error) {
+	if IsPostgres(name) {
+		pg, err := OpenPostgres(name)
+		if err != nil {
+			return nil, err
+		}
+		return pg, nil
+	}
+	fs, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain skips the tests when SQLite was built without FTS5, which the
+// sqlite store needs to open a database at all. Run them with
+// -tags sqlite_fts5.
+func TestMain(m *testing.M) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	ok, err := hasFTS5(db)
+	db.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !ok {
+		fmt.Println("skipping the tests, SQLite was built without FTS5, run them with -tags sqlite_fts5")
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// stores returns every Store implementation to run the same tests against.
+func stores(t *testing.T) map[string]Store {
+	os.Remove("store.db")
+	fs, err := New("store.db")
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		fs.Close()
+		os.Remove("store.db")
+		os.Remove("store.db.sql.gz")
+	})
+	s := map[string]Store{
+		"sqlite": fs,
+		"memory": NewMemory(),
+	}
+
+	// set RWTXT_TEST_POSTGRES to the DSN of a scratch database to also test
+	// PostgreSQL, its tables are dropped first
+	if dsn := os.Getenv("RWTXT_TEST_POSTGRES"); dsn != "" {
+		pg, err := OpenPostgres(dsn)
+		assert.Nil(t, err)
+		_, err = pg.DB.Exec(`DROP TABLE IF EXISTS schema_version, audit, similar, keys, tokens, shares, memberships, users, revisions, fs, blobs, cached_images, domains CASCADE`)
+		assert.Nil(t, err)
+		pg.Close()
+		pg, err = NewPostgres(dsn)
+		assert.Nil(t, err)
+		t.Cleanup(func() {
+			pg.Close()
+		})
+		s["postgres"] = pg
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, s)
+		})
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	// domains
+	assert.Nil(t, s.SetDomain("work", "secret"))
+	assert.NotNil(t, s.SetDomain("work", "secret"))
+	_, ispublic, _, err := s.GetDomainFromName("work")
+	assert.Nil(t, err)
+	assert.False(t, ispublic)
+	_, _, _, err = s.GetDomainFromName("nope")
+	assert.NotNil(t, err)
+	assert.Nil(t, s.UpdateDomain("work", "", true, DomainOptions{ShowSearch: true}))
+	_, ispublic, options, err := s.GetDomainFromName("work")
+	assert.Nil(t, err)
+	assert.True(t, ispublic)
+	assert.True(t, options.ShowSearch)
+	_, _, err = s.ValidateDomain("work", "wrong")
+	assert.NotNil(t, err)
+	domains, err := s.GetDomains()
+	assert.Nil(t, err)
+	assert.Contains(t, domains, "work")
+
+	// keys
+	_, err = s.SetKey("work", "wrong")
+	assert.NotNil(t, err)
+	key, err := s.SetKey("work", "secret")
+	assert.Nil(t, err)
+	_, domain, err := s.CheckKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "work", domain)
+	assert.Nil(t, s.UpdateKeys([]string{key}))
+	assert.Nil(t, s.DeleteOldKeys())
+	_, _, err = s.CheckKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, s.DeleteKey(key))
+	_, _, err = s.CheckKey(key)
+	assert.NotNil(t, err)
+
+	// pages
+	f := File{ID: "page1", Slug: "hello", Data: "hello world", Domain: "work"}
+	assert.Nil(t, s.Save(f))
+	f.Data = "hello there world"
+	assert.Nil(t, s.Save(f))
+	assert.NotNil(t, s.Save(File{ID: "page2", Domain: "nope"}))
+	assert.NotNil(t, s.Save(File{ID: "page1", Data: "hijacked", Domain: "public"}), "pages stay in their domain")
+	assert.Nil(t, s.Save(File{ID: "page3", Slug: "empty", Domain: "work"}))
+
+	files, err := s.Get("hello", "work")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "hello there world", files[0].Data)
+	assert.Equal(t, 2, files[0].History.NumEdits())
+	_, err = s.Get("hello", "public")
+	assert.NotNil(t, err)
+
+	trueID, many, err := s.Exists("hello", "work")
+	assert.Nil(t, err)
+	assert.Equal(t, "page1", trueID)
+	assert.False(t, many)
+
+	files, err = s.GetAll("work")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	files, err = s.GetTopX("work", 10, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	assert.Nil(t, s.UpdateViews(File{ID: "page1", Views: 4}))
+	files, err = s.GetTopXMostViews("work", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, files[0].Views)
+
+	files, err = s.Find("there", "work")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	files, err = s.Find("there", "public")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	assert.Nil(t, s.SetSimilar("page3", []string{"page1"}))
+	files, err = s.GetSimilar("page3")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	// trash
+	oops := File{ID: "page4", Slug: "oops", Data: "important", Domain: "work"}
+	assert.Nil(t, s.Save(oops))
+	oops.Data = ""
+	assert.Nil(t, s.Save(oops))
+	assert.Nil(t, s.DeleteEmpty())
+	_, err = s.Get("page3", "work")
+	assert.NotNil(t, err, "pages that never had content are purged")
+	files, err = s.GetTrash("work")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(files)) {
+		assert.Equal(t, "page4", files[0].ID)
+		assert.Equal(t, "important", files[0].DeletedData())
+	}
+	oops.Data = "important"
+	assert.Nil(t, s.Save(oops))
+	files, err = s.GetTrash("work")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+	files, err = s.Get("page4", "work")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, files[0].History.NumEdits())
+	oops.Data = ""
+	assert.Nil(t, s.Save(oops))
+	assert.Nil(t, s.PurgeTrash(time.Now().Add(-time.Hour)))
+	files, err = s.GetTrash("work")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Nil(t, s.PurgeTrash(time.Now().Add(time.Hour)))
+	files, err = s.GetTrash("work")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+	_, err = s.Get("page4", "work")
+	assert.NotNil(t, err)
+
+	lastModified, err := s.LastModified()
+	assert.Nil(t, err)
+	assert.False(t, lastModified.IsZero())
+
+	// blobs
+	assert.Nil(t, s.SaveBlob("blob1", "a.txt", []byte("abc")))
+	name, data, _, err := s.GetBlob("blob1")
+	assert.Nil(t, err)
+	assert.Equal(t, "a.txt", name)
+	assert.Equal(t, []byte("abc"), data)
+	ids, err := s.GetBlobIDs()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"blob1"}, ids)
+	_, _, _, err = s.GetResizedImage("blob1")
+	assert.NotNil(t, err)
+	assert.Nil(t, s.SaveResizedImage("blob1", "a.txt", []byte("ab")))
+	_, data, _, err = s.GetResizedImage("blob1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ab"), data)
+}
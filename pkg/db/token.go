@@ -0,0 +1,360 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// TokenPrefix starts every API token, which tells them apart from the session
+// keys handed out when signing in.
+const TokenPrefix = "rwtxt_"
+
+// Scope is what an API token may do in its domain.
+type Scope string
+
+const (
+	// ScopeRead may read pages.
+	ScopeRead Scope = "read"
+	// ScopeWrite may also create, change and delete pages.
+	ScopeWrite Scope = "write"
+	// ScopeAdmin may also manage the tokens of the domain.
+	ScopeAdmin Scope = "admin"
+)
+
+var scopeRanks = map[Scope]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+
+// ParseScope returns the scope named s.
+func ParseScope(s string) (scope Scope, err error) {
+	scope = Scope(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := scopeRanks[scope]; !ok {
+		err = errors.New("scope must be read, write or admin")
+	}
+	return
+}
+
+// Allows returns whether the scope includes need. The empty scope allows
+// nothing.
+func (s Scope) Allows(need Scope) bool {
+	return scopeRanks[s] > 0 && scopeRanks[s] >= scopeRanks[need]
+}
+
+// Token is a named, revocable API token of a domain. The token itself is only
+// known when it is created, only a hash of it is stored.
+type Token struct {
+	ID       int
+	Domain   string
+	Name     string
+	Scope    Scope
+	Created  time.Time
+	Expires  *time.Time // nil if the token does not expire
+	LastUsed *time.Time // nil if the token was never used
+}
+
+// Expired returns whether the token has expired.
+func (t Token) Expired() bool {
+	return t.Expires != nil && !time.Now().Before(*t.Expires)
+}
+
+// tokenUseInterval is how often the last use of a token is written, so that
+// requests with a token do not each wait to write it.
+const tokenUseInterval = time.Minute
+
+// usedSince returns whether the token was last used less than
+// tokenUseInterval before now.
+func (t Token) usedSince(now time.Time) bool {
+	return t.LastUsed != nil && now.Sub(*t.LastUsed) < tokenUseInterval
+}
+
+// TokenStore keeps the API tokens of domains.
+type TokenStore interface {
+	// CreateToken returns a new token for the domain. It can not be shown
+	// again, as only its hash is stored.
+	CreateToken(domain, name string, scope Scope, expires *time.Time) (token string, t Token, err error)
+	// CheckToken returns the token, and marks it as just used, if it exists
+	// and has not expired. The last use is only written about once a minute.
+	CheckToken(token string) (t Token, err error)
+	// GetTokens returns the tokens of a domain, the most recently created
+	// first.
+	GetTokens(domain string) ([]Token, error)
+	// DeleteToken revokes the token of the domain with the id.
+	DeleteToken(domain string, id int) error
+}
+
+// newToken returns a random token and the hash it is stored as.
+func newToken() (token, hash string, err error) {
+	random, err := randomHex(24)
+	if err != nil {
+		return
+	}
+	token = TokenPrefix + random
+	return token, hashToken(token), nil
+}
+
+// randomHex returns n bytes from crypto/rand, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "reading random bytes")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	return utils.Hash("rwtxt api token", token)
+}
+
+// checkNewToken validates a token to be created.
+func checkNewToken(name string, scope Scope, expires *time.Time) (err error) {
+	if _, ok := scopeRanks[scope]; !ok {
+		return errors.New("scope must be read, write or admin")
+	}
+	if strings.TrimSpace(name) == "" {
+		return errors.New("token needs a name")
+	}
+	if expires != nil && !expires.After(time.Now()) {
+		return errors.New("token would already be expired")
+	}
+	return
+}
+
+// CreateToken returns a new token for the domain.
+func (fs *FileSystem) CreateToken(domain, name string, scope Scope, expires *time.Time) (token string, t Token, err error) {
+	if err = checkNewToken(name, scope, expires); err != nil {
+		return
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	domainid, _, _, _, err := fs.getDomainFromName(fs.DB, strings.ToLower(domain))
+	if err != nil {
+		return
+	}
+	if domainid == 0 {
+		err = errors.New("domain does not exist")
+		return
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	t = Token{Domain: strings.ToLower(domain), Name: strings.TrimSpace(name), Scope: scope, Created: time.Now().UTC(), Expires: expires}
+	res, err := fs.DB.Exec(`INSERT INTO tokens (domainid, name, hash, scope, created, expires) VALUES (?,?,?,?,?,?)`,
+		domainid, t.Name, hash, string(t.Scope), t.Created, t.Expires)
+	if err != nil {
+		return "", t, errors.Wrap(err, "insert token")
+	}
+	id, err := res.LastInsertId()
+	t.ID = int(id)
+	return
+}
+
+// CheckToken returns the token if it exists and has not expired.
+func (fs *FileSystem) CheckToken(token string) (t Token, err error) {
+	tokens, err := getTokens(fs.reader, bindSQLite, `tokens.hash = ?`, hashToken(token))
+	if err != nil {
+		return
+	}
+	if len(tokens) == 0 {
+		return t, errors.New("no such token")
+	}
+	t = tokens[0]
+	if t.Expired() {
+		return t, errors.New("token has expired")
+	}
+	now := time.Now().UTC()
+	if t.usedSince(now) {
+		return
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.DB.Exec(`UPDATE tokens SET lastused = ? WHERE id = ?`, now, t.ID)
+	return
+}
+
+// GetTokens returns the tokens of a domain.
+func (fs *FileSystem) GetTokens(domain string) (tokens []Token, err error) {
+	return getTokens(fs.reader, bindSQLite, `domains.name = ?`, strings.ToLower(domain))
+}
+
+// DeleteToken revokes a token of the domain.
+func (fs *FileSystem) DeleteToken(domain string, id int) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	res, err := fs.DB.Exec(`DELETE FROM tokens WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, id, strings.ToLower(domain))
+	if err != nil {
+		return errors.Wrap(err, "delete token")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("no such token")
+	}
+	return
+}
+
+// getTokens returns the tokens matching where, the most recently created
+// first.
+func getTokens(db queryer, bind func(string) string, where string, args ...interface{}) (tokens []Token, err error) {
+	stmt, err := db.Prepare(bind(`SELECT tokens.id, domains.name, tokens.name, tokens.scope, tokens.created, tokens.expires, tokens.lastused
+		FROM tokens INNER JOIN domains ON tokens.domainid = domains.id
+		WHERE ` + where + ` ORDER BY tokens.created DESC, tokens.id DESC`))
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing tokens")
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "get tokens")
+	}
+	defer rows.Close()
+	tokens = []Token{}
+	for rows.Next() {
+		var t Token
+		var scope string
+		err = rows.Scan(&t.ID, &t.Domain, &t.Name, &scope, &t.Created, &t.Expires, &t.LastUsed)
+		if err != nil {
+			return nil, errors.Wrap(err, "get tokens")
+		}
+		t.Scope = Scope(scope)
+		tokens = append(tokens, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// CreateToken returns a new token for the domain.
+func (pg *Postgres) CreateToken(domain, name string, scope Scope, expires *time.Time) (token string, t Token, err error) {
+	if err = checkNewToken(name, scope, expires); err != nil {
+		return
+	}
+	domainid, _, _, _, err := pg.getDomainFromName(strings.ToLower(domain))
+	if err == sql.ErrNoRows {
+		err = errors.New("domain does not exist")
+	}
+	if err != nil {
+		return
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	t = Token{Domain: strings.ToLower(domain), Name: strings.TrimSpace(name), Scope: scope, Created: time.Now().UTC(), Expires: expires}
+	err = pg.queryRow(`INSERT INTO tokens (domainid, name, hash, scope, created, expires) VALUES (?,?,?,?,?,?) RETURNING id`,
+		domainid, t.Name, hash, string(t.Scope), t.Created, t.Expires).Scan(&t.ID)
+	if err != nil {
+		return "", t, errors.Wrap(err, "insert token")
+	}
+	return
+}
+
+// CheckToken returns the token if it exists and has not expired.
+func (pg *Postgres) CheckToken(token string) (t Token, err error) {
+	tokens, err := getTokens(pg.DB, bindPostgres, `tokens.hash = ?`, hashToken(token))
+	if err != nil {
+		return
+	}
+	if len(tokens) == 0 {
+		return t, errors.New("no such token")
+	}
+	t = tokens[0]
+	if t.Expired() {
+		return t, errors.New("token has expired")
+	}
+	now := time.Now().UTC()
+	if t.usedSince(now) {
+		return
+	}
+	_, err = pg.exec(`UPDATE tokens SET lastused = ? WHERE id = ?`, now, t.ID)
+	return
+}
+
+// GetTokens returns the tokens of a domain.
+func (pg *Postgres) GetTokens(domain string) (tokens []Token, err error) {
+	return getTokens(pg.DB, bindPostgres, `domains.name = ?`, strings.ToLower(domain))
+}
+
+// DeleteToken revokes a token of the domain.
+func (pg *Postgres) DeleteToken(domain string, id int) (err error) {
+	res, err := pg.exec(`DELETE FROM tokens WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, id, strings.ToLower(domain))
+	if err != nil {
+		return errors.Wrap(err, "delete token")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("no such token")
+	}
+	return
+}
+
+// CreateToken returns a new token for the domain.
+func (m *Memory) CreateToken(domain, name string, scope Scope, expires *time.Time) (token string, t Token, err error) {
+	if err = checkNewToken(name, scope, expires); err != nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		err = errors.New("domain does not exist")
+		return
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	m.lastTokenID++
+	t = Token{ID: m.lastTokenID, Domain: d.name, Name: strings.TrimSpace(name), Scope: scope, Created: time.Now().UTC(), Expires: expires}
+	m.tokens[hash] = &memoryToken{Token: t, domainid: d.id}
+	return
+}
+
+// CheckToken returns the token if it exists and has not expired.
+func (m *Memory) CheckToken(token string) (t Token, err error) {
+	m.Lock()
+	defer m.Unlock()
+	mt, ok := m.tokens[hashToken(token)]
+	if !ok || m.domainByID(mt.domainid) == nil {
+		return t, errors.New("no such token")
+	}
+	if mt.Expired() {
+		return mt.Token, errors.New("token has expired")
+	}
+	now := time.Now().UTC()
+	if !mt.usedSince(now) {
+		mt.LastUsed = &now
+	}
+	return mt.Token, nil
+}
+
+// GetTokens returns the tokens of a domain.
+func (m *Memory) GetTokens(domain string) (tokens []Token, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	tokens = []Token{}
+	for _, mt := range m.tokens {
+		if mt.Domain == strings.ToLower(domain) {
+			tokens = append(tokens, mt.Token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+	return
+}
+
+// DeleteToken revokes a token of the domain.
+func (m *Memory) DeleteToken(domain string, id int) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	for hash, mt := range m.tokens {
+		if mt.ID == id && mt.Domain == strings.ToLower(domain) {
+			delete(m.tokens, hash)
+			return
+		}
+	}
+	return errors.New("no such token")
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testTokens(t, s)
+		})
+	}
+}
+
+func testTokens(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("tokens", "secret"))
+	assert.Nil(t, s.SetDomain("other", "secret"))
+
+	_, _, err := s.CreateToken("tokens", "", ScopeRead, nil)
+	assert.NotNil(t, err, "needs a name")
+	_, _, err = s.CreateToken("tokens", "bot", Scope("root"), nil)
+	assert.NotNil(t, err)
+	_, _, err = s.CreateToken("nodomain", "bot", ScopeRead, nil)
+	assert.NotNil(t, err)
+	past := time.Now().Add(-time.Hour)
+	_, _, err = s.CreateToken("tokens", "bot", ScopeRead, &past)
+	assert.NotNil(t, err)
+
+	token, created, err := s.CreateToken("tokens", "bot", ScopeWrite, nil)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(token, TokenPrefix))
+	assert.Equal(t, "bot", created.Name)
+
+	checked, err := s.CheckToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, created.ID, checked.ID)
+	assert.Equal(t, "tokens", checked.Domain)
+	assert.Equal(t, ScopeWrite, checked.Scope)
+	_, err = s.CheckToken(token + "x")
+	assert.NotNil(t, err)
+
+	// the last use is only written again once it is a minute old
+	used, err := s.CheckToken(token)
+	assert.Nil(t, err)
+	if assert.NotNil(t, used.LastUsed) {
+		assert.WithinDuration(t, time.Now(), *used.LastUsed, tokenUseInterval)
+	}
+	if fs, ok := s.(*FileSystem); ok {
+		fs.Lock()
+		done := make(chan bool)
+		go func() {
+			_, err = fs.CheckToken(token)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("checking a token waited for the lock")
+		}
+		fs.Unlock()
+		<-done
+		assert.Nil(t, err)
+	}
+
+	soon := time.Now().Add(50 * time.Millisecond)
+	expiring, _, err := s.CreateToken("tokens", "expiring", ScopeRead, &soon)
+	assert.Nil(t, err)
+	_, err = s.CheckToken(expiring)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = s.CheckToken(expiring)
+	assert.NotNil(t, err)
+
+	tokens, err := s.GetTokens("tokens")
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, "expiring", tokens[0].Name)
+	assert.NotNil(t, tokens[1].LastUsed)
+
+	assert.NotNil(t, s.DeleteToken("other", created.ID), "tokens are revoked from their own domain")
+	assert.Nil(t, s.DeleteToken("tokens", created.ID))
+	_, err = s.CheckToken(token)
+	assert.NotNil(t, err)
+}
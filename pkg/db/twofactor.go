@@ -0,0 +1,251 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// NumRecoveryCodes is how many recovery codes come with enrolling in
+// two-factor authentication.
+const NumRecoveryCodes = 10
+
+// TwoFactorStore keeps the TOTP (RFC 6238) secrets that are asked for as a
+// second factor when signing in. The secret of a domain guards its shared and
+// reader passwords, the secret of a user guards their own password in every
+// domain they are a member of. Each method works on the user if user is not
+// empty, and on the domain otherwise.
+type TwoFactorStore interface {
+	// SetTwoFactor enrolls the domain or user with the secret and recovery
+	// codes, or stops asking for a code if secret is empty. Only hashes of
+	// the recovery codes are stored.
+	SetTwoFactor(domain, user, secret string, recoveryCodes []string) error
+	// HasTwoFactor returns whether the domain or user is enrolled.
+	HasTwoFactor(domain, user string) (bool, error)
+	// CheckTwoFactor returns nil if the domain or user is not enrolled, or
+	// if code is valid at now and was not used before. A recovery code is
+	// used up by this, as is the period of a TOTP code.
+	CheckTwoFactor(domain, user, code string, now time.Time) error
+}
+
+// NewRecoveryCodes returns random codes that each sign in once in place of a
+// TOTP code.
+func NewRecoveryCodes() (codes []string, err error) {
+	codes = make([]string, NumRecoveryCodes)
+	for i := range codes {
+		var code string
+		code, err = randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return utils.Hash("rwtxt recovery code", code)
+}
+
+// hashRecoveryCodes returns the hashes of the codes as they are stored.
+func hashRecoveryCodes(codes []string) string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return strings.Join(hashes, " ")
+}
+
+// checkTwoFactorCode matches the code against the secret, and the period of
+// the last code used, or else against the hashes of the recovery codes. It
+// returns the period and recovery codes to store after using the code.
+func checkTwoFactorCode(secret string, step int64, recoveryCodes string, code string, now time.Time) (newStep int64, newRecoveryCodes string, err error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return step, recoveryCodes, errors.New("two-factor code required")
+	}
+	if s := utils.CheckTOTP(secret, code, now); s >= 0 {
+		if s <= step {
+			return step, recoveryCodes, errors.New("two-factor code was already used")
+		}
+		return s, recoveryCodes, nil
+	}
+	hash := hashRecoveryCode(code)
+	hashes := strings.Fields(recoveryCodes)
+	for i, h := range hashes {
+		if h == hash {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			return step, strings.Join(hashes, " "), nil
+		}
+	}
+	return step, recoveryCodes, errors.New("incorrect two-factor code")
+}
+
+// twoFactorTable returns the table and name of the row that keeps the two
+// factor authentication of the domain or user.
+func twoFactorTable(domain, user string) (table, name string) {
+	if user != "" {
+		return "users", strings.ToLower(strings.TrimSpace(user))
+	}
+	return "domains", strings.ToLower(domain)
+}
+
+func setTwoFactor(db *sql.DB, bind func(string) string, domain, user, secret string, recoveryCodes []string) (err error) {
+	table, name := twoFactorTable(domain, user)
+	var totpSecret, hashes sql.NullString
+	if secret != "" {
+		if _, err = utils.TOTPCode(secret, 0); err != nil {
+			return errors.Wrap(err, "bad secret")
+		}
+		totpSecret = sql.NullString{String: secret, Valid: true}
+		hashes = sql.NullString{String: hashRecoveryCodes(recoveryCodes), Valid: true}
+	}
+	res, err := db.Exec(bind(`UPDATE `+table+` SET totp_secret = ?, totp_step = 0, recovery_codes = ? WHERE name = ?`),
+		totpSecret, hashes, name)
+	if err != nil {
+		return errors.Wrap(err, "update "+table)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New(strings.TrimSuffix(table, "s") + " does not exist")
+	}
+	return
+}
+
+func hasTwoFactor(db queryer, bind func(string) string, domain, user string) (enrolled bool, err error) {
+	table, name := twoFactorTable(domain, user)
+	stmt, err := db.Prepare(bind(`SELECT totp_secret FROM ` + table + ` WHERE name = ?`))
+	if err != nil {
+		return false, errors.Wrap(err, "preparing two-factor")
+	}
+	defer stmt.Close()
+	var secret sql.NullString
+	err = stmt.QueryRow(name).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "get two-factor")
+	}
+	return secret.String != "", nil
+}
+
+// checkTwoFactor uses up the code. The update only goes through if nobody
+// used a code in the meantime, so that a code can not be used twice by
+// signing in with it at the same time.
+func checkTwoFactor(db *sql.DB, bind func(string) string, domain, user, code string, now time.Time) (err error) {
+	table, name := twoFactorTable(domain, user)
+	var secret, recoveryCodes sql.NullString
+	var step int64
+	err = db.QueryRow(bind(`SELECT totp_secret, totp_step, recovery_codes FROM `+table+` WHERE name = ?`), name).
+		Scan(&secret, &step, &recoveryCodes)
+	if err == sql.ErrNoRows || (err == nil && secret.String == "") {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "get two-factor")
+	}
+	newStep, newRecoveryCodes, err := checkTwoFactorCode(secret.String, step, recoveryCodes.String, code, now)
+	if err != nil {
+		return
+	}
+	res, err := db.Exec(bind(`UPDATE `+table+` SET totp_step = ?, recovery_codes = ? WHERE name = ? AND totp_step = ? AND recovery_codes = ?`),
+		newStep, newRecoveryCodes, name, step, recoveryCodes.String)
+	if err != nil {
+		return errors.Wrap(err, "update two-factor")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("two-factor code was already used")
+	}
+	return
+}
+
+// SetTwoFactor enrolls the domain or user in two-factor authentication.
+func (fs *FileSystem) SetTwoFactor(domain, user, secret string, recoveryCodes []string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return setTwoFactor(fs.DB, bindSQLite, domain, user, secret, recoveryCodes)
+}
+
+// HasTwoFactor returns whether the domain or user is enrolled.
+func (fs *FileSystem) HasTwoFactor(domain, user string) (enrolled bool, err error) {
+	return hasTwoFactor(fs.reader, bindSQLite, domain, user)
+}
+
+// CheckTwoFactor checks and uses up the code of the domain or user.
+func (fs *FileSystem) CheckTwoFactor(domain, user, code string, now time.Time) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return checkTwoFactor(fs.DB, bindSQLite, domain, user, code, now)
+}
+
+// SetTwoFactor enrolls the domain or user in two-factor authentication.
+func (pg *Postgres) SetTwoFactor(domain, user, secret string, recoveryCodes []string) (err error) {
+	return setTwoFactor(pg.DB, bindPostgres, domain, user, secret, recoveryCodes)
+}
+
+// HasTwoFactor returns whether the domain or user is enrolled.
+func (pg *Postgres) HasTwoFactor(domain, user string) (enrolled bool, err error) {
+	return hasTwoFactor(pg.DB, bindPostgres, domain, user)
+}
+
+// CheckTwoFactor checks and uses up the code of the domain or user.
+func (pg *Postgres) CheckTwoFactor(domain, user, code string, now time.Time) (err error) {
+	return checkTwoFactor(pg.DB, bindPostgres, domain, user, code, now)
+}
+
+// twoFactor returns the two-factor authentication of the domain or user.
+func (m *Memory) twoFactor(domain, user string) (tf *memoryTwoFactor, err error) {
+	table, name := twoFactorTable(domain, user)
+	if table == "users" {
+		if u, ok := m.users[name]; ok {
+			return &u.memoryTwoFactor, nil
+		}
+		return nil, errors.New("user does not exist")
+	}
+	if d, ok := m.domains[name]; ok {
+		return &d.memoryTwoFactor, nil
+	}
+	return nil, errors.New("domain does not exist")
+}
+
+// SetTwoFactor enrolls the domain or user in two-factor authentication.
+func (m *Memory) SetTwoFactor(domain, user, secret string, recoveryCodes []string) (err error) {
+	if secret != "" {
+		if _, err = utils.TOTPCode(secret, 0); err != nil {
+			return errors.Wrap(err, "bad secret")
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	tf, err := m.twoFactor(domain, user)
+	if err != nil {
+		return
+	}
+	*tf = memoryTwoFactor{totpSecret: secret}
+	if secret != "" {
+		tf.recoveryCodes = hashRecoveryCodes(recoveryCodes)
+	}
+	return
+}
+
+// HasTwoFactor returns whether the domain or user is enrolled.
+func (m *Memory) HasTwoFactor(domain, user string) (enrolled bool, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	tf, _ := m.twoFactor(domain, user)
+	return tf != nil && tf.totpSecret != "", nil
+}
+
+// CheckTwoFactor checks and uses up the code of the domain or user.
+func (m *Memory) CheckTwoFactor(domain, user, code string, now time.Time) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	tf, errMissing := m.twoFactor(domain, user)
+	if errMissing != nil || tf.totpSecret == "" {
+		return nil
+	}
+	tf.totpStep, tf.recoveryCodes, err = checkTwoFactorCode(tf.totpSecret, tf.totpStep, tf.recoveryCodes, code, now)
+	return
+}
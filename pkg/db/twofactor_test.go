@@ -0,0 +1,76 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/schollz/rwtxt/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTwoFactor(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testTwoFactor(t, s)
+		})
+	}
+}
+
+func testTwoFactor(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("work", "secret"))
+	assert.Nil(t, s.CreateUser("alice", "alicepass"))
+	now := time.Unix(1500000000, 0)
+	code := func(secret string, at time.Time) string {
+		c, err := utils.TOTPCode(secret, utils.TOTPStep(at))
+		assert.Nil(t, err)
+		return c
+	}
+
+	// nothing is asked of those who are not enrolled
+	enrolled, err := s.HasTwoFactor("work", "")
+	assert.Nil(t, err)
+	assert.False(t, enrolled)
+	assert.Nil(t, s.CheckTwoFactor("work", "", "", now))
+	assert.Nil(t, s.CheckTwoFactor("nodomain", "", "", now))
+
+	assert.NotNil(t, s.SetTwoFactor("nodomain", "", "GEZDGNBVGY3TQOJQ", nil))
+	assert.NotNil(t, s.SetTwoFactor("work", "nobody", "GEZDGNBVGY3TQOJQ", nil))
+	assert.NotNil(t, s.SetTwoFactor("work", "", "not base32!", nil))
+
+	secret, err := utils.NewTOTPSecret()
+	assert.Nil(t, err)
+	recoveryCodes, err := NewRecoveryCodes()
+	assert.Nil(t, err)
+	assert.Len(t, recoveryCodes, NumRecoveryCodes)
+	assert.Nil(t, s.SetTwoFactor("work", "", secret, recoveryCodes))
+	enrolled, _ = s.HasTwoFactor("WORK", "")
+	assert.True(t, enrolled)
+	enrolled, _ = s.HasTwoFactor("work", "alice")
+	assert.False(t, enrolled, "the user is enrolled separately")
+
+	assert.NotNil(t, s.CheckTwoFactor("work", "", "", now))
+	assert.NotNil(t, s.CheckTwoFactor("work", "", "000000", now))
+	assert.NotNil(t, s.CheckTwoFactor("work", "", code(secret, now.Add(-5*utils.TOTPPeriod)), now))
+	assert.Nil(t, s.CheckTwoFactor("work", "", code(secret, now), now))
+	assert.NotNil(t, s.CheckTwoFactor("work", "", code(secret, now), now), "a code can only be used once")
+	assert.NotNil(t, s.CheckTwoFactor("work", "", code(secret, now.Add(-utils.TOTPPeriod)), now), "nor can an older one")
+	later := now.Add(utils.TOTPPeriod)
+	assert.Nil(t, s.CheckTwoFactor("work", "", code(secret, later), later))
+
+	// recovery codes work once each, however they are typed
+	assert.Nil(t, s.CheckTwoFactor("work", "", recoveryCodes[0], now))
+	assert.NotNil(t, s.CheckTwoFactor("work", "", recoveryCodes[0], now))
+	assert.Nil(t, s.CheckTwoFactor("work", "", " "+recoveryCodes[1][:5]+recoveryCodes[1][6:]+" ", now))
+
+	// users have their own secret
+	userSecret, _ := utils.NewTOTPSecret()
+	assert.Nil(t, s.SetTwoFactor("", "Alice", userSecret, recoveryCodes))
+	assert.NotNil(t, s.CheckTwoFactor("work", "alice", code(secret, now.Add(2*utils.TOTPPeriod)), now.Add(2*utils.TOTPPeriod)))
+	assert.Nil(t, s.CheckTwoFactor("work", "alice", code(userSecret, now), now))
+	assert.Nil(t, s.CheckTwoFactor("work", "alice", recoveryCodes[0], now), "recovery codes are separate too")
+
+	assert.Nil(t, s.SetTwoFactor("work", "", "", nil))
+	enrolled, _ = s.HasTwoFactor("work", "")
+	assert.False(t, enrolled)
+	assert.Nil(t, s.CheckTwoFactor("work", "", "", now))
+}
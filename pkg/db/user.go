@@ -0,0 +1,551 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/rwtxt/pkg/utils"
+)
+
+// Role is what a member may do in a domain.
+type Role string
+
+const (
+	// RoleReader may view a private domain.
+	RoleReader Role = "reader"
+	// RoleEditor may also write pages.
+	RoleEditor Role = "editor"
+	// RoleAdmin may also change the options, the password and the members of
+	// the domain.
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{RoleReader: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// ParseRole returns the role named s.
+func ParseRole(s string) (role Role, err error) {
+	role = Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRanks[role]; !ok {
+		err = errors.New("role must be reader, editor or admin")
+	}
+	return
+}
+
+// Allows returns whether the role includes need. The empty role allows
+// nothing.
+func (r Role) Allows(need Role) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[need]
+}
+
+// Scope returns the API scope that matches the role.
+func (r Role) Scope() Scope {
+	switch r {
+	case RoleReader:
+		return ScopeRead
+	case RoleEditor:
+		return ScopeWrite
+	case RoleAdmin:
+		return ScopeAdmin
+	}
+	return ""
+}
+
+// Key is a session handed out when signing in to a domain.
+type Key struct {
+	DomainID int
+	Domain   string
+	// User is empty for sessions from the shared password of the domain,
+	// which are admins, or from its reader password.
+	User string
+	Role Role
+}
+
+// Membership is the role of a user in a domain.
+type Membership struct {
+	User string
+	Role Role
+}
+
+// UserStore manages users and their memberships of domains. Users sign in to
+// a domain they are a member of with their own password, next to the shared
+// password of the domain unless its NoSharedPassword option is set.
+type UserStore interface {
+	// CreateUser adds a user, returning an error if the name is taken.
+	CreateUser(name, password string) error
+	// SetUserPassword changes the password of a user, and signs them out
+	// of every domain.
+	SetUserPassword(name, password string) error
+	// SetMembership gives the user the role in the domain, or removes them
+	// from the domain if role is empty.
+	SetMembership(domain, user string, role Role) error
+	// GetMemberships returns the members of a domain, sorted by name.
+	GetMemberships(domain string) ([]Membership, error)
+	// SetUserKey returns a new key for the user in the domain if the
+	// password is correct and they are a member.
+	SetUserKey(domain, user, password string) (key string, err error)
+}
+
+// checkNewUser validates the name and password of a user to be created.
+func checkNewUser(name, password string) (err error) {
+	if name == "" || strings.ContainsAny(name, " \t\n,/") {
+		return errors.New("user name can not be empty or contain spaces, commas or slashes")
+	}
+	if password == "" {
+		return errors.New("password can not be empty")
+	}
+	return
+}
+
+// roleOfKey returns the role of a session: that of the membership of its
+// user, or else the role it was given by the shared or reader password,
+// unless the domain no longer allows those.
+func roleOfKey(user string, keyRole, role sql.NullString, options DomainOptions) (Role, error) {
+	if user == "" {
+		if options.NoSharedPassword {
+			return "", errors.New("domain does not allow the shared password")
+		}
+		if keyRole.String != "" {
+			return Role(keyRole.String), nil
+		}
+		return RoleAdmin, nil
+	}
+	if !role.Valid {
+		return "", errors.New("user is no longer a member of the domain")
+	}
+	return Role(role.String), nil
+}
+
+// CreateUser adds a user.
+func (fs *FileSystem) CreateUser(name, password string) (err error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if err = checkNewUser(name, password); err != nil {
+		return
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	var n int
+	err = fs.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE name = ?`, name).Scan(&n)
+	if err != nil {
+		return errors.Wrap(err, "get user")
+	}
+	if n > 0 {
+		return errors.New("user already exists")
+	}
+	_, err = fs.DB.Exec(`INSERT INTO users (name, hashed_pass, created) VALUES (?,?,?)`, name, hashedPassword, time.Now().UTC())
+	if err != nil {
+		err = errors.Wrap(err, "insert user")
+	}
+	return
+}
+
+// SetUserPassword changes the password of a user, and signs them out.
+func (fs *FileSystem) SetUserPassword(name, password string) (err error) {
+	if password == "" {
+		return errors.New("password can not be empty")
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin SetUserPassword")
+	}
+	defer tx.Rollback()
+	err = setUserPassword(tx, bindSQLite, name, hashedPassword)
+	if err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit SetUserPassword")
+}
+
+// setUserPassword stores the new hash of the password of the user, and signs
+// them out of every domain.
+func setUserPassword(tx *sql.Tx, bind func(string) string, name, hashedPassword string) (err error) {
+	var userid int
+	err = tx.QueryRow(bind(`SELECT id FROM users WHERE name = ?`), strings.ToLower(strings.TrimSpace(name))).Scan(&userid)
+	if err == sql.ErrNoRows {
+		return errors.New("user does not exist")
+	} else if err != nil {
+		return errors.Wrap(err, "get user")
+	}
+	_, err = tx.Exec(bind(`UPDATE users SET hashed_pass = ? WHERE id = ?`), hashedPassword, userid)
+	if err != nil {
+		return errors.Wrap(err, "update user")
+	}
+	_, err = tx.Exec(bind(`DELETE FROM keys WHERE userid = ?`), userid)
+	return errors.Wrap(err, "delete keys")
+}
+
+// SetMembership gives the user the role in the domain, or removes them.
+func (fs *FileSystem) SetMembership(domain, user string, role Role) (err error) {
+	if role != "" {
+		if _, err = ParseRole(string(role)); err != nil {
+			return
+		}
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin SetMembership")
+	}
+	defer tx.Rollback()
+	err = setMembership(tx, bindSQLite, domain, user, role)
+	if err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit SetMembership")
+}
+
+func setMembership(tx *sql.Tx, bind func(string) string, domain, user string, role Role) (err error) {
+	var domainid, userid int
+	err = tx.QueryRow(bind(`SELECT id FROM domains WHERE name = ?`), strings.ToLower(domain)).Scan(&domainid)
+	if err == sql.ErrNoRows {
+		return errors.New("domain does not exist")
+	} else if err != nil {
+		return errors.Wrap(err, "get domain")
+	}
+	err = tx.QueryRow(bind(`SELECT id FROM users WHERE name = ?`), strings.ToLower(strings.TrimSpace(user))).Scan(&userid)
+	if err == sql.ErrNoRows {
+		return errors.New("user does not exist")
+	} else if err != nil {
+		return errors.Wrap(err, "get user")
+	}
+	_, err = tx.Exec(bind(`DELETE FROM memberships WHERE domainid = ? AND userid = ?`), domainid, userid)
+	if err != nil {
+		return errors.Wrap(err, "delete membership")
+	}
+	if role == "" {
+		// sign them out of the domain too
+		_, err = tx.Exec(bind(`DELETE FROM keys WHERE domainid = ? AND userid = ?`), domainid, userid)
+		return errors.Wrap(err, "delete keys")
+	}
+	_, err = tx.Exec(bind(`INSERT INTO memberships (domainid, userid, role) VALUES (?,?,?)`), domainid, userid, string(role))
+	return errors.Wrap(err, "insert membership")
+}
+
+// GetMemberships returns the members of a domain.
+func (fs *FileSystem) GetMemberships(domain string) (memberships []Membership, err error) {
+	return getMemberships(fs.reader, bindSQLite, domain)
+}
+
+func getMemberships(db queryer, bind func(string) string, domain string) (memberships []Membership, err error) {
+	stmt, err := db.Prepare(bind(`SELECT users.name, memberships.role FROM memberships
+		INNER JOIN users ON memberships.userid = users.id
+		INNER JOIN domains ON memberships.domainid = domains.id
+		WHERE domains.name = ? ORDER BY users.name`))
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing memberships")
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(strings.ToLower(domain))
+	if err != nil {
+		return nil, errors.Wrap(err, "get memberships")
+	}
+	defer rows.Close()
+	memberships = []Membership{}
+	for rows.Next() {
+		var m Membership
+		var role string
+		err = rows.Scan(&m.User, &role)
+		if err != nil {
+			return nil, errors.Wrap(err, "get memberships")
+		}
+		m.Role = Role(role)
+		memberships = append(memberships, m)
+	}
+	err = rows.Err()
+	return
+}
+
+// SetUserKey returns a new key for the user in the domain.
+func (fs *FileSystem) SetUserKey(domain, user, password string) (key string, err error) {
+	// check the password before locking, as bcrypt is slow
+	domainid, userid, err := validateUser(fs.reader, bindSQLite, domain, user, password)
+	if err != nil {
+		return
+	}
+	key, hash, err := newKey()
+	if err != nil {
+		return
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	now := time.Now().UTC()
+	_, err = fs.DB.Exec(`INSERT INTO keys (domainid, userid, key, created, lastused) VALUES (?,?,?,?,?)`, domainid, userid, hash, now, now)
+	if err != nil {
+		err = errors.Wrap(err, "insert key")
+	}
+	return
+}
+
+// validateUser returns the ids of the domain and the user if the password is
+// correct and the user is a member of the domain.
+func validateUser(db queryer, bind func(string) string, domain, user, password string) (domainid, userid int, err error) {
+	stmt, err := db.Prepare(bind(`SELECT domains.id, users.id, users.hashed_pass FROM memberships
+		INNER JOIN users ON memberships.userid = users.id
+		INNER JOIN domains ON memberships.domainid = domains.id
+		WHERE domains.name = ? AND users.name = ?`))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "preparing user")
+	}
+	defer stmt.Close()
+	var hashedPassword string
+	err = stmt.QueryRow(strings.ToLower(domain), strings.ToLower(strings.TrimSpace(user))).Scan(&domainid, &userid, &hashedPassword)
+	if err == sql.ErrNoRows {
+		return 0, 0, errors.New("incorrect user or password to log into domain")
+	} else if err != nil {
+		return 0, 0, errors.Wrap(err, "get user")
+	}
+	if utils.CheckPasswordHash(hashedPassword, password) != nil {
+		return 0, 0, errors.New("incorrect user or password to log into domain")
+	}
+	return
+}
+
+// getKey returns the session with the key, see KeyStore.GetKey.
+func getKey(db queryer, bind func(string) string, key string) (k Key, err error) {
+	stmt, err := db.Prepare(bind(`SELECT domains.id, domains.name, domains.options, keys.key, keys.role, users.name, memberships.role
+		FROM keys
+		INNER JOIN domains ON keys.domainid = domains.id
+		LEFT JOIN users ON keys.userid = users.id
+		LEFT JOIN memberships ON memberships.domainid = keys.domainid AND memberships.userid = keys.userid
+		WHERE keys.key = ?`))
+	if err != nil {
+		return k, errors.Wrap(err, "preparing key")
+	}
+	defer stmt.Close()
+	hash := hashKey(key)
+	var stored string
+	var options []byte
+	var keyRole, user, role sql.NullString
+	err = stmt.QueryRow(hash).Scan(&k.DomainID, &k.Domain, &options, &stored, &keyRole, &user, &role)
+	if err != nil {
+		return
+	}
+	if k.Domain == "" || !sameHash(stored, hash) {
+		return k, errors.New("no such key")
+	}
+	var domainOptions DomainOptions
+	json.Unmarshal(options, &domainOptions)
+	k.User = user.String
+	k.Role, err = roleOfKey(k.User, keyRole, role, domainOptions)
+	return
+}
+
+// CreateUser adds a user.
+func (pg *Postgres) CreateUser(name, password string) (err error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if err = checkNewUser(name, password); err != nil {
+		return
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	res, err := pg.exec(`INSERT INTO users (name, hashed_pass, created) VALUES (?,?,?) ON CONFLICT (name) DO NOTHING`,
+		name, hashedPassword, time.Now().UTC())
+	if err != nil {
+		return errors.Wrap(err, "insert user")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("user already exists")
+	}
+	return
+}
+
+// SetUserPassword changes the password of a user, and signs them out.
+func (pg *Postgres) SetUserPassword(name, password string) (err error) {
+	if password == "" {
+		return errors.New("password can not be empty")
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin SetUserPassword")
+	}
+	defer tx.Rollback()
+	err = setUserPassword(tx, bindPostgres, name, hashedPassword)
+	if err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit SetUserPassword")
+}
+
+// SetMembership gives the user the role in the domain, or removes them.
+func (pg *Postgres) SetMembership(domain, user string, role Role) (err error) {
+	if role != "" {
+		if _, err = ParseRole(string(role)); err != nil {
+			return
+		}
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin SetMembership")
+	}
+	defer tx.Rollback()
+	err = setMembership(tx, bindPostgres, domain, user, role)
+	if err != nil {
+		return
+	}
+	return errors.Wrap(tx.Commit(), "commit SetMembership")
+}
+
+// GetMemberships returns the members of a domain.
+func (pg *Postgres) GetMemberships(domain string) (memberships []Membership, err error) {
+	return getMemberships(pg.DB, bindPostgres, domain)
+}
+
+// SetUserKey returns a new key for the user in the domain.
+func (pg *Postgres) SetUserKey(domain, user, password string) (key string, err error) {
+	domainid, userid, err := validateUser(pg.DB, bindPostgres, domain, user, password)
+	if err != nil {
+		return
+	}
+	key, hash, err := newKey()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	_, err = pg.exec(`INSERT INTO keys (domainid, userid, key, created, lastused) VALUES (?,?,?,?,?)`, domainid, userid, hash, now, now)
+	if err != nil {
+		err = errors.Wrap(err, "insert key")
+	}
+	return
+}
+
+// CreateUser adds a user.
+func (m *Memory) CreateUser(name, password string) (err error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if err = checkNewUser(name, password); err != nil {
+		return
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.users[name]; ok {
+		return errors.New("user already exists")
+	}
+	m.users[name] = &memoryUser{id: len(m.users) + 1, name: name, hashedPassword: hashedPassword}
+	return
+}
+
+// SetUserPassword changes the password of a user, and signs them out.
+func (m *Memory) SetUserPassword(name, password string) (err error) {
+	if password == "" {
+		return errors.New("password can not be empty")
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "can't hash password")
+	}
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return errors.New("user does not exist")
+	}
+	u.hashedPassword = hashedPassword
+	// sign them out of every domain
+	for hash, k := range m.keys {
+		if k.userid == u.id {
+			delete(m.keys, hash)
+		}
+	}
+	return
+}
+
+// SetMembership gives the user the role in the domain, or removes them.
+func (m *Memory) SetMembership(domain, user string, role Role) (err error) {
+	if role != "" {
+		if _, err = ParseRole(string(role)); err != nil {
+			return
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return errors.New("domain does not exist")
+	}
+	u, ok := m.users[strings.ToLower(strings.TrimSpace(user))]
+	if !ok {
+		return errors.New("user does not exist")
+	}
+	if role == "" {
+		delete(d.members, u.id)
+		for hash, k := range m.keys {
+			if k.domainid == d.id && k.userid == u.id {
+				delete(m.keys, hash)
+			}
+		}
+		return
+	}
+	d.members[u.id] = role
+	return
+}
+
+// GetMemberships returns the members of a domain.
+func (m *Memory) GetMemberships(domain string) (memberships []Membership, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	memberships = []Membership{}
+	d, ok := m.domains[strings.ToLower(domain)]
+	if !ok {
+		return
+	}
+	for _, u := range m.users {
+		if role, ok := d.members[u.id]; ok {
+			memberships = append(memberships, Membership{User: u.name, Role: role})
+		}
+	}
+	sort.Slice(memberships, func(i, j int) bool {
+		return memberships[i].User < memberships[j].User
+	})
+	return
+}
+
+// SetUserKey returns a new key for the user in the domain.
+func (m *Memory) SetUserKey(domain, user, password string) (key string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	domainid, userid, err := m.validateUser(domain, user, password)
+	if err != nil {
+		return
+	}
+	key, hash, err := newKey()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	m.keys[hash] = &memoryKey{domainid: domainid, userid: userid, created: now, lastused: now}
+	return
+}
+
+// validateUser returns the ids of the domain and the user if the password is
+// correct and the user is a member of the domain.
+func (m *Memory) validateUser(domain, user, password string) (domainid, userid int, err error) {
+	d, okDomain := m.domains[strings.ToLower(domain)]
+	u, okUser := m.users[strings.ToLower(strings.TrimSpace(user))]
+	if !okDomain || !okUser || d.members[u.id] == "" || utils.CheckPasswordHash(u.hashedPassword, password) != nil {
+		return 0, 0, errors.New("incorrect user or password to log into domain")
+	}
+	return d.id, u.id, nil
+}
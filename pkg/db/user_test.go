@@ -0,0 +1,103 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsers(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testUsers(t, s)
+		})
+	}
+}
+
+func testUsers(t *testing.T, s Store) {
+	assert.Nil(t, s.SetDomain("team", "secret"))
+	assert.Nil(t, s.SetDomain("other", "secret"))
+
+	assert.NotNil(t, s.CreateUser("", "pass"))
+	assert.NotNil(t, s.CreateUser("al ice", "pass"))
+	assert.NotNil(t, s.CreateUser("alice", ""))
+	assert.Nil(t, s.CreateUser("Alice", "pass"))
+	assert.NotNil(t, s.CreateUser("alice", "other"), "names are unique")
+	assert.Nil(t, s.CreateUser("bob", "pass"))
+
+	// users can only sign in to domains they are a member of
+	_, err := s.SetUserKey("team", "alice", "pass")
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.SetMembership("team", "alice", Role("owner")))
+	assert.NotNil(t, s.SetMembership("nodomain", "alice", RoleEditor))
+	assert.NotNil(t, s.SetMembership("team", "nobody", RoleEditor))
+	assert.Nil(t, s.SetMembership("team", "alice", RoleEditor))
+	assert.Nil(t, s.SetMembership("team", "bob", RoleReader))
+	_, err = s.SetUserKey("team", "alice", "wrong")
+	assert.NotNil(t, err)
+	_, err = s.SetUserKey("other", "alice", "pass")
+	assert.NotNil(t, err)
+	key, err := s.SetUserKey("team", "alice", "pass")
+	assert.Nil(t, err)
+	k, err := s.GetKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, Key{DomainID: k.DomainID, Domain: "team", User: "alice", Role: RoleEditor}, k)
+
+	memberships, err := s.GetMemberships("team")
+	assert.Nil(t, err)
+	assert.Equal(t, []Membership{{"alice", RoleEditor}, {"bob", RoleReader}}, memberships)
+
+	// roles take effect on existing sessions
+	assert.Nil(t, s.SetMembership("team", "alice", RoleAdmin))
+	k, err = s.GetKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, RoleAdmin, k.Role)
+
+	// changing the password signs them out
+	assert.Nil(t, s.SetUserPassword("alice", "new"))
+	assert.NotNil(t, s.SetUserPassword("nobody", "new"))
+	_, _, err = s.CheckKey(key)
+	assert.NotNil(t, err)
+	_, err = s.SetUserKey("team", "alice", "pass")
+	assert.NotNil(t, err)
+	key, err = s.SetUserKey("team", "alice", "new")
+	assert.Nil(t, err)
+
+	// removing a member signs them out
+	assert.Nil(t, s.SetMembership("team", "alice", ""))
+	_, err = s.GetKey(key)
+	assert.NotNil(t, err)
+	_, _, err = s.CheckKey(key)
+	assert.NotNil(t, err)
+	memberships, err = s.GetMemberships("team")
+	assert.Nil(t, err)
+	assert.Len(t, memberships, 1)
+
+	// the shared password makes admins, until it is disabled
+	shared, err := s.SetKey("team", "secret")
+	assert.Nil(t, err)
+	k, err = s.GetKey(shared)
+	assert.Nil(t, err)
+	assert.Equal(t, "", k.User)
+	assert.Equal(t, RoleAdmin, k.Role)
+	assert.Nil(t, s.UpdateDomain("team", "", false, DomainOptions{NoSharedPassword: true}))
+	_, err = s.GetKey(shared)
+	assert.NotNil(t, err)
+	_, err = s.SetKey("team", "secret")
+	assert.NotNil(t, err)
+	_, err = s.SetUserKey("team", "bob", "pass")
+	assert.Nil(t, err)
+}
+
+func TestRoles(t *testing.T) {
+	assert.True(t, RoleAdmin.Allows(RoleEditor))
+	assert.True(t, RoleEditor.Allows(RoleEditor))
+	assert.False(t, RoleReader.Allows(RoleEditor))
+	assert.False(t, Role("").Allows(RoleReader))
+	assert.Equal(t, ScopeWrite, RoleEditor.Scope())
+	role, err := ParseRole(" Editor ")
+	assert.Nil(t, err)
+	assert.Equal(t, RoleEditor, role)
+	_, err = ParseRole("owner")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTPPeriod is how long a TOTP code is valid for.
+const TOTPPeriod = 30 * time.Second
+
+// TOTPDigits is how many digits a TOTP code has.
+const TOTPDigits = 6
+
+// TOTPSkew is how many periods before and after the current one a code is
+// still accepted from, to allow for clocks that are off a little.
+const TOTPSkew = 1
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 encoded secret for TOTP (RFC 6238),
+// in the form authenticator apps expect.
+func NewTOTPSecret() (secret string, err error) {
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPStep returns the number of the period that t falls into.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// TOTPCode returns the code of the secret for the period step, using
+// HMAC-SHA1 as RFC 6238 does by default.
+func TOTPCode(secret string, step int64) (code string, err error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
+
+// CheckTOTP returns the period step of the code if it is valid for the secret
+// at time t, or -1 if it is not. Callers should refuse steps that were
+// already used, so that a code can not be replayed.
+func CheckTOTP(secret, code string, t time.Time) (step int64) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != TOTPDigits {
+		return -1
+	}
+	now := TOTPStep(t)
+	for step = now - TOTPSkew; step <= now+TOTPSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return -1
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return
+		}
+	}
+	return -1
+}
+
+// TOTPURL returns the otpauth:// URL that authenticator apps read from a QR
+// code to add the secret.
+func TOTPURL(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
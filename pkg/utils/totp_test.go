@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfc6238Secret is the SHA1 secret of the test vectors in RFC 6238,
+// "12345678901234567890" in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// the last six digits of the eight digit codes in the RFC
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(unix, 0)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, code, unix)
+	}
+	_, err := TOTPCode("not base32!", 1)
+	assert.NotNil(t, err)
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, _ := TOTPCode(rfc6238Secret, TOTPStep(now))
+	assert.Equal(t, TOTPStep(now), CheckTOTP(rfc6238Secret, code, now))
+	assert.Equal(t, TOTPStep(now), CheckTOTP(rfc6238Secret, code[:3]+" "+code[3:], now))
+
+	// a clock that is off by a period is fine, more is not
+	assert.Equal(t, TOTPStep(now), CheckTOTP(rfc6238Secret, code, now.Add(TOTPPeriod)))
+	assert.Equal(t, TOTPStep(now), CheckTOTP(rfc6238Secret, code, now.Add(-TOTPPeriod)))
+	assert.Equal(t, int64(-1), CheckTOTP(rfc6238Secret, code, now.Add(3*TOTPPeriod)))
+
+	assert.Equal(t, int64(-1), CheckTOTP(rfc6238Secret, "000000", now))
+	assert.Equal(t, int64(-1), CheckTOTP(rfc6238Secret, "", now))
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, 32)
+	other, _ := NewTOTPSecret()
+	assert.NotEqual(t, secret, other)
+	_, err = TOTPCode(secret, 1)
+	assert.Nil(t, err)
+
+	u := TOTPURL("rwtxt", "notes", secret)
+	assert.True(t, strings.HasPrefix(u, "otpauth://totp/rwtxt:notes?"))
+	assert.Contains(t, u, "secret="+secret)
+}
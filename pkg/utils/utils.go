@@ -14,6 +14,7 @@ import (
 
 	"github.com/microcosm-cc/bluemonday"
 	blackfriday "github.com/russross/blackfriday/v2"
+	"github.com/sergi/go-diff/diffmatchpatch"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -92,6 +93,27 @@ func RenderMarkdownToHTML(markdown string) template.HTML {
 	return template.HTML(html)
 }
 
+// RenderDiffToHTML renders the changes between two texts, with removed text in
+// <del> and added text in <ins>. The changes are grouped into whole words
+// where possible, so they are easy to read.
+func RenderDiffToHTML(from, to string) template.HTML {
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffCleanupSemantic(dmp.DiffMain(from, to, true))
+	var html strings.Builder
+	for _, diff := range diffs {
+		text := template.HTMLEscapeString(diff.Text)
+		switch diff.Type {
+		case diffmatchpatch.DiffInsert:
+			html.WriteString("<ins>" + text + "</ins>")
+		case diffmatchpatch.DiffDelete:
+			html.WriteString("<del>" + text + "</del>")
+		default:
+			html.WriteString(text)
+		}
+	}
+	return template.HTML(html.String())
+}
+
 var src = rand.NewSource(time.Now().UTC().UnixNano())
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
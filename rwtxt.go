@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"time"
@@ -22,47 +23,90 @@ var pbclean = bluemonday.UGCPolicy()
 
 const DefaultBind = ":8152"
 
+// DefaultTrashRetention is how long emptied pages stay in the trash before
+// they are deleted for good.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// DefaultBackupDir is where backups of the database are written.
+const DefaultBackupDir = "backups"
+
 type RWTxt struct {
-	Config           Config
-	viewEditTemplate *template.Template
-	mainTemplate     *template.Template
-	loginTemplate    *template.Template
-	listTemplate     *template.Template
-	prismTemplate    []string
-	fs               *db.FileSystem
-	wsupgrader       websocket.Upgrader
+	Config            Config
+	viewEditTemplate  *template.Template
+	mainTemplate      *template.Template
+	loginTemplate     *template.Template
+	listTemplate      *template.Template
+	trashTemplate     *template.Template
+	historyTemplate   *template.Template
+	tokensTemplate    *template.Template
+	membersTemplate   *template.Template
+	sharesTemplate    *template.Template
+	twoFactorTemplate *template.Template
+	auditTemplate     *template.Template
+	sessionsTemplate  *template.Template
+	prismTemplate     []string
+	fs                db.Store
+	wsupgrader        websocket.Upgrader
+	logins            *loginLimiter
+	now               func() time.Time // the clock logins are throttled and checked by
 }
 
 type Config struct {
-	Bind            string // interface:port to listen on, defaults to DefaultBind.
-	Private         bool
-	ResizeWidth     int
-	ResizeOnUpload  bool
-	ResizeOnRequest bool
-	OrderByCreated  bool
+	Bind                 string // interface:port to listen on, defaults to DefaultBind.
+	Private              bool
+	ResizeWidth          int
+	ResizeOnUpload       bool
+	ResizeOnRequest      bool
+	OrderByCreated       bool
+	TrashRetention       time.Duration   // how long emptied pages are kept, defaults to DefaultTrashRetention.
+	BackupDir            string          // where backups are written, defaults to DefaultBackupDir.
+	Backups              db.BackupPolicy // which backups are kept, defaults to db.DefaultBackupPolicy.
+	NoSignup             bool            // whether domains can only be created with the domain command, not by logging in.
+	LoginLockout         int             // failed logins in a row before a lockout, defaults to DefaultLoginLockout.
+	LoginLockoutDuration time.Duration   // how long a lockout lasts, defaults to DefaultLoginLockoutDuration.
+	Origins              []string        // origins, like https://notes.example.com, that may open websockets besides rwtxt itself.
+	TrustProxy           bool            // whether the address of a request is taken from the X-Forwarded-For header of a proxy in front of rwtxt.
 }
 
-func New(fs *db.FileSystem, configUser ...Config) (*RWTxt, error) {
+// New returns a server for the store. Use db.New for the default SQLite
+// store or db.NewMemory for a store that is not persisted.
+func New(fs db.Store, configUser ...Config) (*RWTxt, error) {
 	config := Config{
 		Bind: ":8152",
 	}
 	if len(configUser) > 0 {
 		config = configUser[0]
 	}
+	if config.TrashRetention == 0 {
+		config.TrashRetention = DefaultTrashRetention
+	}
+	if config.BackupDir == "" {
+		config.BackupDir = DefaultBackupDir
+	}
+	if config.Backups == (db.BackupPolicy{}) {
+		config.Backups = db.DefaultBackupPolicy
+	}
+	if config.LoginLockout == 0 {
+		config.LoginLockout = DefaultLoginLockout
+	}
+	if config.LoginLockoutDuration == 0 {
+		config.LoginLockoutDuration = DefaultLoginLockoutDuration
+	}
 	rwt := &RWTxt{
 		Config: config,
 		fs:     fs,
+		logins: newLoginLimiter(config.LoginLockout, config.LoginLockoutDuration),
+		now:    time.Now,
 		wsupgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
 		},
 	}
+	rwt.wsupgrader.CheckOrigin = rwt.checkOrigin
 
 	funcMap := template.FuncMap{
 		"replace": replace,
+		"inc":     inc,
 	}
 
 	var err error
@@ -89,10 +133,74 @@ func New(fs *db.FileSystem, configUser ...Config) (*RWTxt, error) {
 	if err != nil {
 		return nil, err
 	}
-	rwt.listTemplate = template.Must(template.New("list").Parse(string(b)))
+	rwt.listTemplate = template.Must(template.New("list").Funcs(funcMap).Parse(string(b)))
 
 	err = templateAssets(headerFooter, rwt.listTemplate)
 
+	b, err = Asset("assets/trash.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.trashTemplate = template.Must(template.New("trash").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.trashTemplate)
+
+	b, err = Asset("assets/history.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.historyTemplate = template.Must(template.New("history").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.historyTemplate)
+
+	b, err = Asset("assets/tokens.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.tokensTemplate = template.Must(template.New("tokens").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.tokensTemplate)
+
+	b, err = Asset("assets/members.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.membersTemplate = template.Must(template.New("members").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.membersTemplate)
+
+	b, err = Asset("assets/shares.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.sharesTemplate = template.Must(template.New("shares").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.sharesTemplate)
+
+	b, err = Asset("assets/twofactor.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.twoFactorTemplate = template.Must(template.New("twofactor").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.twoFactorTemplate)
+
+	b, err = Asset("assets/audit.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.auditTemplate = template.Must(template.New("audit").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.auditTemplate)
+
+	b, err = Asset("assets/sessions.html")
+	if err != nil {
+		return nil, err
+	}
+	rwt.sessionsTemplate = template.Must(template.New("sessions").Parse(string(b)))
+
+	err = templateAssets(headerFooter, rwt.sessionsTemplate)
+
 	b, err = Asset("assets/prism.js")
 	if err != nil {
 		return nil, err
@@ -102,6 +210,27 @@ func New(fs *db.FileSystem, configUser ...Config) (*RWTxt, error) {
 	return rwt, err
 }
 
+// checkOrigin returns whether a page at the origin of the request may open a
+// websocket: a page of rwtxt itself, or one of Config.Origins. Requests that
+// do not come from a browser have no origin, and are let through.
+func (rwt *RWTxt) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range rwt.Config.Origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	log.Infof("refused websocket from %s", origin)
+	return false
+}
+
 func templateAssets(s []string, t *template.Template) error {
 	for _, asset := range s {
 		b, err := Asset(asset)
@@ -117,6 +246,7 @@ func templateAssets(s []string, t *template.Template) error {
 func (rwt *RWTxt) Serve() (err error) {
 	go func() {
 		lastDumped := time.Now().UTC()
+		var lastCompacted time.Time
 		for {
 			time.Sleep(120 * time.Second)
 			lastModified, errGet := rwt.fs.LastModified()
@@ -129,9 +259,26 @@ func (rwt *RWTxt) Serve() (err error) {
 				if errDelete != nil {
 					log.Error(errDelete)
 				}
-				errDump := rwt.fs.DumpSQL()
-				if errDump != nil {
-					log.Error(errDump)
+				errDelete = rwt.fs.DeleteEmpty()
+				if errDelete != nil {
+					log.Error(errDelete)
+				}
+				errDelete = rwt.fs.PurgeTrash(time.Now().UTC().Add(-rwt.Config.TrashRetention))
+				if errDelete != nil {
+					log.Error(errDelete)
+				}
+				// compaction reads every history, so only do it hourly
+				if compactor, ok := rwt.fs.(db.Compactor); ok && time.Since(lastCompacted) > time.Hour {
+					pages, revisions, errCompact := compactor.Compact(time.Now().UTC())
+					if errCompact != nil {
+						log.Error(errCompact)
+					} else if pages > 0 {
+						log.Infof("compacted the history of %d pages, removing %d revisions", pages, revisions)
+					}
+					lastCompacted = time.Now().UTC()
+				}
+				if backuper, ok := rwt.fs.(db.Backuper); ok {
+					rwt.backup(backuper)
 				}
 				lastDumped = time.Now().UTC()
 			}
@@ -142,6 +289,24 @@ func (rwt *RWTxt) Serve() (err error) {
 	return http.ListenAndServe(rwt.Config.Bind, nil)
 }
 
+// backup writes a new backup and removes the ones the policy no longer keeps.
+// Old backups are only pruned after a new one was written successfully.
+func (rwt *RWTxt) backup(backuper db.Backuper) {
+	b, err := backuper.Backup(rwt.Config.BackupDir)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Debugf("wrote %s", b.Path)
+	removed, err := db.PruneBackups(rwt.Config.BackupDir, b.Name, rwt.Config.Backups)
+	if err != nil {
+		log.Error(err)
+	}
+	for _, old := range removed {
+		log.Debugf("removed %s", old.Path)
+	}
+}
+
 func (rwt *RWTxt) isSignedIn(w http.ResponseWriter, r *http.Request, domain string) (signedin bool, domainkey string, defaultDomain string, domainList []string, domainKeys map[string]string) {
 	domainKeys, defaultDomain = rwt.getDomainListCookie(w, r)
 	domainList = make([]string, len(domainKeys))
@@ -158,17 +323,26 @@ func (rwt *RWTxt) isSignedIn(w http.ResponseWriter, r *http.Request, domain stri
 	return
 }
 
+// keyIDs returns the ids of the keys, which can be logged without giving
+// away the sessions.
+func keyIDs(keys []string) (ids []string) {
+	for _, key := range keys {
+		ids = append(ids, db.KeyID(key))
+	}
+	return
+}
+
 func (rwt *RWTxt) getDomainListCookie(w http.ResponseWriter, r *http.Request) (domainKeys map[string]string, defaultDomain string) {
 	startTime := time.Now().UTC()
 	domainKeys = make(map[string]string)
 	cookie, cookieErr := r.Cookie("rwtxt-domains")
 	keysToUpdate := []string{}
 	if cookieErr == nil {
-		log.Debugf("got cookie: %s", cookie.Value)
+		log.Debugf("got cookie: %v", keyIDs(strings.Split(cookie.Value, ",")))
 		for _, key := range strings.Split(cookie.Value, ",") {
 			startTime2 := time.Now().UTC()
 			_, domainName, domainErr := rwt.fs.CheckKey(key)
-			log.Debugf("checked key: %s [%s]", key, time.Since(startTime2))
+			log.Debugf("checked key: %s [%s]", db.KeyID(key), time.Since(startTime2))
 			if domainErr == nil && domainName != "" {
 				if defaultDomain == "" {
 					defaultDomain = domainName
@@ -182,7 +356,7 @@ func (rwt *RWTxt) getDomainListCookie(w http.ResponseWriter, r *http.Request) (d
 	if defaultDomain == "" {
 		defaultDomain = "public"
 	}
-	log.Debugf("logged in domains: %+v [%s]", domainKeys, time.Since(startTime))
+	log.Debugf("logged in domains: %d [%s]", len(domainKeys), time.Since(startTime))
 	go func() {
 		if err := rwt.fs.UpdateKeys(keysToUpdate); err != nil {
 			log.Debug(err)
@@ -217,6 +391,9 @@ Disallow: /`))
 	} else if strings.HasPrefix(r.URL.Path, "/static") {
 		// special path /static
 		return rwt.handleStatic(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/api/") {
+		// special path /api
+		return rwt.handleAPI(w, r)
 	}
 
 	fields := strings.Split(pbclean.Sanitize(r.URL.Path), "/")
@@ -231,6 +408,14 @@ Disallow: /`))
 	}
 
 	tr.SignedIn, tr.DomainKey, tr.DefaultDomain, tr.DomainList, tr.DomainKeys = rwt.isSignedIn(w, r, tr.Domain)
+	tr.setRole()
+
+	// forms that change something have to come from a page of rwtxt
+	tr.CSRFToken = csrfToken(w, r)
+	if r.Method == "POST" && !checkCSRF(r) {
+		http.Error(w, "the form has expired, reload the page and try again", http.StatusForbidden)
+		return
+	}
 
 	// get browser local time
 	tr.getUTCOffsetFromCookie(r)
@@ -254,9 +439,20 @@ Disallow: /`))
 		// special path /upload
 		return tr.handleUpload(w, r)
 	} else if tr.Page == "new" {
-		// special path /upload
+		// special path /{domain}/new, which creates a page in the default
+		// domain
+		tr.Domain = tr.DefaultDomain
+		tr.DomainKey = tr.DomainKeys[tr.Domain]
+		tr.setRole()
+		if !tr.CanEdit() {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an editor")), 302)
+			return
+		}
 		http.Redirect(w, r, "/"+tr.DefaultDomain+"/"+rwt.createPage(tr.DefaultDomain).ID, 302)
 		return
+	} else if tr.Domain == "s" && tr.Page != "" {
+		// special path /s/{token}
+		return tr.handleShare(w, r, tr.Page)
 	} else if strings.HasPrefix(r.URL.Path, "/uploads") {
 		// special path /uploads
 		return tr.handleUploads(w, r, tr.Page)
@@ -288,6 +484,27 @@ Disallow: /`))
 			return tr.handleList(w, r, "All", files)
 		} else if tr.Page == "export" {
 			return tr.handleExport(w, r)
+		} else if tr.Page == "trash" {
+			if tr.Domain == "public" && !rwt.Config.Private {
+				err = fmt.Errorf("cannot list public")
+				http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+				return
+			}
+			return tr.handleTrash(w, r)
+		} else if tr.Page == "tokens" {
+			return tr.handleTokens(w, r)
+		} else if tr.Page == "members" {
+			return tr.handleMembers(w, r)
+		} else if tr.Page == "twofactor" {
+			return tr.handleTwoFactor(w, r)
+		} else if tr.Page == "audit" {
+			return tr.handleAudit(w, r)
+		} else if tr.Page == "sessions" {
+			return tr.handleSessions(w, r)
+		} else if len(fields) > 3 && fields[3] == "share" {
+			return tr.handleShares(w, r)
+		} else if len(fields) > 3 && fields[3] == "history" {
+			return tr.handleHistory(w, r)
 		}
 		return tr.handleViewEdit(w, r)
 	}
@@ -0,0 +1,600 @@
+package rwtxt
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/schollz/rwtxt/pkg/db"
+	"github.com/schollz/rwtxt/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (rwt *RWTxt, fs db.Store) {
+	fs = db.NewMemory()
+	rwt, err := New(fs)
+	assert.Nil(t, err)
+	return
+}
+
+// do sends the request to the handler and returns the response with the body
+// decompressed.
+func do(rwt *RWTxt, r *http.Request) (w *httptest.ResponseRecorder, body string) {
+	w = httptest.NewRecorder()
+	rwt.Handler(w, r)
+	b := w.Body.Bytes()
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(w.Body)
+		if err == nil {
+			b, _ = ioutil.ReadAll(gz)
+		}
+	}
+	return w, string(b)
+}
+
+// testCSRFToken is the CSRF token of the browser in tests.
+const testCSRFToken = "0123456789abcdef0123456789abcdef"
+
+// postForm returns a post of the form with the CSRF token, as sent by a page
+// of rwtxt.
+func postForm(path string, form url.Values) *http.Request {
+	form.Set("csrf", testCSRFToken)
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFToken})
+	return r
+}
+
+func TestHandleMain(t *testing.T) {
+	rwt, _ := newTestServer(t)
+	w, body := do(rwt, httptest.NewRequest("GET", "/public", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "Welcome")
+}
+
+func TestHandleLoginAndView(t *testing.T) {
+	rwt, fs := newTestServer(t)
+
+	// logging in to a new domain creates it
+	form := url.Values{"domain": {"notes"}, "password": {"secret"}}
+	r := postForm("/login", form)
+	w, _ := do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+
+	assert.Nil(t, fs.Save(db.File{ID: "abc", Slug: "todo", Data: "# buy milk", Domain: "notes"}))
+
+	// private domains need a sign in
+	w, _ = do(rwt, httptest.NewRequest("GET", "/notes/todo", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	r = httptest.NewRequest("GET", "/notes/todo", nil)
+	r.AddCookie(cookies[0])
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "buy milk")
+}
+
+func TestHandleSearch(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	key, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Save(db.File{ID: "titled", Slug: "milk", Data: "# from the farm", Domain: "notes"}))
+	assert.Nil(t, fs.Save(db.File{ID: "mentions", Slug: "todo", Data: "# buy <em>milk</em>", Domain: "notes"}))
+
+	r := httptest.NewRequest("GET", "/notes?q=milk", nil)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "2 results for 'milk'")
+	assert.Regexp(t, `(?s)1\.</span> <a href="/notes/titled">.*2\.</span> <a href="/notes/mentions">`, body)
+	assert.Contains(t, body, "buy &lt;em&gt;<b>milk</b>&lt;/em&gt;")
+
+	// with filters, and a reason for searches that can not be understood
+	r = httptest.NewRequest("GET", "/notes?q="+url.QueryEscape("milk -slug:milk"), nil)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	_, body = do(rwt, r)
+	assert.Contains(t, body, "1 results for")
+	assert.Contains(t, body, `href="/notes/mentions"`)
+	r = httptest.NewRequest("GET", "/notes?q="+url.QueryEscape(`"milk`), nil)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, body = do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "0 results for")
+	assert.Contains(t, body, "a quote is not closed.")
+}
+
+func TestHandleTrash(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	key, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+	cookie := &http.Cookie{Name: "rwtxt-domains", Value: key}
+
+	f := db.File{ID: "abc", Slug: "todo", Data: "# buy milk", Domain: "notes"}
+	assert.Nil(t, fs.Save(f))
+	f.Data = ""
+	assert.Nil(t, fs.Save(f))
+	assert.Nil(t, fs.DeleteEmpty())
+
+	// the trash is only for those signed in
+	w, _ := do(rwt, httptest.NewRequest("GET", "/notes/trash", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	r := httptest.NewRequest("GET", "/notes/trash", nil)
+	r.AddCookie(cookie)
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "buy milk")
+
+	form := url.Values{"id": {"abc"}}
+	r = postForm("/notes/trash", form)
+	r.AddCookie(cookie)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/notes/abc", w.Header().Get("Location"))
+
+	files, err := fs.Get("abc", "notes")
+	assert.Nil(t, err)
+	assert.Equal(t, "# buy milk", files[0].Data)
+	assert.Equal(t, 3, files[0].History.NumEdits())
+	files, err = fs.GetTrash("notes")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestHandleHistory(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	f := db.File{ID: "abc", Slug: "todo", Data: "buy milk", Domain: "public"}
+	assert.Nil(t, fs.Save(f))
+	f.Data = "buy milk\nand <eggs>"
+	assert.Nil(t, fs.Save(f))
+
+	files, err := fs.Get("abc", "public")
+	assert.Nil(t, err)
+	revisions, err := files[0].Revisions()
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	first := strconv.FormatInt(revisions[0].Timestamp, 10)
+	second := strconv.FormatInt(revisions[1].Timestamp, 10)
+
+	w, body := do(rwt, httptest.NewRequest("GET", "/public/todo/history", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "2 versions")
+	assert.Contains(t, body, "?version="+first)
+
+	w, body = do(rwt, httptest.NewRequest("GET", "/public/todo/history?to="+second, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "buy milk<ins>\nand &lt;eggs&gt;</ins>")
+
+	form := url.Values{"version": {first}}
+	r := postForm("/public/abc/history", form)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/public/abc", w.Header().Get("Location"))
+
+	files, err = fs.Get("abc", "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "buy milk", files[0].Data)
+	assert.Equal(t, 3, files[0].History.NumEdits())
+}
+
+func TestHandleTokens(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	key, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+	cookie := &http.Cookie{Name: "rwtxt-domains", Value: key}
+
+	w, _ := do(rwt, httptest.NewRequest("GET", "/notes/tokens", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	form := url.Values{"name": {"bot"}, "scope": {"write"}, "days": {"30"}}
+	r := postForm("/notes/tokens", form)
+	r.AddCookie(cookie)
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, db.TokenPrefix)
+
+	tokens, err := fs.GetTokens("notes")
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, db.ScopeWrite, tokens[0].Scope)
+	assert.NotNil(t, tokens[0].Expires)
+
+	form = url.Values{"id": {strconv.Itoa(tokens[0].ID)}, "revoke": {"Revoke"}}
+	r = postForm("/notes/tokens", form)
+	r.AddCookie(cookie)
+	w, body = do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "token revoked")
+	assert.NotContains(t, body, db.TokenPrefix)
+}
+
+func TestHandleSessions(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("notes", "secret"))
+	key, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+	other, err := fs.SetKey("notes", "secret")
+	assert.Nil(t, err)
+	cookie := &http.Cookie{Name: "rwtxt-domains", Value: key}
+
+	w, _ := do(rwt, httptest.NewRequest("GET", "/notes/sessions", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// sessions are listed by id, never by key
+	r := httptest.NewRequest("GET", "/notes/sessions", nil)
+	r.AddCookie(cookie)
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, db.KeyID(other))
+	assert.Contains(t, body, db.KeyID(key)+"), this session")
+	assert.NotContains(t, body, other)
+
+	r = postForm("/notes/sessions", url.Values{"id": {db.KeyID(other)}, "revoke": {"Sign out"}})
+	r.AddCookie(cookie)
+	w, body = do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "signed out session "+db.KeyID(other))
+	_, err = fs.GetKey(other)
+	assert.NotNil(t, err)
+
+	// signing out everyone includes this session
+	r = postForm("/notes/sessions", url.Values{"revokeall": {"Sign out everyone"}})
+	r.AddCookie(cookie)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	sessions, err := fs.GetSessions("notes")
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+
+	// logging out revokes the key, not just the cookie
+	key, _ = fs.SetKey("notes", "secret")
+	r = postForm("/logout", url.Values{"d": {"notes"}})
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	_, err = fs.GetKey(key)
+	assert.NotNil(t, err)
+
+	// and so does changing the password of the domain
+	key, _ = fs.SetKey("notes", "secret")
+	other, _ = fs.SetKey("notes", "secret")
+	r = postForm("/update", url.Values{"domain": {"notes"}, "domain_key": {key}, "sharedpassword": {"on"}, "password": {"secret2"}})
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	_, err = fs.GetKey(other)
+	assert.NotNil(t, err)
+	_, err = fs.GetKey(key)
+	assert.NotNil(t, err)
+}
+
+func TestHandleMembers(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("team", "secret"))
+	key, err := fs.SetKey("team", "secret")
+	assert.Nil(t, err)
+
+	form := url.Values{"user": {"alice"}, "role": {"reader"}, "password": {"pass"}}
+	r := postForm("/team/members", form)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "alice is now reader")
+
+	// members log in with their own password
+	form = url.Values{"domain": {"team"}, "user": {"alice"}, "password": {"pass"}}
+	r = postForm("/login", form)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/team", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	reader := cookies[0]
+
+	// readers can view pages, but not edit them or manage the domain
+	assert.Nil(t, fs.Save(db.File{ID: "page1", Slug: "hello", Data: "hello world", Domain: "team"}))
+	r = httptest.NewRequest("GET", "/team/hello", nil)
+	r.AddCookie(reader)
+	w, body = do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "hello world")
+	assert.NotContains(t, body, "<a id='editlink'>")
+	r = httptest.NewRequest("GET", "/team/members", nil)
+	r.AddCookie(reader)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	var p Payload
+	assert.Equal(t, http.StatusOK, api(t, rwt, "POST", "/api/v1/team/keys", "", `{"user":"alice","password":"pass"}`, &p))
+	assert.Equal(t, http.StatusOK, api(t, rwt, "GET", "/api/v1/team/pages", p.DomainKey, "", nil))
+	assert.Equal(t, http.StatusForbidden, api(t, rwt, "POST", "/api/v1/team/pages", p.DomainKey, `{"data":"hi"}`, nil))
+	assert.Nil(t, fs.SetMembership("team", "alice", db.RoleEditor))
+	assert.Equal(t, http.StatusCreated, api(t, rwt, "POST", "/api/v1/team/pages", p.DomainKey, `{"data":"hi"}`, nil))
+}
+
+func TestHandleReaderPassword(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("client", "secret"))
+	key, err := fs.SetKey("client", "secret")
+	assert.Nil(t, err)
+
+	form := url.Values{"domain": {"client"}, "domain_key": {key}, "sharedpassword": {"on"}, "reader_password": {"look"}}
+	r := postForm("/update", form)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, _ := do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	form = url.Values{"domain": {"client"}, "password": {"look"}}
+	r = postForm("/login", form)
+	w, _ = do(rwt, r)
+	assert.Equal(t, "/client", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	reader := cookies[0]
+
+	// the page is shown without the editor
+	assert.Nil(t, fs.Save(db.File{ID: "page1", Slug: "report", Data: "all good", Domain: "client"}))
+	r = httptest.NewRequest("GET", "/client/report", nil)
+	r.AddCookie(reader)
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "all good")
+	assert.Contains(t, body, "readonly")
+	assert.Contains(t, body, `domain_key: ""`)
+
+	r = postForm("/upload?domain=client", url.Values{})
+	r.AddCookie(reader)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// nor are pages created, by name or as new ones
+	for _, path := range []string{"/client/plans", "/client/new"} {
+		r = httptest.NewRequest("GET", path, nil)
+		r.AddCookie(reader)
+		w, _ = do(rwt, r)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "/client?m="+base64.URLEncoding.EncodeToString([]byte("must be an editor")), w.Header().Get("Location"))
+	}
+	files, err := fs.GetAll("client")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	r = httptest.NewRequest("GET", "/client/new", nil)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	_, err = fs.Get(strings.TrimPrefix(w.Header().Get("Location"), "/client/"), "client")
+	assert.Nil(t, err, "editors may")
+
+	readerKey := strings.Split(reader.Value, ",")[0]
+	form = url.Values{"domain": {"client"}, "domain_key": {readerKey}, "ispublic": {"on"}}
+	r = postForm("/update", form)
+	r.AddCookie(reader)
+	w, _ = do(rwt, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	_, ispublic, _, err := fs.GetDomainFromName("client")
+	assert.Nil(t, err)
+	assert.False(t, ispublic, "readers can not change the settings")
+}
+
+func TestHandleShares(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	assert.Nil(t, fs.SetDomain("work", "secret"))
+	key, err := fs.SetKey("work", "secret")
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Save(db.File{ID: "page1", Slug: "plan", Data: "the secret plan", Domain: "work"}))
+	assert.Nil(t, fs.Save(db.File{ID: "page2", Slug: "other", Data: "the other plan", Domain: "work"}))
+
+	// outsiders can not see the page
+	w, _ := do(rwt, httptest.NewRequest("GET", "/work/plan", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	w, _ = do(rwt, postForm("/work/plan/share", url.Values{}))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	form := url.Values{"days": {"1"}, "views": {"1"}}
+	r := postForm("/work/plan/share", form)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	link := regexp.MustCompile(`/s/[0-9a-f]+`).FindString(body)
+	assert.NotEmpty(t, link)
+
+	// until they get the link, which shows only that page and no way to edit
+	w, body = do(rwt, httptest.NewRequest("GET", link, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "the secret plan")
+	assert.NotContains(t, body, "<a id='editlink'>")
+	assert.NotContains(t, body, `href="/work"`)
+	assert.Contains(t, body, `domain_key: ""`)
+	w, _ = do(rwt, httptest.NewRequest("GET", link, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "the link could be viewed once")
+	w, _ = do(rwt, httptest.NewRequest("GET", "/s/0123", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	shares, err := fs.GetShares("work", "page1")
+	assert.Nil(t, err)
+	if !assert.Len(t, shares, 1) {
+		return
+	}
+	form = url.Values{"id": {strconv.Itoa(shares[0].ID)}, "revoke": {"Revoke"}}
+	r = postForm("/work/plan/share", form)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+	w, body = do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "link revoked")
+}
+
+func TestHandleTwoFactor(t *testing.T) {
+	rwt, fs := newTestServer(t)
+	now := time.Unix(1500000000, 0)
+	rwt.now = func() time.Time { return now }
+	assert.Nil(t, fs.SetDomain("team", "secret"))
+	assert.Nil(t, fs.CreateUser("alice", "pass"))
+	assert.Nil(t, fs.SetMembership("team", "alice", db.RoleReader))
+	adminKey, err := fs.SetKey("team", "secret")
+	assert.Nil(t, err)
+	aliceKey, err := fs.SetUserKey("team", "alice", "pass")
+	assert.Nil(t, err)
+	post := func(key string, form url.Values) string {
+		r := postForm("/team/twofactor", form)
+		r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: key})
+		w, body := do(rwt, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return body
+	}
+
+	w, _ := do(rwt, httptest.NewRequest("GET", "/team/twofactor", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// members enroll their own account, which admins can not do for them
+	r := httptest.NewRequest("GET", "/team/twofactor", nil)
+	r.AddCookie(&http.Cookie{Name: "rwtxt-domains", Value: aliceKey})
+	w, body := do(rwt, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, body, "data:image/png;base64,")
+	assert.NotContains(t, body, "The password of the domain")
+	secret := regexp.MustCompile(`name="secret" value="([A-Z2-7]+)"`).FindStringSubmatch(body)
+	if !assert.Len(t, secret, 2) {
+		return
+	}
+	body = post(adminKey, url.Values{"account": {"user"}, "secret": {secret[1]}, "code": {"000000"}})
+	assert.Contains(t, body, "The password of the domain")
+	assert.NotContains(t, body, "Your account")
+
+	body = post(aliceKey, url.Values{"account": {"user"}, "secret": {secret[1]}, "code": {"000000"}})
+	assert.Contains(t, body, "incorrect code")
+	assert.Contains(t, body, secret[1], "the same secret is shown again")
+	code, _ := utils.TOTPCode(secret[1], utils.TOTPStep(now))
+	body = post(aliceKey, url.Values{"account": {"user"}, "secret": {secret[1]}, "code": {code}})
+	assert.Contains(t, body, "two-factor authentication is on")
+	recoveryCodes := regexp.MustCompile(`[0-9a-f]{5}-[0-9a-f]{5}`).FindAllString(body, -1)
+	assert.Len(t, recoveryCodes, db.NumRecoveryCodes)
+	enrolled, _ := fs.HasTwoFactor("team", "alice")
+	assert.True(t, enrolled)
+	enrolled, _ = fs.HasTwoFactor("team", "")
+	assert.False(t, enrolled, "the domain is enrolled separately")
+
+	// enrolling again with a new secret takes a code of the old one
+	newSecret, _ := utils.NewTOTPSecret()
+	newCode, _ := utils.TOTPCode(newSecret, utils.TOTPStep(now))
+	body = post(aliceKey, url.Values{"account": {"user"}, "secret": {newSecret}, "code": {newCode}})
+	assert.Contains(t, body, "two-factor code required")
+	body = post(aliceKey, url.Values{"account": {"user"}, "secret": {newSecret}, "code": {newCode}, "current_code": {"000000"}})
+	assert.Contains(t, body, "incorrect two-factor code")
+	assert.Nil(t, fs.CheckTwoFactor("team", "alice", recoveryCodes[1], now), "the old recovery codes still work")
+	body = post(aliceKey, url.Values{"account": {"user"}, "secret": {newSecret}, "code": {newCode}, "current_code": {recoveryCodes[2]}})
+	assert.Contains(t, body, "two-factor authentication is on")
+	oldRecoveryCodes := recoveryCodes
+	recoveryCodes = regexp.MustCompile(`[0-9a-f]{5}-[0-9a-f]{5}`).FindAllString(body, -1)
+	assert.Len(t, recoveryCodes, db.NumRecoveryCodes)
+	assert.NotNil(t, fs.CheckTwoFactor("team", "alice", oldRecoveryCodes[3], now), "the old recovery codes are replaced")
+
+	// and turn it off with a code
+	body = post(aliceKey, url.Values{"account": {"user"}, "disable": {"Turn off"}, "code": {"000000"}})
+	assert.Contains(t, body, "incorrect two-factor code")
+	body = post(aliceKey, url.Values{"account": {"user"}, "disable": {"Turn off"}, "code": {recoveryCodes[0]}})
+	assert.Contains(t, body, "two-factor authentication is off")
+	enrolled, _ = fs.HasTwoFactor("team", "alice")
+	assert.False(t, enrolled)
+}
+
+func TestHandleWebsocket(t *testing.T) {
+	fs := db.NewMemory()
+	rwt, err := New(fs, Config{Origins: []string{"https://notes.example.com"}})
+	assert.Nil(t, err)
+	server := httptest.NewServer(http.HandlerFunc(rwt.Handler))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	dial := func(origin string) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {origin}})
+		if err != nil {
+			return nil
+		}
+		return c
+	}
+	send := func(c *websocket.Conn, p Payload) Payload {
+		assert.Nil(t, c.WriteJSON(p))
+		var reply Payload
+		assert.Nil(t, c.ReadJSON(&reply))
+		return reply
+	}
+
+	assert.Nil(t, fs.SetDomain("mine", "secret"))
+	assert.Nil(t, fs.SetDomain("theirs", "other"))
+	assert.Nil(t, fs.Save(db.File{ID: "page1", Data: "their page", Domain: "theirs"}))
+	key, err := fs.SetKey("mine", "secret")
+	assert.Nil(t, err)
+
+	// only pages of rwtxt, or the allowed origins, may connect
+	assert.Nil(t, dial("https://evil.example.com"))
+	if c := dial("https://notes.example.com"); assert.NotNil(t, c) {
+		c.Close()
+	}
+	c := dial(server.URL)
+	if !assert.NotNil(t, c) {
+		return
+	}
+	defer c.Close()
+
+	// a key of one domain can not write into another
+	reply := send(c, Payload{ID: "page1", Data: "overwritten", Domain: "theirs", DomainKey: key})
+	assert.Equal(t, "not saving", reply.Message)
+	files, err := fs.Get("page1", "theirs")
+	assert.Nil(t, err)
+	assert.Equal(t, "their page", files[0].Data)
+
+	// nor through its own domain, which does not save it
+	c3 := dial(server.URL)
+	defer c3.Close()
+	reply = send(c3, Payload{ID: "page1", Data: "overwritten", Domain: "mine", DomainKey: key})
+	assert.Equal(t, "not saving", reply.Message)
+	files, _ = fs.Get("page1", "theirs")
+	assert.Equal(t, "their page", files[0].Data)
+
+	// nor can a socket that is bound to another page
+	c2 := dial(server.URL)
+	defer c2.Close()
+	reply = send(c2, Payload{ID: "page2", Data: "my page", Domain: "mine", DomainKey: key})
+	assert.Equal(t, "unique_slug", reply.Message)
+	reply = send(c2, Payload{ID: "page1", Data: "overwritten", Domain: "theirs", DomainKey: key})
+	assert.Equal(t, "not saving", reply.Message)
+	reply = send(c2, Payload{ID: "page3", Data: "another page", Domain: "mine", DomainKey: key})
+	assert.Equal(t, "not saving", reply.Message)
+	files, _ = fs.Get("page1", "theirs")
+	assert.Equal(t, "their page", files[0].Data)
+
+	// and the key is checked with every message
+	assert.Nil(t, fs.DeleteKey(key))
+	reply = send(c2, Payload{ID: "page2", Data: "my page, edited", Domain: "mine", DomainKey: key})
+	assert.Equal(t, "not saving", reply.Message)
+	files, _ = fs.Get("page2", "mine")
+	assert.Equal(t, "my page", files[0].Data)
+
+	// a reserved slug is not kept, so the page is reached by its id
+	key, err = fs.SetKey("mine", "secret")
+	assert.Nil(t, err)
+	c4 := dial(server.URL)
+	defer c4.Close()
+	reply = send(c4, Payload{ID: "page4", Slug: "trash", Data: "# Trash\n\ntake it out", Domain: "mine", DomainKey: key})
+	assert.Equal(t, "unique_slug", reply.Message)
+	assert.False(t, reply.Success)
+	files, _ = fs.Get("page4", "mine")
+	assert.Empty(t, files[0].Slug)
+}
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/disintegration/imaging"
+	qrcode "github.com/skip2/go-qrcode"
 
 	log "github.com/schollz/logger"
 	"github.com/schollz/rwtxt/pkg/db"
@@ -49,6 +50,8 @@ type TemplateRender struct {
 	DomainKeys         map[string]string
 	DefaultDomain      string
 	SignedIn           bool
+	User               string
+	Role               db.Role
 	Message            string
 	NumResults         int
 	Files              []db.File
@@ -68,6 +71,30 @@ type TemplateRender struct {
 	Options            db.DomainOptions
 	CustomIntro        template.HTML
 	CustomCSS          template.CSS
+	Revisions          []db.Revision
+	Diff               template.HTML
+	DiffFrom           db.Revision
+	DiffTo             db.Revision
+	Tokens             []db.Token
+	NewToken           string
+	Members            []db.Membership
+	Shared             bool
+	Shares             []db.Share
+	NewShare           string
+	TwoFactors         []TwoFactor
+	Events             []db.Event
+	Sessions           []db.Session
+	CSRFToken          string
+}
+
+// TwoFactor is the two-factor authentication of the signed in user, or of the
+// shared password of the domain, as shown on its page.
+type TwoFactor struct {
+	User          string // empty for the domain
+	Enrolled      bool
+	Secret        string       // a new secret to enroll with
+	QRCode        template.URL // of the secret, for authenticator apps to scan
+	RecoveryCodes []string     // only shown right after enrolling
 }
 
 type Payload struct {
@@ -127,6 +154,34 @@ func NewTemplateRender(rwt *RWTxt) *TemplateRender {
 	return tr
 }
 
+// setRole looks up who is signed in to the domain, and what they may do.
+func (tr *TemplateRender) setRole() {
+	tr.User, tr.Role = "", ""
+	if !tr.SignedIn || tr.DomainKey == "" {
+		return
+	}
+	k, err := tr.rwt.fs.GetKey(tr.DomainKey)
+	if err != nil || k.Domain != tr.Domain {
+		return
+	}
+	tr.User, tr.Role = k.User, k.Role
+}
+
+// CanEdit returns whether pages of the domain may be written, which anyone
+// may do in the public domain.
+func (tr *TemplateRender) CanEdit() bool {
+	if tr.Shared {
+		return false
+	}
+	return tr.Domain == "public" || (tr.SignedIn && tr.Role.Allows(db.RoleEditor))
+}
+
+// IsAdmin returns whether the settings and members of the domain may be
+// changed.
+func (tr *TemplateRender) IsAdmin() bool {
+	return tr.Domain != "public" && tr.SignedIn && tr.Role.Allows(db.RoleAdmin)
+}
+
 func (tr *TemplateRender) handleSearch(w http.ResponseWriter, r *http.Request, domain, query string) (err error) {
 	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(domain)
 	if !tr.SignedIn && !tr.DomainIsPublic {
@@ -135,7 +190,10 @@ func (tr *TemplateRender) handleSearch(w http.ResponseWriter, r *http.Request, d
 
 	}
 	files, errGet := tr.rwt.fs.Find(query, tr.Domain)
-	if errGet != nil {
+	if qerr, ok := errGet.(*db.QueryError); ok {
+		tr.Message = qerr.Reason + ". Search for words, \"phrases\", prefix*, -excluded, this OR that, slug:, created:>2026-01-01, modified:<2026-01-01 or has:upload."
+		files = []db.File{}
+	} else if errGet != nil {
 		return errGet
 	}
 	return tr.handleList(w, r, query, files)
@@ -165,7 +223,6 @@ func (tr *TemplateRender) handleList(w http.ResponseWriter, r *http.Request, que
 func (tr TemplateRender) updateDomainCookie(w http.ResponseWriter, r *http.Request) (cookie http.Cookie) {
 	delete(tr.DomainKeys, "public")
 	tr.DomainKeys[tr.Domain] = tr.DomainKey
-	log.Debugf("updated domain keys: %+v", tr.DomainKeys)
 
 	// add the current one as default
 	domainKeyList := []string{tr.DomainKey}
@@ -177,12 +234,16 @@ func (tr TemplateRender) updateDomainCookie(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	log.Debugf("setting new list: %+v", domainKeyList)
+	log.Debugf("setting new list: %v", keyIDs(domainKeyList))
 	// return the new cookie
 	return http.Cookie{
-		Name:    "rwtxt-domains",
-		Value:   strings.Join(domainKeyList, ","),
-		Expires: time.Now().UTC().Add(365 * 24 * time.Hour),
+		Name:     "rwtxt-domains",
+		Value:    strings.Join(domainKeyList, ","),
+		Path:     "/",
+		Expires:  time.Now().UTC().Add(365 * 24 * time.Hour),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
 	}
 }
 
@@ -325,8 +386,24 @@ func (tr *TemplateRender) getUTCOffsetFromCookie(r *http.Request) {
 	return
 }
 
+// handleLogout signs out of every domain, revoking the keys of the browser
+// so that they no longer work anywhere. It has to be posted, with the CSRF
+// token, so that other sites can not sign anyone out.
 func (tr *TemplateRender) handleLogout(w http.ResponseWriter, r *http.Request) (err error) {
-	tr.Domain = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("d")))
+	tr.Domain = strings.ToLower(strings.TrimSpace(r.FormValue("d")))
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("log out with the link on the page")), 302)
+		return
+	}
+
+	for _, key := range tr.DomainKeys {
+		if key == "" {
+			continue
+		}
+		if errDelete := tr.rwt.fs.DeleteKey(key); errDelete != nil {
+			log.Error(errDelete)
+		}
+	}
 
 	// delete all cookies
 	_, err = r.Cookie("rwtxt-domains")
@@ -337,6 +414,8 @@ func (tr *TemplateRender) handleLogout(w http.ResponseWriter, r *http.Request) (
 			Path:     "/",
 			Expires:  time.Unix(0, 0),
 			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
 		}
 		http.SetCookie(w, c)
 	}
@@ -348,6 +427,7 @@ func (tr *TemplateRender) handleLogout(w http.ResponseWriter, r *http.Request) (
 func (tr *TemplateRender) handleLogin(w http.ResponseWriter, r *http.Request) (err error) {
 	tr.Domain = strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
 	password := strings.TrimSpace(r.FormValue("password"))
+	user := strings.TrimSpace(r.FormValue("user"))
 	if tr.Domain == "public" || tr.Domain == "" {
 		tr.Domain = "public"
 		return tr.handleMain(w, r)
@@ -357,11 +437,20 @@ func (tr *TemplateRender) handleLogin(w http.ResponseWriter, r *http.Request) (e
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain key cannot be empty")), 302)
 		return
 	}
-	var key string
+	if wait := tr.rwt.checkLogin(r, tr.Domain, user); wait > 0 {
+		tr.Domain = "public"
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("too many failed logins, try again in "+wait.Round(time.Second).String())), 302)
+		return nil
+	}
 
 	// check if exists
 	_, _, _, err = tr.rwt.fs.GetDomainFromName(tr.Domain)
-	if err != nil {
+	if err != nil && (user != "" || tr.rwt.Config.NoSignup) {
+		tr.rwt.loginDone(r, tr.Domain, user, "", err)
+		tr.Domain = "public"
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain does not exist")), 302)
+		return nil
+	} else if err != nil {
 		// domain doesn't exist, create it
 		log.Debugf("domain '%s' doesn't exist, creating it", tr.Domain)
 		err = tr.rwt.fs.SetDomain(tr.Domain, password)
@@ -371,15 +460,16 @@ func (tr *TemplateRender) handleLogin(w http.ResponseWriter, r *http.Request) (e
 			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 			return
 		}
+		tr.rwt.audit(r, db.Event{Domain: tr.Domain, Action: db.AuditSettings, Detail: "created the domain"})
 	}
-	tr.DomainKey, err = tr.rwt.fs.SetKey(tr.Domain, password)
+	tr.DomainKey, err = tr.rwt.signIn(tr.Domain, user, password, r.FormValue("code"))
+	tr.rwt.loginDone(r, tr.Domain, user, tr.DomainKey, err)
 	if err != nil {
 		tr.Domain = "public"
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 		return
 	}
 
-	log.Debugf("new key: %s", key)
 	// set domain password
 	cookie := tr.updateDomainCookie(w, r)
 	http.SetCookie(w, &cookie)
@@ -409,6 +499,9 @@ func (tr *TemplateRender) handleLoginUpdate(w http.ResponseWriter, r *http.Reque
 	options.CSS = strings.TrimSpace(r.FormValue("css"))
 	options.CustomTitle = strings.TrimSpace(r.FormValue("title"))
 	options.CustomIntro = strings.TrimSpace(r.FormValue("intro"))
+	options.NoSharedPassword = strings.TrimSpace(r.FormValue("sharedpassword")) != "on"
+	readerPassword := strings.TrimSpace(r.FormValue("reader_password"))
+	removeReaderPassword := strings.TrimSpace(r.FormValue("noreaderpassword")) == "on"
 
 	log.Debugf("new options: %+v", options)
 	if tr.Domain == "public" || tr.Domain == "" {
@@ -417,28 +510,63 @@ func (tr *TemplateRender) handleLoginUpdate(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// check that the key is valid
-	_, domainFound, err := tr.rwt.fs.CheckKey(tr.DomainKey)
-	if err != nil || tr.Domain != domainFound {
-		if err != nil {
-			log.Debug(err)
-		}
+	// check that the key is valid, and of an admin of the domain
+	k, err := tr.rwt.fs.GetKey(tr.DomainKey)
+	if err == nil && (tr.Domain != k.Domain || !k.Role.Allows(db.RoleAdmin)) {
+		err = fmt.Errorf("must be an admin of the domain")
+	}
+	if err != nil {
+		log.Debug(err)
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 		return
 	}
+	if options.NoSharedPassword && k.User == "" {
+		// keep whoever disables the shared password from locking themselves out
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("sign in as an admin member to disable the shared password")), 302)
+		return
+	}
 
+	tr.User = k.User
+	_, wasPublic, oldOptions, _ := tr.rwt.fs.GetDomainFromName(tr.Domain)
+	var changes []string
 	err = tr.rwt.fs.UpdateDomain(tr.Domain, password, isPublic, options)
 	message := "settings updated"
 	if password != "" {
-		message = "password updated"
+		message = "password updated, everyone was signed out"
+		changes = append(changes, "changed the password")
+	}
+	if isPublic && !wasPublic {
+		changes = append(changes, "made the domain public")
+	} else if !isPublic && wasPublic {
+		changes = append(changes, "made the domain private")
+	}
+	if options != oldOptions {
+		changes = append(changes, "changed the options")
+	}
+	if err == nil && (readerPassword != "" || removeReaderPassword) {
+		err = tr.rwt.fs.SetReaderPassword(tr.Domain, readerPassword)
+		message = "reader password updated"
+		if readerPassword != "" {
+			changes = append(changes, "set the read-only password")
+		} else {
+			changes = append(changes, "removed the read-only password")
+		}
 	}
 	if err != nil {
 		message = err.Error()
+	} else if len(changes) > 0 {
+		tr.audit(r, db.AuditSettings, "", strings.Join(changes, ", "))
 	}
 	http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(message)), 302)
 	return
 }
 
+// handleWebsocket saves the page being edited as it is typed. The socket is
+// bound to the domain and page of the first message, and the key sent along
+// is checked with every message, so that it stops saving once the key is
+// revoked. A save is audited as it happens, compared with the page before the
+// first save, unless the socket already audited the same action, so that
+// typing is not logged once for every save.
 func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request) (err error) {
 	// handle websockets on this page
 	c, errUpgrade := tr.rwt.wsupgrader.Upgrade(w, r, nil)
@@ -446,9 +574,10 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 		return errUpgrade
 	}
 	defer c.Close()
-	domainChecked := false
-	domainValidated := false
-	var editFile db.File
+	var domain, pageID string
+	var editFile db.File       // the page as last saved
+	var before string          // the page before the first save
+	var audited db.AuditAction // the action last audited
 	var p Payload
 	for {
 		err := c.ReadJSON(&p)
@@ -467,37 +596,47 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 		}
 		log.Debugf("recv: %v", p)
 
-		if !domainChecked {
-			domainChecked = true
-			if p.Domain == "public" {
-				domainValidated = true
-			} else {
-				_, _, keyErr := tr.rwt.fs.CheckKey(p.DomainKey)
-				if keyErr == nil {
-					domainValidated = true
-				}
-			}
+		if p.Domain == "" {
+			p.Domain = "public"
+		}
+		if pageID == "" {
+			domain, pageID = p.Domain, p.ID
 		}
+		k, errSave := tr.authorizeWebsocket(p, domain, pageID)
 
 		// save it
-		if p.ID != "" && domainValidated {
-			if p.Domain == "" {
-				p.Domain = "public"
+		var f db.File
+		var reserved bool
+		if errSave == nil {
+			if editFile.ID == "" {
+				if files, errGet := tr.rwt.fs.Get(p.ID, p.Domain); errGet == nil && len(files) == 1 {
+					before = files[0].Data
+				}
 			}
 			data := strings.TrimSpace(p.Data)
 			if data == introText {
 				data = ""
 			}
-			editFile = db.File{
+			// a page with a reserved slug is saved without it, and is
+			// reached by its id like one whose slug is taken
+			slug := p.Slug
+			if reserved = db.IsReservedSlug(slug); reserved {
+				slug = ""
+			}
+			f = db.File{
 				ID:      p.ID,
-				Slug:    p.Slug,
+				Slug:    slug,
 				Data:    data,
 				Created: time.Now().UTC(),
 				Domain:  p.Domain,
 			}
-			err = tr.rwt.fs.Save(editFile)
-			if err != nil {
-				log.Error(err)
+			errSave = tr.rwt.fs.Save(f)
+		}
+		if errSave == nil {
+			editFile = f
+			if action := pageAction(before, f.Data); action != "" && action != audited {
+				audited = action
+				tr.rwt.audit(r, db.Event{Domain: domain, Action: action, Page: f.ID, User: k.User, Session: db.KeyID(p.DomainKey)})
 			}
 			fs, _ := tr.rwt.fs.Get(p.Slug, p.Domain)
 
@@ -505,14 +644,14 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 				ID:      p.ID,
 				Slug:    p.Slug,
 				Message: "unique_slug",
-				Success: len(fs) < 2,
+				Success: !reserved && len(fs) < 2,
 			})
 			if err != nil {
 				log.Debug("write:", err)
 				break
 			}
 		} else {
-			log.Debug("not saving")
+			log.Debugf("not saving: %s", errSave)
 			err = c.WriteJSON(Payload{
 				Message: "not saving",
 			})
@@ -525,6 +664,30 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 	return
 }
 
+// authorizeWebsocket returns the key of the message, or an error unless the
+// message may be saved by a socket bound to the page of the domain.
+func (tr *TemplateRender) authorizeWebsocket(p Payload, domain, pageID string) (k db.Key, err error) {
+	if p.ID == "" {
+		err = fmt.Errorf("no page")
+		return
+	}
+	if p.Domain != domain || p.ID != pageID {
+		err = fmt.Errorf("socket is bound to /%s/%s", domain, pageID)
+		return
+	}
+	if domain == "public" {
+		return
+	}
+	k, err = tr.rwt.fs.GetKey(p.DomainKey)
+	if err != nil {
+		return
+	}
+	if k.Domain != domain || !k.Role.Allows(db.RoleEditor) {
+		err = fmt.Errorf("key can not edit %s", domain)
+	}
+	return
+}
+
 func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request) (err error) {
 	// handle new page
 	// get edit url parameter
@@ -542,7 +705,6 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 	log.Debugf("many: %+v", many)
 	log.Debugf("checked havepage %s", time.Since(timerStart))
 
-	initialMarkdown := ""
 	var f db.File
 
 	// check if domain is public and exists
@@ -554,6 +716,10 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	log.Debugf("checked domain %s", time.Since(timerStart))
+	if !tr.CanEdit() {
+		// keeps readers from connecting to save
+		tr.DomainKey = ""
+	}
 
 	// check whether want to serve raw
 	showRaw := r.URL.Query().Get("raw") != ""
@@ -619,6 +785,11 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		log.Debugf("got %s content in %s", tr.Page, time.Since(timerStart))
 		wg.Wait()
 	} else {
+		// a missing page is created, which readers may not do
+		if !tr.CanEdit() {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an editor")), 302)
+			return
+		}
 		uuid := utils.UUID()
 		f = db.File{
 			ID:       uuid,
@@ -626,7 +797,9 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 			Domain:   tr.Domain,
 			Modified: time.Now().UTC(),
 		}
-		f.Slug = tr.Page
+		if !db.IsReservedSlug(tr.Page) {
+			f.Slug = tr.Page
+		}
 		f.Data = ""
 		err = tr.rwt.fs.Save(f)
 		if err != nil {
@@ -665,7 +838,6 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	initialMarkdown += "\n\n" + f.Data
 	// if f.Data == "" {
 	// 	f.Data = introText
 	// }
@@ -677,28 +849,8 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		}
 	}()
 
-	// make title
 	timerStart = time.Now().UTC()
-	domain := tr.Domain
-	slug := f.Slug
-	if domain == "" {
-		domain = "public"
-	}
-	if slug == "" {
-		slug = f.ID
-	}
-	tr.Title = slug + " | " + domain
-	initialMarkdown = strings.Replace(initialMarkdown, "- [ ]", "- ☐", -1)
-	initialMarkdown = strings.Replace(initialMarkdown, "- [x]", "- 🗹", -1)
-	tr.Rendered = utils.RenderMarkdownToHTML(initialMarkdown)
-	if tr.Options.CSS != "" {
-		tr.CustomCSS = template.CSS(tr.Options.CSS)
-	}
-
-	tr.IntroText = template.JS(introText)
-	tr.Rows = len(strings.Split(string(utils.RenderMarkdownToHTML(initialMarkdown)), "\n")) + 1
-	tr.EditOnly = strings.TrimSpace(f.Data) == ""
-	tr.Languages = utils.DetectMarkdownCodeBlockLanguages(initialMarkdown)
+	tr.render(f)
 	log.Debugf("processed %s content in %s", tr.Page, time.Since(timerStart))
 
 	// go func() {
@@ -724,6 +876,34 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 
 }
 
+// render fills in the page for the viewedit template.
+func (tr *TemplateRender) render(f db.File) {
+	initialMarkdown := "\n\n" + f.Data
+
+	// make title
+	domain := tr.Domain
+	slug := f.Slug
+	if domain == "" {
+		domain = "public"
+	}
+	if slug == "" {
+		slug = f.ID
+	}
+	tr.Title = slug + " | " + domain
+	initialMarkdown = strings.Replace(initialMarkdown, "- [ ]", "- ☐", -1)
+	initialMarkdown = strings.Replace(initialMarkdown, "- [x]", "- 🗹", -1)
+	tr.Rendered = utils.RenderMarkdownToHTML(initialMarkdown)
+	if tr.Options.CSS != "" {
+		tr.CustomCSS = template.CSS(tr.Options.CSS)
+	}
+
+	tr.IntroText = template.JS(introText)
+	tr.Rows = len(strings.Split(string(utils.RenderMarkdownToHTML(initialMarkdown)), "\n")) + 1
+	// readers see empty pages rendered rather than in the editor
+	tr.EditOnly = strings.TrimSpace(f.Data) == "" && tr.CanEdit()
+	tr.Languages = utils.DetectMarkdownCodeBlockLanguages(initialMarkdown)
+}
+
 func (tr *TemplateRender) handleUploads(w http.ResponseWriter, r *http.Request, id string) (err error) {
 	log.Debug("getting ", id)
 	name, data, _, err := tr.rwt.fs.GetBlob(id)
@@ -815,10 +995,13 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 	for _, domainName := range tr.DomainList {
 		if domain == domainName {
 			tr.SignedIn = true
+			tr.Domain = domain
+			tr.DomainKey = tr.DomainKeys[domain]
+			tr.setRole()
 			break
 		}
 	}
-	if !tr.SignedIn || domain == "public" {
+	if !tr.CanEdit() || domain == "public" {
 		log.Debugf("got domain: %s, signed in: %+v", domain, tr)
 		log.Debugf("refusing to upload")
 		http.Error(w, "need to be logged in", http.StatusForbidden)
@@ -871,6 +1054,7 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
+		tr.audit(r, db.AuditUpload, id, info.Filename)
 
 		w.Header().Set("Location", "/uploads/"+id+"?filename="+url.QueryEscape(info.Filename))
 		_, err = w.Write([]byte("ok"))
@@ -905,6 +1089,7 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
+		tr.audit(r, db.AuditUpload, id, info.Filename)
 
 		w.Header().Set("Location", "/uploads/"+id+"?filename="+url.QueryEscape(info.Filename))
 		_, err = w.Write([]byte("ok"))
@@ -912,6 +1097,509 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 	}
 }
 
+// handleTrash lists the pages that were emptied, and restores one when posted
+// its id.
+func (tr *TemplateRender) handleTrash(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.SignedIn {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must sign in")), 302)
+		return
+	}
+	files, err := tr.rwt.fs.GetTrash(tr.Domain)
+	if err != nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		if !tr.CanEdit() {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an editor")), 302)
+			return
+		}
+		id := r.FormValue("id")
+		for _, f := range files {
+			if f.ID != id {
+				continue
+			}
+			// saving the old content keeps the whole history
+			f.Data = f.DeletedData()
+			f.Domain = tr.Domain
+			err = tr.rwt.fs.Save(f)
+			if err != nil {
+				return
+			}
+			tr.audit(r, db.AuditSave, f.ID, "restored from the trash")
+			http.Redirect(w, r, "/"+tr.Domain+"/"+f.ID, 302)
+			return
+		}
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("page is not in the trash")), 302)
+		return
+	}
+
+	for i := range files {
+		data := []rune(files[i].DeletedData())
+		if len(data) > 200 {
+			data = append(data[:200], []rune("...")...)
+		}
+		files[i].Data = string(data)
+	}
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "trash | " + tr.Domain
+	tr.Files = files
+	tr.NumResults = len(files)
+	tr.Message = fmt.Sprintf("Pages are deleted for good %d days after they were emptied.", int(tr.rwt.Config.TrashRetention.Hours()/24))
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.trashTemplate.Execute(gz, tr)
+}
+
+// handleTokens lists the API tokens of the domain. Posting a name and scope
+// creates a token, which is shown once, and posting revoke and an id
+// deletes one.
+func (tr *TemplateRender) handleTokens(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.IsAdmin() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an admin")), 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		if r.FormValue("revoke") != "" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			err = tr.rwt.fs.DeleteToken(tr.Domain, id)
+			if err != nil {
+				tr.Message = err.Error()
+			} else {
+				tr.Message = "token revoked"
+				tr.audit(r, db.AuditSettings, "", fmt.Sprintf("revoked API token %d", id))
+			}
+		} else {
+			var scope db.Scope
+			var expires *time.Time
+			scope, err = db.ParseScope(r.FormValue("scope"))
+			if days, _ := strconv.Atoi(r.FormValue("days")); days > 0 {
+				t := time.Now().UTC().Add(time.Duration(days) * 24 * time.Hour)
+				expires = &t
+			}
+			var t db.Token
+			if err == nil {
+				tr.NewToken, t, err = tr.rwt.fs.CreateToken(tr.Domain, r.FormValue("name"), scope, expires)
+			}
+			if err != nil {
+				tr.Message = err.Error()
+			} else {
+				tr.audit(r, db.AuditSettings, "", fmt.Sprintf("created API token %d (%s, %s)", t.ID, t.Name, t.Scope))
+			}
+		}
+	}
+
+	tr.Tokens, err = tr.rwt.fs.GetTokens(tr.Domain)
+	if err != nil {
+		return
+	}
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "tokens | " + tr.Domain
+	tr.NumResults = len(tr.Tokens)
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.tokensTemplate.Execute(gz, tr)
+}
+
+// handleSessions lists the sessions of the domain. Posting revoke and an id
+// signs that session out, and posting revokeall signs out every session,
+// including the one posting it.
+func (tr *TemplateRender) handleSessions(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.IsAdmin() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an admin")), 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		id := r.FormValue("id")
+		if r.FormValue("revokeall") != "" {
+			err = tr.rwt.fs.DeleteSessions(tr.Domain)
+			tr.Message = "signed out every session"
+		} else {
+			err = tr.rwt.fs.DeleteSession(tr.Domain, id)
+			tr.Message = "signed out session " + id
+		}
+		if err != nil {
+			tr.Message = err.Error()
+		} else {
+			tr.audit(r, db.AuditSettings, "", tr.Message)
+		}
+		if err == nil && (id == tr.SessionID() || r.FormValue("revokeall") != "") {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(tr.Message)), 302)
+			return nil
+		}
+	}
+
+	tr.Sessions, err = tr.rwt.fs.GetSessions(tr.Domain)
+	if err != nil {
+		return
+	}
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "sessions | " + tr.Domain
+	tr.NumResults = len(tr.Sessions)
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.sessionsTemplate.Execute(gz, tr)
+}
+
+// SessionID is the id of the session signed in to the domain.
+func (tr *TemplateRender) SessionID() string {
+	return db.KeyID(tr.DomainKey)
+}
+
+// handleMembers lists the members of the domain. Posting a user and role
+// adds them, creating the user with the password if they are new, and
+// posting remove and a user takes them out of the domain.
+func (tr *TemplateRender) handleMembers(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.IsAdmin() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an admin")), 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		user := strings.ToLower(strings.TrimSpace(r.FormValue("user")))
+		if r.FormValue("remove") != "" {
+			err = tr.rwt.fs.SetMembership(tr.Domain, user, "")
+			tr.Message = "removed " + user
+		} else {
+			var role db.Role
+			role, err = db.ParseRole(r.FormValue("role"))
+			if err == nil && r.FormValue("password") != "" {
+				err = tr.rwt.fs.CreateUser(user, r.FormValue("password"))
+			}
+			if err == nil {
+				err = tr.rwt.fs.SetMembership(tr.Domain, user, role)
+			}
+			tr.Message = user + " is now " + string(role)
+		}
+		if err != nil {
+			tr.Message = err.Error()
+		} else {
+			tr.audit(r, db.AuditSettings, "", tr.Message)
+		}
+	}
+
+	tr.Members, err = tr.rwt.fs.GetMemberships(tr.Domain)
+	if err != nil {
+		return
+	}
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "members | " + tr.Domain
+	tr.NumResults = len(tr.Members)
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.membersTemplate.Execute(gz, tr)
+}
+
+// handleTwoFactor enrolls the signed in member, and the domain if they are an
+// admin, in two-factor authentication. Enrolling shows a new secret as a QR
+// code, and takes effect once a code from it is posted back, after which the
+// recovery codes are shown once. Posting disable with a code stops asking for
+// codes, and enrolling an account that is already enrolled also takes a code
+// of its current secret as current_code.
+func (tr *TemplateRender) handleTwoFactor(w http.ResponseWriter, r *http.Request) (err error) {
+	if tr.User == "" && !tr.IsAdmin() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be a member or an admin")), 302)
+		return
+	}
+
+	secrets := make(map[string]string)
+	recoveryCodes := make(map[string][]string)
+	if r.Method == "POST" {
+		user := ""
+		if r.FormValue("account") == "user" {
+			user = tr.User
+		}
+		code := strings.TrimSpace(r.FormValue("code"))
+		if user == "" && !tr.IsAdmin() {
+			err = fmt.Errorf("must be an admin")
+		} else if r.FormValue("disable") != "" {
+			err = tr.rwt.fs.CheckTwoFactor(tr.Domain, user, code, tr.rwt.now())
+			if err == nil {
+				err = tr.rwt.fs.SetTwoFactor(tr.Domain, user, "", nil)
+			}
+			tr.Message = "two-factor authentication is off"
+		} else {
+			secret := r.FormValue("secret")
+			secrets[user] = secret
+			if utils.CheckTOTP(secret, code, tr.rwt.now()) < 0 {
+				err = fmt.Errorf("incorrect code, check the clock of your device and try again")
+			}
+			// enrolling again replaces the secret and recovery codes, which
+			// takes a code of the ones it replaces, as turning it off does
+			var enrolled bool
+			if err == nil {
+				enrolled, err = tr.rwt.fs.HasTwoFactor(tr.Domain, user)
+			}
+			if err == nil && enrolled {
+				err = tr.rwt.fs.CheckTwoFactor(tr.Domain, user, r.FormValue("current_code"), tr.rwt.now())
+			}
+			if err == nil {
+				recoveryCodes[user], err = db.NewRecoveryCodes()
+			}
+			if err == nil {
+				err = tr.rwt.fs.SetTwoFactor(tr.Domain, user, secret, recoveryCodes[user])
+			}
+			tr.Message = "two-factor authentication is on"
+		}
+		if err != nil {
+			tr.Message = err.Error()
+		} else if user != "" {
+			tr.audit(r, db.AuditSettings, "", tr.Message+" for "+user)
+		} else {
+			tr.audit(r, db.AuditSettings, "", tr.Message+" for the domain")
+		}
+	}
+
+	// the member first, then the shared password of the domain
+	var users []string
+	if tr.User != "" {
+		users = append(users, tr.User)
+	}
+	if tr.IsAdmin() {
+		users = append(users, "")
+	}
+	tr.TwoFactors = make([]TwoFactor, len(users))
+	for i, user := range users {
+		tf := TwoFactor{User: user, RecoveryCodes: recoveryCodes[user]}
+		tf.Enrolled, err = tr.rwt.fs.HasTwoFactor(tr.Domain, user)
+		if err != nil {
+			return
+		}
+		if !tf.Enrolled {
+			tf.Secret = secrets[user]
+			if tf.Secret == "" {
+				tf.Secret, err = utils.NewTOTPSecret()
+				if err != nil {
+					return
+				}
+			}
+			account := tr.Domain
+			if user != "" {
+				account = user
+			}
+			var png []byte
+			png, err = qrcode.Encode(utils.TOTPURL("rwtxt", account, tf.Secret), qrcode.Medium, 256)
+			if err != nil {
+				return
+			}
+			tf.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		}
+		tr.TwoFactors[i] = tf
+	}
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "two-factor | " + tr.Domain
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.twoFactorTemplate.Execute(gz, tr)
+}
+
+// handleShare shows the page of a share link, read-only, to anyone who has
+// the link.
+func (tr *TemplateRender) handleShare(w http.ResponseWriter, r *http.Request, token string) (err error) {
+	share, errShare := tr.rwt.fs.UseShare(token)
+	if errShare != nil {
+		log.Debug(errShare)
+		http.Error(w, "share link does not exist or has expired", http.StatusNotFound)
+		return
+	}
+	files, errGet := tr.rwt.fs.Get(share.FileID, share.Domain)
+	if errGet != nil || len(files) == 0 || strings.TrimSpace(files[0].Data) == "" {
+		http.Error(w, "page no longer exists", http.StatusNotFound)
+		return
+	}
+
+	// nothing of the domain is shown but the page
+	tr.Shared = true
+	tr.Domain = share.Domain
+	tr.SignedIn = false
+	tr.DomainKey = ""
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.File = files[0]
+	tr.render(tr.File)
+
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.viewEditTemplate.Execute(gz, tr)
+}
+
+// handleShares lists the share links of a page. Posting creates a link, which
+// is shown once, with the optional days until it expires and number of
+// views, and posting revoke and an id deletes one.
+func (tr *TemplateRender) handleShares(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.CanEdit() || tr.Domain == "public" {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an editor")), 302)
+		return
+	}
+	pageID, many, err := tr.rwt.fs.Exists(tr.Page, tr.Domain)
+	if err != nil {
+		return
+	}
+	if pageID == "" || many {
+		http.Redirect(w, r, "/"+tr.Domain+"/"+tr.Page, 302)
+		return
+	}
+	files, err := tr.rwt.fs.Get(pageID, tr.Domain)
+	if err != nil {
+		return
+	}
+	tr.File = files[0]
+
+	if r.Method == "POST" {
+		if r.FormValue("revoke") != "" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			err = tr.rwt.fs.DeleteShare(tr.Domain, id)
+			if err == nil {
+				tr.Message = "link revoked"
+				tr.audit(r, db.AuditSettings, pageID, fmt.Sprintf("revoked share link %d", id))
+			}
+		} else {
+			var expires *time.Time
+			if days, _ := strconv.Atoi(r.FormValue("days")); days > 0 {
+				t := time.Now().UTC().Add(time.Duration(days) * 24 * time.Hour)
+				expires = &t
+			}
+			views, _ := strconv.Atoi(r.FormValue("views"))
+			var token string
+			var share db.Share
+			token, share, err = tr.rwt.fs.CreateShare(tr.Domain, pageID, expires, views)
+			if err == nil {
+				tr.NewShare = "/s/" + token
+				tr.audit(r, db.AuditSettings, pageID, fmt.Sprintf("created share link %d", share.ID))
+			}
+		}
+		if err != nil {
+			tr.Message = err.Error()
+		}
+	}
+
+	tr.Shares, err = tr.rwt.fs.GetShares(tr.Domain, pageID)
+	if err != nil {
+		return
+	}
+	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.Title = "share | " + tr.File.Slug + " | " + tr.Domain
+	tr.NumResults = len(tr.Shares)
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.sharesTemplate.Execute(gz, tr)
+}
+
+// handleHistory lists the versions of a page and shows the changes between
+// two of them, by default the ?to= version and the one before it. Posting a
+// version restores it by saving it as the newest one.
+func (tr *TemplateRender) handleHistory(w http.ResponseWriter, r *http.Request) (err error) {
+	var errGet error
+	_, tr.DomainIsPublic, tr.Options, errGet = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if errGet != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain does not exist")), 302)
+		return
+	}
+	if !tr.SignedIn && !tr.DomainIsPublic {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain is not public, sign in first")), 302)
+		return
+	}
+
+	pageID, many, err := tr.rwt.fs.Exists(tr.Page, tr.Domain)
+	if err != nil {
+		return
+	}
+	if pageID == "" || many {
+		http.Redirect(w, r, "/"+tr.Domain+"/"+tr.Page, 302)
+		return
+	}
+	files, err := tr.rwt.fs.Get(pageID, tr.Domain)
+	if err != nil {
+		return
+	}
+	f := files[0]
+	revisions, err := f.Revisions()
+	if err != nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		if !tr.CanEdit() {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be an editor")), 302)
+			return
+		}
+		version, _ := strconv.ParseInt(r.FormValue("version"), 10, 64)
+		for _, revision := range revisions {
+			if revision.Timestamp != version {
+				continue
+			}
+			f.Data = revision.Data
+			f.Domain = tr.Domain
+			err = tr.rwt.fs.Save(f)
+			if err != nil {
+				return
+			}
+			tr.audit(r, db.AuditSave, f.ID, "restored the version of "+time.Unix(0, revision.Timestamp).UTC().Format("2006-01-02 15:04:05"))
+			http.Redirect(w, r, "/"+tr.Domain+"/"+f.ID, 302)
+			return
+		}
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("no such version")), 302)
+		return
+	}
+
+	to, _ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+	from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	for i, revision := range revisions {
+		if revision.Timestamp != to {
+			continue
+		}
+		tr.DiffTo = revision
+		if from == 0 && i > 0 {
+			tr.DiffFrom = revisions[i-1]
+		}
+	}
+	for _, revision := range revisions {
+		if revision.Timestamp == from {
+			tr.DiffFrom = revision
+		}
+	}
+	if tr.DiffTo.Timestamp != 0 {
+		tr.Diff = utils.RenderDiffToHTML(tr.DiffFrom.Data, tr.DiffTo.Data)
+	}
+
+	// most recent first
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+	tr.File = f
+	tr.Revisions = revisions
+	tr.NumResults = len(revisions)
+	tr.Title = "history | " + f.Slug + " | " + tr.Domain
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	return tr.rwt.historyTemplate.Execute(gz, tr)
+}
+
 func (tr *TemplateRender) handleExport(w http.ResponseWriter, r *http.Request) (err error) {
 	log.Debug("exporting")
 	if tr.Domain == "public" {
@@ -935,3 +1623,8 @@ func (tr *TemplateRender) handleExport(w http.ResponseWriter, r *http.Request) (
 func replace(input, from, to string) string {
 	return strings.Replace(input, from, to, -1)
 }
+
+// inc returns i + 1, to number lists from one.
+func inc(i int) int {
+	return i + 1
+}